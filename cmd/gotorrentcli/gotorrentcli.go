@@ -3,32 +3,120 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/lezhenin/gotorrentclient/pkg/dht"
+	"github.com/lezhenin/gotorrentclient/pkg/lsd"
 	"github.com/lezhenin/gotorrentclient/pkg/torrent"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 )
 
+var dhtRouters = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+func startDHT(port int, statePath string) (node *dht.DHT, err error) {
+
+	node, err = dht.NewDHT(fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	err = node.LoadState(statePath)
+	if err != nil {
+		fmt.Printf("DHT state is not loaded: %v\n", err)
+	}
+
+	go func() {
+		_ = node.Start()
+	}()
+
+	err = node.Bootstrap(dhtRouters)
+	if err != nil {
+		fmt.Printf("DHT bootstrap failed: %v\n", err)
+	}
+
+	return node, nil
+}
+
+// setFilePriorities sets the priority of the files with comma separated indices
+func setFilePriorities(download *torrent.Download, indices string, priority torrent.Priority) (err error) {
+
+	if indices == "" {
+		return nil
+	}
+
+	for _, item := range strings.Split(indices, ",") {
+
+		index, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return err
+		}
+
+		err = download.SetFilePriority(index, priority)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func main() {
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 
 	torrentFilePath := flag.String("t", "", "Path to .torrent file")
+	magnetLink := flag.String("m", "", "Magnet link, used instead of .torrent file")
 	downloadDirPath := flag.String("o", "", "Path to output directory")
 	keepSeeding := flag.Bool("s", false, "Keep seeding when download finished")
+	showSwarm := flag.Bool("i", false, "Print seeders and leechers reported by trackers before download")
+	useDHT := flag.Bool("d", false, "Find peers with DHT")
+	dhtPort := flag.Int("dht-port", 6881, "UDP port of DHT node")
+	dhtStatePath := flag.String("dht-state", "dht.dat", "Path to file with DHT node state kept between runs")
+	useLSD := flag.Bool("l", false, "Find peers in local network with local service discovery")
+	lsdInterfaces := flag.String("lsd-if", "",
+		"Comma separated names of interfaces used for local service discovery, all by default")
+	requestQueueDepth := flag.Int("q", torrent.DefaultRequestQueueDepth,
+		"Maximal number of outstanding block requests to a peer")
+	uploadSlots := flag.Int("u", torrent.DefaultUploadSlots,
+		"Number of peers unchoked for their rate, one more peer is unchoked optimistically")
+	maxConnections := flag.Int("c", torrent.DefaultMaxConnections, "Maximal number of connected peers")
+	snubInterval := flag.Duration("snub", torrent.DefaultSnubInterval,
+		"Time without received blocks after which requests to a peer are passed to other peers")
+	uploadLimit := flag.Int64("up-limit", 0, "Upload rate limit of all torrents in KiB/s, 0 - no limit")
+	downloadLimit := flag.Int64("down-limit", 0, "Download rate limit of all torrents in KiB/s, 0 - no limit")
+	torrentUploadLimit := flag.Int64("torrent-up-limit", 0, "Upload rate limit of the torrent in KiB/s, 0 - no limit")
+	torrentDownloadLimit := flag.Int64("torrent-down-limit", 0,
+		"Download rate limit of the torrent in KiB/s, 0 - no limit")
+	skipFiles := flag.String("skip", "", "Comma separated indices of files which are not downloaded")
+	highFiles := flag.String("high", "", "Comma separated indices of files which are downloaded first")
+	recheck := flag.Bool("recheck", false, "Verify downloaded files instead of loading resume data")
+	useMmap := flag.Bool("mmap", false, "Access downloaded files through memory mappings")
+	cacheSize := flag.Int64("cache", torrent.DefaultCacheSize/1024/1024,
+		"Memory budget of block cache of all torrents in MiB, 0 - no cache")
 	verbosity := flag.Int("v", 2,
 		"Verbosity level: 0 - error, 1 - warning, 2 - info, 3 - debug, 4 - trace")
 
 	flag.Parse()
 
-	if *torrentFilePath == "" || *downloadDirPath == "" {
-		fmt.Println("Path to .torrent file or output directory is not specified")
+	if (*torrentFilePath == "" && *magnetLink == "") || *downloadDirPath == "" {
+		fmt.Println("Path to .torrent file, magnet link or output directory is not specified")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	fmt.Printf("Download %s to %s\n", *torrentFilePath, *downloadDirPath)
+	source := *torrentFilePath
+	if source == "" {
+		source = *magnetLink
+	}
+
+	fmt.Printf("Download %s to %s\n", source, *downloadDirPath)
 
 	switch *verbosity {
 	case 0:
@@ -43,20 +131,117 @@ func main() {
 		torrent.SetLoggerLevel(torrent.AllLoggers, torrent.TraceLevel)
 	}
 
-	metadata, err := torrent.NewMetadata(*torrentFilePath)
+	var metadata *torrent.Metadata
+	var node *dht.DHT
+	var err error
+
+	if *useDHT {
+		node, err = startDHT(*dhtPort, *dhtStatePath)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if *torrentFilePath != "" {
+		metadata, err = torrent.NewMetadata(*torrentFilePath)
+	} else {
+		var magnet *torrent.Magnet
+		magnet, err = torrent.ParseMagnet(*magnetLink)
+		if err == nil {
+			fmt.Println("Fetch metadata from peers")
+			metadata, err = torrent.NewMetadataFromMagnet(magnet, node)
+		}
+	}
+
+	if err != nil {
+		panic(err)
+	}
+
+	newDownload := torrent.NewDownload
+	if *useMmap {
+		newDownload = torrent.NewMmapDownload
+	}
+
+	download, err := newDownload(metadata, *downloadDirPath)
+
 	if err != nil {
 		panic(err)
 	}
 
-	download, err := torrent.NewDownload(metadata, *downloadDirPath)
+	download.DHT = node
+	download.RequestQueueDepth = *requestQueueDepth
+	download.UploadSlots = *uploadSlots
+	download.SnubInterval = *snubInterval
+	download.MaxConnections = *maxConnections
+	download.ForceRecheck = *recheck
+
+	err = setFilePriorities(download, *skipFiles, torrent.PrioritySkip)
+	if err == nil {
+		err = setFilePriorities(download, *highFiles, torrent.PriorityHigh)
+	}
 
 	if err != nil {
 		panic(err)
 	}
 
+	torrent.SetGlobalUploadLimit(*uploadLimit * 1024)
+	torrent.SetGlobalDownloadLimit(*downloadLimit * 1024)
+	torrent.SetCacheSize(*cacheSize * 1024 * 1024)
+	download.SetUploadLimit(*torrentUploadLimit * 1024)
+	download.SetDownloadLimit(*torrentDownloadLimit * 1024)
+
+	var localDiscovery *lsd.LSD
+
+	if *useLSD {
+
+		var interfaces []string
+		if *lsdInterfaces != "" {
+			interfaces = strings.Split(*lsdInterfaces, ",")
+		}
+
+		localDiscovery, err = lsd.NewLSD(interfaces)
+		if err != nil {
+			panic(err)
+		}
+
+		go func() {
+			_ = localDiscovery.Start()
+		}()
+
+		download.LSD = localDiscovery
+	}
+
+	if *showSwarm {
+		swarm, err := download.Scrape()
+		if err != nil {
+			fmt.Printf("Can not get swarm info: %v\n", err)
+		} else {
+			fmt.Printf("Seeders: %d, leechers: %d, completed: %d\n",
+				swarm.SeedersCount, swarm.LechersCount, swarm.CompletedCount)
+		}
+	}
+
 	var wait sync.WaitGroup
 	wait.Add(1)
 
+	stop := func() {
+		err := download.Close()
+		if err != nil {
+			fmt.Printf("Download is not closed: %v\n", err)
+		}
+		wait.Wait()
+		if node != nil {
+			err := node.SaveState(*dhtStatePath)
+			if err != nil {
+				fmt.Printf("DHT state is not saved: %v\n", err)
+			}
+			node.Close()
+		}
+		if localDiscovery != nil {
+			localDiscovery.Close()
+		}
+	}
+
 	go func() {
 		defer wait.Done()
 		download.Start()
@@ -67,13 +252,11 @@ func main() {
 		select {
 		case <-download.Done:
 			if !*keepSeeding {
-				download.Stop()
-				wait.Wait()
+				stop()
 				os.Exit(0)
 			}
 		case <-signals:
-			download.Stop()
-			wait.Wait()
+			stop()
 			os.Exit(130)
 		}
 	}
@@ -88,6 +88,28 @@ func NewAddDialog() (dialog *AddDialog, err error) {
 		return nil, err
 	}
 
+	magnetLabel, err := gtk.LabelNew("Magnet link:")
+	if err != nil {
+		return nil, err
+	}
+
+	magnetLabel.SetHAlign(gtk.ALIGN_START)
+
+	magnetEntry, err := gtk.EntryNew()
+	if err != nil {
+		return nil, err
+	}
+
+	magnetEntry.SetHExpand(true)
+
+	_, err = magnetEntry.Connect("activate", func(entry *gtk.Entry) {
+		dialog.onMagnetSet(entry)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
 	folderChooserLabel, err := gtk.LabelNew("Download folder:")
 	if err != nil {
 		return nil, err
@@ -145,9 +167,11 @@ func NewAddDialog() (dialog *AddDialog, err error) {
 
 	grid.Attach(fileChooserLabel, 0, 0, 1, 1)
 	grid.Attach(fileChooserBtn, 1, 0, 1, 1)
-	grid.Attach(folderChooserLabel, 0, 1, 1, 1)
-	grid.Attach(folderChooserBtn, 1, 1, 1, 1)
-	grid.Attach(scrolledWindow, 0, 2, 2, 1)
+	grid.Attach(magnetLabel, 0, 1, 1, 1)
+	grid.Attach(magnetEntry, 1, 1, 1, 1)
+	grid.Attach(folderChooserLabel, 0, 2, 1, 1)
+	grid.Attach(folderChooserBtn, 1, 2, 1, 1)
+	grid.Attach(scrolledWindow, 0, 3, 2, 1)
 	grid.SetHExpand(true)
 	grid.SetVExpand(true)
 
@@ -186,6 +210,54 @@ func (d *AddDialog) onFileSet(button *gtk.FileChooserButton) {
 		log.Fatal(err)
 	}
 
+	d.showMetadata()
+}
+
+func (d *AddDialog) onMagnetSet(entry *gtk.Entry) {
+
+	text, err := entry.GetText()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	magnet, err := torrent.ParseMagnet(text)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	d.isMetadataLoaded = false
+	d.treeStore.Clear()
+	d.addRow("Fetching metadata...", 0)
+
+	// metadata is fetched from peers, it can take a while
+	go func() {
+
+		metadata, err := torrent.NewMetadataFromMagnet(magnet, nil)
+
+		_, idleErr := glib.IdleAdd(func() bool {
+			d.treeStore.Clear()
+			if err != nil {
+				log.Println(err)
+				d.addRow("Can not fetch metadata", 0)
+				return false
+			}
+			d.metadata = metadata
+			d.showMetadata()
+			return false
+		})
+
+		if idleErr != nil {
+			log.Println(idleErr)
+		}
+	}()
+}
+
+func (d *AddDialog) showMetadata() {
+
+	d.treeStore.Clear()
+
 	iter := d.addRow(d.metadata.Info.Name, d.metadata.Info.TotalLength)
 
 	iters := make(map[string]*gtk.TreeIter)
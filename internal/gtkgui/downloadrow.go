@@ -5,6 +5,7 @@ import (
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
 	"github.com/lezhenin/gotorrentclient/pkg/torrent"
+	"log"
 	"path"
 )
 
@@ -17,6 +18,7 @@ type DownloadRow struct {
 	nameLabel   *gtk.Label
 	stateLabel  *gtk.Label
 	speedLabel  *gtk.Label
+	swarmLabel  *gtk.Label
 
 	lastDownloaded float64
 
@@ -72,9 +74,17 @@ func NewDownloadRow(download *torrent.Download) (row *DownloadRow, err error) {
 	row.speedLabel, err = gtk.LabelNew("0 MiB/sec")
 	row.speedLabel.SetHAlign(gtk.ALIGN_END)
 
+	row.swarmLabel, err = gtk.LabelNew("")
+	if err != nil {
+		return nil, err
+	}
+
+	row.swarmLabel.SetHAlign(gtk.ALIGN_START)
+
 	grid.Attach(row.nameLabel, 0, 0, 1, 1)
 	grid.Attach(row.stateLabel, 1, 0, 1, 1)
 	grid.Attach(row.progressBar, 0, 1, 2, 1)
+	grid.Attach(row.swarmLabel, 0, 2, 1, 1)
 	grid.Attach(row.speedLabel, 1, 2, 1, 1)
 
 	row.Add(grid)
@@ -116,6 +126,27 @@ func (r *DownloadRow) onTimerTick() bool {
 
 }
 
+func (r *DownloadRow) updateSwarm() {
+
+	swarm, err := r.download.Scrape()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	swarmText := fmt.Sprintf("%d seeders, %d leechers",
+		swarm.SeedersCount, swarm.LechersCount)
+
+	_, err = glib.IdleAdd(func() bool {
+		r.swarmLabel.SetText(swarmText)
+		return false
+	})
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func (r *DownloadRow) Start() (err error) {
 
 	if !r.download.State.Stopped() {
@@ -132,6 +163,10 @@ func (r *DownloadRow) Start() (err error) {
 		return err
 	}
 
+	go func() {
+		r.updateSwarm()
+	}()
+
 	go func() {
 		r.download.Start()
 	}()
@@ -0,0 +1,588 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/bencode"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const queryTimeout = 2 * time.Second
+
+// number of concurrent queries of a lookup
+const alpha = 3
+
+const maxDatagramLength = 65535
+
+type transaction struct {
+	address   *net.UDPAddr
+	responses chan *message
+}
+
+// DHT is a node of mainline DHT (BEP 5), it serves queries of other nodes
+// and finds peers of torrents without trackers
+type DHT struct {
+	Id []byte
+
+	connection *net.UDPConn
+
+	table  *routingTable
+	tokens *tokenManager
+	peers  *peerStore
+
+	transactions  map[string]*transaction
+	transactionId uint16
+	mutex         sync.Mutex
+
+	closeChannel chan struct{}
+	closeOnce    sync.Once
+	wait         sync.WaitGroup
+}
+
+func NewDHT(address string) (dht *DHT, err error) {
+
+	udpAddress, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return nil, errors.Annotate(err, "new dht")
+	}
+
+	dht = new(DHT)
+
+	dht.connection, err = net.ListenUDP("udp4", udpAddress)
+	if err != nil {
+		return nil, errors.Annotate(err, "new dht")
+	}
+
+	dht.Id = make([]byte, idLength)
+	_, err = rand.Read(dht.Id)
+	if err != nil {
+		_ = dht.connection.Close()
+		return nil, errors.Annotate(err, "new dht")
+	}
+
+	dht.table = newRoutingTable(dht.Id)
+	dht.tokens = newTokenManager()
+	dht.peers = newPeerStore()
+
+	dht.transactions = make(map[string]*transaction)
+	dht.closeChannel = make(chan struct{})
+
+	return dht, nil
+}
+
+func (d *DHT) Address() string {
+	return d.connection.LocalAddr().String()
+}
+
+func (d *DHT) NodeCount() int {
+	return d.table.length()
+}
+
+// Start serves incoming messages until the node is closed
+func (d *DHT) Start() (err error) {
+
+	d.wait.Add(1)
+	defer d.wait.Done()
+
+	buffer := make([]byte, maxDatagramLength)
+
+	for {
+
+		n, address, err := d.connection.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-d.closeChannel:
+				return nil
+			default:
+				return errors.Annotate(err, "dht start")
+			}
+		}
+
+		d.handleDatagram(append([]byte{}, buffer[:n]...), address)
+	}
+}
+
+func (d *DHT) Close() {
+
+	d.closeOnce.Do(func() {
+		close(d.closeChannel)
+		_ = d.connection.Close()
+	})
+
+	d.wait.Wait()
+}
+
+func (d *DHT) handleDatagram(data []byte, address *net.UDPAddr) {
+
+	m, err := parseMessage(data)
+	if err != nil {
+		dhtLogger.WithFields(logrus.Fields{
+			"address": address,
+		}).Debug(err.Error())
+		return
+	}
+
+	if m.Type == queryType {
+		d.handleQuery(m, address)
+		return
+	}
+
+	d.mutex.Lock()
+
+	t, ok := d.transactions[m.TransactionId]
+	if ok && t.address.String() == address.String() {
+		delete(d.transactions, m.TransactionId)
+	} else {
+		ok = false
+	}
+
+	d.mutex.Unlock()
+
+	if !ok {
+		dhtLogger.WithFields(logrus.Fields{
+			"address": address,
+		}).Debug("unexpected response")
+		return
+	}
+
+	t.responses <- m
+}
+
+func (d *DHT) handleQuery(m *message, address *net.UDPAddr) {
+
+	id, ok := getId(m.Arguments, "id")
+	if !ok {
+		d.send(makeError(m.TransactionId, protocolError, "id is absent"), address)
+		return
+	}
+
+	// read-only nodes don't respond to queries (BEP 43)
+	if readOnly, _ := getInt(m.Arguments, "ro"); readOnly != 1 {
+		d.addNode(id, address)
+	}
+
+	response := map[string]interface{}{"id": string(d.Id)}
+
+	switch m.Query {
+
+	case "ping":
+
+	case "find_node":
+
+		target, ok := getId(m.Arguments, "target")
+		if !ok {
+			d.send(makeError(m.TransactionId, protocolError, "target is absent"), address)
+			return
+		}
+
+		response["nodes"] = string(makeCompactNodes(d.table.closest(target, k)))
+
+	case "get_peers":
+
+		infoHash, ok := getId(m.Arguments, "info_hash")
+		if !ok {
+			d.send(makeError(m.TransactionId, protocolError, "info_hash is absent"), address)
+			return
+		}
+
+		response["token"] = string(d.tokens.make(address.IP))
+		response["nodes"] = string(makeCompactNodes(d.table.closest(infoHash, k)))
+
+		values := d.peers.get(infoHash)
+		if len(values) > 0 {
+			response["values"] = values
+		}
+
+	case "announce_peer":
+
+		infoHash, ok := getId(m.Arguments, "info_hash")
+		if !ok {
+			d.send(makeError(m.TransactionId, protocolError, "info_hash is absent"), address)
+			return
+		}
+
+		token, _ := getString(m.Arguments, "token")
+		if !d.tokens.valid([]byte(token), address.IP) {
+			d.send(makeError(m.TransactionId, protocolError, "bad token"), address)
+			return
+		}
+
+		port, _ := getInt(m.Arguments, "port")
+		if impliedPort, _ := getInt(m.Arguments, "implied_port"); impliedPort == 1 {
+			port = int64(address.Port)
+		}
+
+		if port <= 0 || port > 65535 {
+			d.send(makeError(m.TransactionId, protocolError, "bad port"), address)
+			return
+		}
+
+		d.peers.add(infoHash, &net.UDPAddr{IP: address.IP, Port: int(port)})
+
+	default:
+		d.send(makeError(m.TransactionId, methodUnknown, "method unknown"), address)
+		return
+	}
+
+	d.send(makeResponse(m.TransactionId, response), address)
+}
+
+func (d *DHT) send(data []byte, address *net.UDPAddr) {
+
+	_, err := d.connection.WriteToUDP(data, address)
+	if err != nil {
+		dhtLogger.WithFields(logrus.Fields{
+			"address": address,
+		}).Debug(err.Error())
+	}
+}
+
+// addNode updates the routing table, the oldest questionable node
+// of a full bucket is replaced if it doesn't respond to ping
+func (d *DHT) addNode(id []byte, address *net.UDPAddr) {
+
+	oldest := d.table.update(id, address)
+	if oldest == nil {
+		return
+	}
+
+	go func() {
+		_, err := d.query(oldest.address, "ping", map[string]interface{}{})
+		if err != nil {
+			d.table.remove(oldest.id)
+			d.table.update(id, address)
+		}
+	}()
+}
+
+func (d *DHT) query(address *net.UDPAddr, method string,
+	arguments map[string]interface{}) (response map[string]interface{}, err error) {
+
+	arguments["id"] = string(d.Id)
+
+	t := &transaction{address, make(chan *message, 1)}
+
+	d.mutex.Lock()
+	d.transactionId++
+	transactionId := string([]byte{byte(d.transactionId >> 8), byte(d.transactionId)})
+	d.transactions[transactionId] = t
+	d.mutex.Unlock()
+
+	defer func() {
+		d.mutex.Lock()
+		delete(d.transactions, transactionId)
+		d.mutex.Unlock()
+	}()
+
+	_, err = d.connection.WriteToUDP(makeQuery(transactionId, method, arguments), address)
+	if err != nil {
+		return nil, errors.Annotate(err, "dht query")
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+
+	case m := <-t.responses:
+
+		if m.Type == errorType {
+			return nil, errors.Annotate(m.Error, "dht query")
+		}
+
+		id, ok := getId(m.Response, "id")
+		if !ok {
+			return nil, errors.Errorf("dht query: id is absent")
+		}
+
+		d.addNode(id, address)
+
+		return m.Response, nil
+
+	case <-timer.C:
+		d.table.failed(address)
+		return nil, errors.Timeoutf("dht query: %s to %s", method, address)
+
+	case <-d.closeChannel:
+		return nil, errors.Errorf("dht query: node is closed")
+	}
+}
+
+type lookupNode struct {
+	node      *node
+	token     string
+	queried   bool
+	responded bool
+	failed    bool
+}
+
+type lookupResult struct {
+	node     *lookupNode
+	response map[string]interface{}
+	err      error
+}
+
+// lookup queries the nodes closer and closer to the target until k closest
+// nodes have responded, get_peers lookup collects peers of the nodes
+func (d *DHT) lookup(target []byte, method string) (closest []*lookupNode, peers []string) {
+
+	seen := make(map[string]bool)
+	peerSet := make(map[string]bool)
+
+	var candidates []*lookupNode
+
+	addCandidate := func(n *node) {
+		if seen[n.address.String()] || bytes.Equal(n.id, d.Id) {
+			return
+		}
+		seen[n.address.String()] = true
+		candidates = append(candidates, &lookupNode{node: n})
+	}
+
+	for _, n := range d.table.closest(target, k) {
+		addCandidate(n)
+	}
+
+	argumentName := "target"
+	if method == "get_peers" {
+		argumentName = "info_hash"
+	}
+
+	for {
+
+		sort.Slice(candidates, func(i, j int) bool {
+			return bytes.Compare(distance(candidates[i].node.id, target),
+				distance(candidates[j].node.id, target)) < 0
+		})
+
+		var batch []*lookupNode
+		count := 0
+
+		for _, candidate := range candidates {
+			if count == k {
+				break
+			}
+			if candidate.failed {
+				continue
+			}
+			count++
+			if !candidate.queried && len(batch) < alpha {
+				candidate.queried = true
+				batch = append(batch, candidate)
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan lookupResult, len(batch))
+
+		for _, candidate := range batch {
+			go func(candidate *lookupNode) {
+				response, err := d.query(candidate.node.address, method,
+					map[string]interface{}{argumentName: string(target)})
+				results <- lookupResult{candidate, response, err}
+			}(candidate)
+		}
+
+		for range batch {
+
+			result := <-results
+
+			if result.err != nil {
+				result.node.failed = true
+				dhtLogger.Debug(result.err.Error())
+				continue
+			}
+
+			result.node.responded = true
+			result.node.token, _ = getString(result.response, "token")
+
+			nodes, _ := getString(result.response, "nodes")
+			for _, n := range parseCompactNodes([]byte(nodes)) {
+				addCandidate(n)
+			}
+
+			values, _ := result.response["values"].([]interface{})
+			for _, peer := range parseCompactPeers(values) {
+				if !peerSet[peer] {
+					peerSet[peer] = true
+					peers = append(peers, peer)
+				}
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if len(closest) == k {
+			break
+		}
+		if candidate.responded {
+			closest = append(closest, candidate)
+		}
+	}
+
+	return closest, peers
+}
+
+// Bootstrap fills the routing table with nodes close to the node,
+// the addresses are used as entry points to the network
+func (d *DHT) Bootstrap(addresses []string) (err error) {
+
+	var wait sync.WaitGroup
+	var responded int32
+
+	for _, address := range addresses {
+
+		udpAddress, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			dhtLogger.WithFields(logrus.Fields{
+				"address": address,
+			}).Warn(errors.Annotate(err, "dht bootstrap").Error())
+			continue
+		}
+
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+			_, err := d.query(udpAddress, "find_node", map[string]interface{}{"target": string(d.Id)})
+			if err == nil {
+				atomic.AddInt32(&responded, 1)
+			}
+		}()
+	}
+
+	wait.Wait()
+
+	closest, _ := d.lookup(d.Id, "find_node")
+
+	if responded == 0 && len(closest) == 0 {
+		return errors.Errorf("dht bootstrap: no node responded")
+	}
+
+	dhtLogger.WithFields(logrus.Fields{
+		"nodes": d.table.length(),
+	}).Info("dht bootstrapped")
+
+	return nil
+}
+
+func (d *DHT) GetPeers(infoHash []byte) (peers []string, err error) {
+
+	if d.table.length() == 0 {
+		return nil, errors.Errorf("dht get peers: routing table is empty")
+	}
+
+	_, peers = d.lookup(infoHash, "get_peers")
+
+	return peers, nil
+}
+
+// AnnouncePeer finds peers of the torrent and announces
+// that the peer listening on the port has it
+func (d *DHT) AnnouncePeer(infoHash []byte, port uint16) (peers []string, err error) {
+
+	if d.table.length() == 0 {
+		return nil, errors.Errorf("dht announce peer: routing table is empty")
+	}
+
+	closest, peers := d.lookup(infoHash, "get_peers")
+
+	announced := make(chan bool, len(closest))
+
+	for _, candidate := range closest {
+		go func(candidate *lookupNode) {
+			_, err := d.query(candidate.node.address, "announce_peer", map[string]interface{}{
+				"info_hash":    string(infoHash),
+				"port":         int64(port),
+				"token":        candidate.token,
+				"implied_port": int64(0),
+			})
+			announced <- err == nil
+		}(candidate)
+	}
+
+	count := 0
+	for range closest {
+		if <-announced {
+			count++
+		}
+	}
+
+	dhtLogger.WithFields(logrus.Fields{
+		"infoHash": infoHash,
+		"peers":    len(peers),
+		"nodes":    count,
+	}).Debug("peer announced")
+
+	if count == 0 {
+		return peers, errors.Errorf("dht announce peer: no node accepted announce")
+	}
+
+	return peers, nil
+}
+
+// SaveState writes id of the node and nodes of the routing table to the file
+func (d *DHT) SaveState(path string) (err error) {
+
+	data, err := bencode.EncodeBytes(map[string]interface{}{
+		"id":    string(d.Id),
+		"nodes": string(makeCompactNodes(d.table.nodes())),
+	})
+	if err != nil {
+		return errors.Annotate(err, "dht save state")
+	}
+
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		return errors.Annotate(err, "dht save state")
+	}
+
+	return nil
+}
+
+// LoadState restores the node saved with SaveState,
+// it must be called before the node is started
+func (d *DHT) LoadState(path string) (err error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Annotate(err, "dht load state")
+	}
+
+	var decoded interface{}
+
+	err = bencode.DecodeBytes(data, &decoded)
+	if err != nil {
+		return errors.Annotate(err, "dht load state")
+	}
+
+	state, ok := decoded.(map[string]interface{})
+	if !ok {
+		return errors.Errorf("dht load state: state is not dictionary")
+	}
+
+	id, ok := getId(state, "id")
+	if !ok {
+		return errors.Errorf("dht load state: id is absent")
+	}
+
+	d.Id = id
+	d.table = newRoutingTable(id)
+
+	nodes, _ := getString(state, "nodes")
+	for _, n := range parseCompactNodes([]byte(nodes)) {
+		d.table.add(n.id, n.address)
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package dht
+
+import (
+	"crypto/rand"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dhtLogger.SetLevel(logrus.ErrorLevel)
+	os.Exit(m.Run())
+}
+
+func startTestNode(t *testing.T) (node *DHT) {
+
+	node, err := NewDHT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = node.Start()
+	}()
+
+	return node
+}
+
+func startTestNetwork(t *testing.T, count int) (nodes []*DHT) {
+
+	for i := 0; i < count; i++ {
+		nodes = append(nodes, startTestNode(t))
+	}
+
+	for _, node := range nodes[1:] {
+		err := node.Bootstrap([]string{nodes[0].Address()})
+		assert.NoError(t, err, "bootstrap finished with error")
+	}
+
+	return nodes
+}
+
+func closeTestNetwork(nodes []*DHT) {
+	for _, node := range nodes {
+		node.Close()
+	}
+}
+
+func makeTestInfoHash() (infoHash []byte) {
+	infoHash = make([]byte, idLength)
+	_, _ = rand.Read(infoHash)
+	return infoHash
+}
+
+func TestDHT_Ping(t *testing.T) {
+
+	nodes := startTestNetwork(t, 2)
+	defer closeTestNetwork(nodes)
+
+	address, _ := net.ResolveUDPAddr("udp4", nodes[1].Address())
+
+	response, err := nodes[0].query(address, "ping", map[string]interface{}{})
+	assert.NoError(t, err, "ping finished with error")
+	assert.EqualValues(t, nodes[1].Id, response["id"], "wrong id in response")
+
+	assert.Equal(t, 1, nodes[0].NodeCount(), "node is not added to routing table")
+	assert.Equal(t, 1, nodes[1].NodeCount(), "node is not added to routing table")
+}
+
+func TestDHT_AnnouncePeer(t *testing.T) {
+
+	nodes := startTestNetwork(t, 12)
+	defer closeTestNetwork(nodes)
+
+	for _, node := range nodes {
+		assert.True(t, node.NodeCount() > 1, "routing table is not filled")
+	}
+
+	infoHash := makeTestInfoHash()
+
+	peers, err := nodes[5].GetPeers(infoHash)
+	assert.NoError(t, err, "get peers finished with error")
+	assert.Empty(t, peers, "unexpected peers")
+
+	peers, err = nodes[3].AnnouncePeer(infoHash, 6881)
+	assert.NoError(t, err, "announce finished with error")
+	assert.Empty(t, peers, "unexpected peers")
+
+	peers, err = nodes[11].AnnouncePeer(infoHash, 6882)
+	assert.NoError(t, err, "announce finished with error")
+	assert.Equal(t, []string{"127.0.0.1:6881"}, peers, "announced peer is not found")
+
+	peers, err = nodes[7].GetPeers(infoHash)
+	assert.NoError(t, err, "get peers finished with error")
+	assert.ElementsMatch(t, []string{"127.0.0.1:6881", "127.0.0.1:6882"}, peers,
+		"announced peers are not found")
+}
+
+func TestDHT_AnnouncePeer_BadToken(t *testing.T) {
+
+	nodes := startTestNetwork(t, 2)
+	defer closeTestNetwork(nodes)
+
+	address, _ := net.ResolveUDPAddr("udp4", nodes[1].Address())
+	infoHash := makeTestInfoHash()
+
+	_, err := nodes[0].query(address, "announce_peer", map[string]interface{}{
+		"info_hash": string(infoHash),
+		"port":      int64(6881),
+		"token":     "wrong",
+	})
+
+	assert.Error(t, err, "announce with wrong token is accepted")
+	assert.IsType(t, KrpcError{}, errors.Cause(err), "unexpected error")
+	assert.EqualValues(t, protocolError, errors.Cause(err).(KrpcError).Code, "wrong error code")
+
+	response, err := nodes[0].query(address, "get_peers", map[string]interface{}{
+		"info_hash": string(infoHash),
+	})
+	assert.NoError(t, err, "get peers finished with error")
+
+	token, _ := getString(response, "token")
+
+	_, err = nodes[0].query(address, "announce_peer", map[string]interface{}{
+		"info_hash":    string(infoHash),
+		"port":         int64(6881),
+		"token":        token,
+		"implied_port": int64(1),
+	})
+	assert.NoError(t, err, "announce finished with error")
+
+	values := nodes[1].peers.get(infoHash)
+	assert.Equal(t, parseCompactPeers(values), []string{nodes[0].Address()},
+		"implied port is not used")
+
+	_, err = nodes[0].query(address, "unknown", map[string]interface{}{})
+	assert.Error(t, err, "unknown method is accepted")
+	assert.EqualValues(t, methodUnknown, errors.Cause(err).(KrpcError).Code, "wrong error code")
+}
+
+func TestDHT_Query_Timeout(t *testing.T) {
+
+	node := startTestNode(t)
+	defer node.Close()
+
+	closed := startTestNode(t)
+	address, _ := net.ResolveUDPAddr("udp4", closed.Address())
+	closed.Close()
+
+	node.table.update(closed.Id, address)
+
+	_, err := node.query(address, "ping", map[string]interface{}{})
+	assert.True(t, errors.IsTimeout(err), "query without response is not timed out")
+
+	err = node.Bootstrap([]string{closed.Address()})
+	assert.Error(t, err, "bootstrap without responses succeeded")
+}
+
+func TestDHT_State(t *testing.T) {
+
+	nodes := startTestNetwork(t, 5)
+	defer closeTestNetwork(nodes)
+
+	dir, err := ioutil.TempDir("", "TestDHT_State")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dht.dat")
+
+	err = nodes[1].SaveState(path)
+	assert.NoError(t, err, "save finished with error")
+
+	restored := startTestNode(t)
+	defer restored.Close()
+
+	err = restored.LoadState(path)
+	assert.NoError(t, err, "load finished with error")
+	assert.Equal(t, nodes[1].Id, restored.Id, "id is not restored")
+	assert.Equal(t, nodes[1].NodeCount(), restored.NodeCount(), "nodes are not restored")
+
+	err = restored.LoadState(filepath.Join(dir, "absent"))
+	assert.Error(t, err, "absent state is loaded")
+}
@@ -0,0 +1,245 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/zeebo/bencode"
+	"net"
+	"strconv"
+)
+
+// KRPC message types (BEP 5)
+const (
+	queryType    = "q"
+	responseType = "r"
+	errorType    = "e"
+)
+
+// KRPC error codes
+const (
+	genericError  = 201
+	serverError   = 202
+	protocolError = 203
+	methodUnknown = 204
+)
+
+const compactNodeLength = idLength + 6
+const compactPeerLength = 6
+
+type KrpcError struct {
+	Code    int64
+	Message string
+}
+
+func (e KrpcError) Error() string {
+	return fmt.Sprintf("node responded with error %d: %s", e.Code, e.Message)
+}
+
+type message struct {
+	TransactionId string
+	Type          string
+	Query         string
+	Arguments     map[string]interface{}
+	Response      map[string]interface{}
+	Error         KrpcError
+}
+
+func makeQuery(transactionId, query string, arguments map[string]interface{}) (data []byte) {
+	return encodeMessage(map[string]interface{}{
+		"t": transactionId,
+		"y": queryType,
+		"q": query,
+		"a": arguments,
+	})
+}
+
+func makeResponse(transactionId string, response map[string]interface{}) (data []byte) {
+	return encodeMessage(map[string]interface{}{
+		"t": transactionId,
+		"y": responseType,
+		"r": response,
+	})
+}
+
+func makeError(transactionId string, code int64, errorMessage string) (data []byte) {
+	return encodeMessage(map[string]interface{}{
+		"t": transactionId,
+		"y": errorType,
+		"e": []interface{}{code, errorMessage},
+	})
+}
+
+func encodeMessage(value map[string]interface{}) (data []byte) {
+
+	data, err := bencode.EncodeBytes(value)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+func parseMessage(data []byte) (m *message, err error) {
+
+	var decoded interface{}
+
+	err = bencode.DecodeBytes(data, &decoded)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse message")
+	}
+
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("parse message: message is not dictionary")
+	}
+
+	m = new(message)
+
+	m.TransactionId, ok = getString(dict, "t")
+	if !ok {
+		return nil, errors.Errorf("parse message: transaction id is absent")
+	}
+
+	m.Type, ok = getString(dict, "y")
+	if !ok {
+		return nil, errors.Errorf("parse message: type is absent")
+	}
+
+	switch m.Type {
+
+	case queryType:
+
+		m.Query, ok = getString(dict, "q")
+		if !ok {
+			return nil, errors.Errorf("parse message: query method is absent")
+		}
+
+		m.Arguments, ok = getDict(dict, "a")
+		if !ok {
+			return nil, errors.Errorf("parse message: query arguments are absent")
+		}
+
+	case responseType:
+
+		m.Response, ok = getDict(dict, "r")
+		if !ok {
+			return nil, errors.Errorf("parse message: response is absent")
+		}
+
+	case errorType:
+
+		values, ok := dict["e"].([]interface{})
+		if !ok || len(values) < 2 {
+			return nil, errors.Errorf("parse message: error is absent")
+		}
+
+		m.Error.Code, _ = values[0].(int64)
+		m.Error.Message, _ = values[1].(string)
+
+	default:
+		return nil, errors.Errorf("parse message: unexpected type %s", m.Type)
+	}
+
+	return m, nil
+}
+
+func getString(dict map[string]interface{}, key string) (value string, ok bool) {
+	value, ok = dict[key].(string)
+	return value, ok
+}
+
+func getInt(dict map[string]interface{}, key string) (value int64, ok bool) {
+	value, ok = dict[key].(int64)
+	return value, ok
+}
+
+func getDict(dict map[string]interface{}, key string) (value map[string]interface{}, ok bool) {
+	value, ok = dict[key].(map[string]interface{})
+	return value, ok
+}
+
+// getId returns 20-byte node id or info hash of the dictionary
+func getId(dict map[string]interface{}, key string) (id []byte, ok bool) {
+
+	value, ok := getString(dict, key)
+	if !ok || len(value) != idLength {
+		return nil, false
+	}
+
+	return []byte(value), true
+}
+
+func makeCompactAddress(address *net.UDPAddr) (data []byte) {
+
+	ip := address.IP.To4()
+	if ip == nil {
+		return nil
+	}
+
+	data = make([]byte, compactPeerLength)
+	copy(data, ip)
+	binary.BigEndian.PutUint16(data[net.IPv4len:], uint16(address.Port))
+
+	return data
+}
+
+func parseCompactAddress(data []byte) (address *net.UDPAddr) {
+	return &net.UDPAddr{
+		IP:   net.IPv4(data[0], data[1], data[2], data[3]),
+		Port: int(binary.BigEndian.Uint16(data[net.IPv4len:])),
+	}
+}
+
+// makeCompactNodes encodes ids and IPv4 addresses of the nodes,
+// nodes with other addresses are skipped
+func makeCompactNodes(nodes []*node) (data []byte) {
+
+	for _, node := range nodes {
+
+		address := makeCompactAddress(node.address)
+		if address == nil {
+			continue
+		}
+
+		data = append(data, node.id...)
+		data = append(data, address...)
+	}
+
+	return data
+}
+
+func parseCompactNodes(data []byte) (nodes []*node) {
+
+	for i := 0; i+compactNodeLength <= len(data); i += compactNodeLength {
+
+		id := make([]byte, idLength)
+		copy(id, data[i:i+idLength])
+
+		address := parseCompactAddress(data[i+idLength : i+compactNodeLength])
+		if address.Port == 0 {
+			continue
+		}
+
+		nodes = append(nodes, &node{id: id, address: address})
+	}
+
+	return nodes
+}
+
+// parseCompactPeers decodes the values of get_peers response
+func parseCompactPeers(values []interface{}) (peers []string) {
+
+	for _, value := range values {
+
+		data, ok := value.(string)
+		if !ok || len(data) != compactPeerLength {
+			continue
+		}
+
+		address := parseCompactAddress([]byte(data))
+		peers = append(peers, net.JoinHostPort(address.IP.String(), strconv.Itoa(address.Port)))
+	}
+
+	return peers
+}
@@ -0,0 +1,16 @@
+package dht
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+var dhtLogger = logrus.New()
+
+func init() {
+	dhtLogger.SetLevel(logrus.TraceLevel)
+}
+
+// Logger returns the logger of the package to set its output and level
+func Logger() *logrus.Logger {
+	return dhtLogger
+}
@@ -0,0 +1,156 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// secret is changed every 5 minutes and tokens
+// of the previous secret are still accepted (BEP 5)
+const tokenSecretLifetime = 5 * time.Minute
+
+const peerLifetime = 30 * time.Minute
+
+const maxReturnedPeers = 50
+const maxStoredInfoHashes = 1024
+
+type tokenManager struct {
+	secret         []byte
+	previousSecret []byte
+	changed        time.Time
+	mutex          sync.Mutex
+}
+
+func newTokenManager() (tokens *tokenManager) {
+
+	tokens = new(tokenManager)
+	tokens.secret = makeSecret()
+	tokens.previousSecret = tokens.secret
+	tokens.changed = time.Now()
+
+	return tokens
+}
+
+func makeSecret() (secret []byte) {
+
+	secret = make([]byte, 20)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+
+	return secret
+}
+
+func makeToken(ip net.IP, secret []byte) []byte {
+
+	hash := sha1.New()
+	hash.Write(ip.To16())
+	hash.Write(secret)
+
+	return hash.Sum(nil)[:8]
+}
+
+func (t *tokenManager) rotate() {
+
+	if time.Since(t.changed) < tokenSecretLifetime {
+		return
+	}
+
+	t.previousSecret = t.secret
+	t.secret = makeSecret()
+	t.changed = time.Now()
+}
+
+func (t *tokenManager) make(ip net.IP) []byte {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.rotate()
+
+	return makeToken(ip, t.secret)
+}
+
+func (t *tokenManager) valid(token []byte, ip net.IP) bool {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.rotate()
+
+	return bytes.Equal(token, makeToken(ip, t.secret)) ||
+		bytes.Equal(token, makeToken(ip, t.previousSecret))
+}
+
+// peerStore keeps peers announced to the node
+type peerStore struct {
+	peers map[string]map[string]time.Time
+	mutex sync.Mutex
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{peers: make(map[string]map[string]time.Time)}
+}
+
+func (s *peerStore) add(infoHash []byte, address *net.UDPAddr) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	peers, ok := s.peers[string(infoHash)]
+	if !ok {
+		if len(s.peers) >= maxStoredInfoHashes {
+			s.expire()
+		}
+		if len(s.peers) >= maxStoredInfoHashes {
+			return
+		}
+		peers = make(map[string]time.Time)
+		s.peers[string(infoHash)] = peers
+	}
+
+	peers[string(makeCompactAddress(address))] = time.Now()
+}
+
+// get returns compact addresses of the peers
+func (s *peerStore) get(infoHash []byte) (values []interface{}) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for address, announced := range s.peers[string(infoHash)] {
+
+		if len(values) == maxReturnedPeers {
+			break
+		}
+
+		if time.Since(announced) > peerLifetime {
+			continue
+		}
+
+		values = append(values, address)
+	}
+
+	return values
+}
+
+func (s *peerStore) expire() {
+
+	for infoHash, peers := range s.peers {
+
+		for address, announced := range peers {
+			if time.Since(announced) > peerLifetime {
+				delete(peers, address)
+			}
+		}
+
+		if len(peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const idLength = 20
+
+// bucket size (BEP 5)
+const k = 8
+
+// node is questionable if it has not responded for 15 minutes
+const questionableTimeout = 15 * time.Minute
+
+// node is bad after several failed queries in a row
+const maxNodeFailures = 3
+
+type node struct {
+	id       []byte
+	address  *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+func (n *node) questionable() bool {
+	return time.Since(n.lastSeen) > questionableTimeout
+}
+
+// routingTable keeps up to k nodes in every bucket, bucket index is
+// the length of the common prefix of node id and id of the table
+type routingTable struct {
+	id      []byte
+	buckets [idLength * 8][]*node
+	mutex   sync.Mutex
+}
+
+func newRoutingTable(id []byte) *routingTable {
+	return &routingTable{id: id}
+}
+
+func distance(a, b []byte) (result []byte) {
+
+	result = make([]byte, idLength)
+	for i := range result {
+		result[i] = a[i] ^ b[i]
+	}
+
+	return result
+}
+
+func commonPrefixLength(a, b []byte) int {
+
+	for i := 0; i < idLength; i++ {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			continue
+		}
+		length := i * 8
+		for x&0x80 == 0 {
+			x <<= 1
+			length++
+		}
+		return length
+	}
+
+	return idLength * 8
+}
+
+func (t *routingTable) bucketIndex(id []byte) int {
+
+	index := commonPrefixLength(t.id, id)
+	if index == len(t.buckets) {
+		return -1
+	}
+
+	return index
+}
+
+// update marks the node as good, the node is added if its bucket is not full
+// or has a bad node, otherwise the oldest questionable node of the bucket
+// is returned to be pinged by the caller
+func (t *routingTable) update(id []byte, address *net.UDPAddr) (oldest *node) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	index := t.bucketIndex(id)
+	if index < 0 || address.IP.To4() == nil {
+		return nil
+	}
+
+	bucket := t.buckets[index]
+
+	for i, n := range bucket {
+		if bytes.Equal(n.id, id) {
+			n.address = address
+			n.lastSeen = time.Now()
+			n.failures = 0
+			// most recently seen node is the last
+			t.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+			return nil
+		}
+	}
+
+	newNode := &node{id: id, address: address, lastSeen: time.Now()}
+
+	if len(bucket) < k {
+		t.buckets[index] = append(bucket, newNode)
+		return nil
+	}
+
+	for i, n := range bucket {
+		if n.failures >= maxNodeFailures {
+			t.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), newNode)
+			return nil
+		}
+	}
+
+	if bucket[0].questionable() {
+		return bucket[0]
+	}
+
+	return nil
+}
+
+// add inserts the node without marking it as good,
+// it is used for nodes restored from the saved state
+func (t *routingTable) add(id []byte, address *net.UDPAddr) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	index := t.bucketIndex(id)
+	if index < 0 || len(t.buckets[index]) >= k {
+		return
+	}
+
+	for _, n := range t.buckets[index] {
+		if bytes.Equal(n.id, id) {
+			return
+		}
+	}
+
+	t.buckets[index] = append(t.buckets[index], &node{id: id, address: address})
+}
+
+// failed counts a query without response, bad nodes are removed
+// only when there are other nodes to replace them
+func (t *routingTable) failed(address *net.UDPAddr) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			if n.address.String() == address.String() {
+				n.failures += 1
+			}
+		}
+	}
+}
+
+func (t *routingTable) remove(id []byte) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	index := t.bucketIndex(id)
+	if index < 0 {
+		return
+	}
+
+	bucket := t.buckets[index]
+
+	for i, n := range bucket {
+		if bytes.Equal(n.id, id) {
+			t.buckets[index] = append(bucket[:i:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns up to count good nodes sorted by distance to the target
+func (t *routingTable) closest(target []byte, count int) (nodes []*node) {
+
+	t.mutex.Lock()
+
+	for _, bucket := range t.buckets {
+		for _, n := range bucket {
+			if n.failures < maxNodeFailures {
+				nodes = append(nodes, &node{n.id, n.address, n.lastSeen, n.failures})
+			}
+		}
+	}
+
+	t.mutex.Unlock()
+
+	sortByDistance(nodes, target)
+
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+
+	return nodes
+}
+
+func (t *routingTable) nodes() (nodes []*node) {
+	return t.closest(t.id, idLength*8*k)
+}
+
+func (t *routingTable) length() (length int) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, bucket := range t.buckets {
+		length += len(bucket)
+	}
+
+	return length
+}
+
+func sortByDistance(nodes []*node, target []byte) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(distance(nodes[i].id, target), distance(nodes[j].id, target)) < 0
+	})
+}
@@ -0,0 +1,114 @@
+package dht
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func makeTestId(first byte) (id []byte) {
+	id = make([]byte, idLength)
+	id[0] = first
+	return id
+}
+
+func makeTestAddress(port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestRoutingTable_Closest(t *testing.T) {
+
+	table := newRoutingTable(makeTestId(0))
+
+	for i := 1; i < 20; i++ {
+		table.update(makeTestId(byte(i*10)), makeTestAddress(i))
+	}
+
+	// own id is not added
+	table.update(makeTestId(0), makeTestAddress(100))
+
+	assert.Equal(t, 19, table.length(), "wrong node count")
+
+	nodes := table.closest(makeTestId(41), 3)
+	assert.Len(t, nodes, 3, "wrong node count")
+	assert.Equal(t, makeTestId(40), nodes[0].id, "wrong closest node")
+	assert.Equal(t, makeTestId(60), nodes[1].id, "wrong closest node")
+	assert.Equal(t, makeTestId(50), nodes[2].id, "wrong closest node")
+}
+
+func TestRoutingTable_FullBucket(t *testing.T) {
+
+	table := newRoutingTable(makeTestId(0))
+
+	// all nodes have first bit set and share the bucket
+	for i := 0; i < k; i++ {
+		oldest := table.update(makeTestId(byte(0x80+i)), makeTestAddress(i+1))
+		assert.Nil(t, oldest, "node is not added")
+	}
+
+	newId := makeTestId(0xf0)
+
+	oldest := table.update(newId, makeTestAddress(100))
+	assert.Nil(t, oldest, "good node is returned")
+	assert.Equal(t, k, table.length(), "node is added to full bucket")
+
+	table.buckets[0][0].lastSeen = time.Now().Add(-questionableTimeout - time.Minute)
+
+	oldest = table.update(newId, makeTestAddress(100))
+	assert.NotNil(t, oldest, "questionable node is not returned")
+	assert.Equal(t, makeTestId(0x80), oldest.id, "wrong questionable node")
+
+	// bad node is replaced at once
+	for i := 0; i < maxNodeFailures; i++ {
+		table.failed(makeTestAddress(2))
+	}
+
+	oldest = table.update(newId, makeTestAddress(100))
+	assert.Nil(t, oldest, "node is not added instead of bad node")
+	assert.Equal(t, k, table.length(), "wrong node count")
+
+	found := false
+	for _, n := range table.nodes() {
+		assert.False(t, bytes.Equal(n.id, makeTestId(0x81)), "bad node is not removed")
+		found = found || bytes.Equal(n.id, newId)
+	}
+	assert.True(t, found, "node is not added")
+
+	table.remove(newId)
+	assert.Equal(t, k-1, table.length(), "node is not removed")
+}
+
+func TestKrpc_Message(t *testing.T) {
+
+	data := makeQuery("aa", "ping", map[string]interface{}{"id": string(makeTestId(1))})
+
+	m, err := parseMessage(data)
+	assert.NoError(t, err, "parse finished with error")
+	assert.Equal(t, "aa", m.TransactionId, "wrong transaction id")
+	assert.Equal(t, queryType, m.Type, "wrong type")
+	assert.Equal(t, "ping", m.Query, "wrong query")
+
+	m, err = parseMessage(makeError("bb", genericError, "test"))
+	assert.NoError(t, err, "parse finished with error")
+	assert.Equal(t, KrpcError{genericError, "test"}, m.Error, "wrong error")
+
+	_, err = parseMessage([]byte("d1:t2:aa1:y1:xe"))
+	assert.Error(t, err, "message with wrong type is parsed")
+
+	_, err = parseMessage([]byte("d1:y1:re"))
+	assert.Error(t, err, "message without transaction id is parsed")
+
+	nodes := []*node{
+		{id: makeTestId(1), address: makeTestAddress(6881)},
+		{id: makeTestId(2), address: makeTestAddress(6882)},
+	}
+
+	parsed := parseCompactNodes(makeCompactNodes(nodes))
+	assert.Len(t, parsed, 2, "wrong node count")
+	for i := range nodes {
+		assert.Equal(t, nodes[i].id, parsed[i].id, "wrong id")
+		assert.Equal(t, nodes[i].address.String(), parsed[i].address.String(), "wrong address")
+	}
+}
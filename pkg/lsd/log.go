@@ -0,0 +1,16 @@
+package lsd
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+var lsdLogger = logrus.New()
+
+func init() {
+	lsdLogger.SetLevel(logrus.TraceLevel)
+}
+
+// Logger returns the logger of the package to set its output and level
+func Logger() *logrus.Logger {
+	return lsdLogger
+}
@@ -0,0 +1,407 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IPv4 multicast group of local service discovery (BEP 14)
+const multicastAddress = "239.192.152.143:6771"
+
+// announces of a torrent are sent not more than once a minute
+const minAnnounceInterval = time.Minute
+
+const maxDatagramLength = 1400
+
+// LSD announces torrents to the local network with BT-SEARCH multicast
+// messages and passes peers found in the network to subscribers
+type LSD struct {
+	connections []*net.UDPConn
+	group       *net.UDPAddr
+
+	// sources of accepted messages, any source is accepted if it is empty
+	networks []*net.IPNet
+
+	cookie string
+
+	subscribers  map[string]chan []string
+	lastAnnounce map[string]time.Time
+	mutex        sync.Mutex
+
+	closeChannel chan struct{}
+	closeOnce    sync.Once
+	wait         sync.WaitGroup
+}
+
+// NewLSD joins the multicast group on the interfaces with the names,
+// all multicast interfaces are used if there are no names
+func NewLSD(interfaceNames []string) (lsd *LSD, err error) {
+
+	group, err := net.ResolveUDPAddr("udp4", multicastAddress)
+	if err != nil {
+		return nil, errors.Annotate(err, "new lsd")
+	}
+
+	interfaces, err := multicastInterfaces(interfaceNames)
+	if err != nil {
+		return nil, errors.Annotate(err, "new lsd")
+	}
+
+	var connections []*net.UDPConn
+	var networks []*net.IPNet
+
+	for _, networkInterface := range interfaces {
+
+		connection, err := net.ListenMulticastUDP("udp4", networkInterface, group)
+		if err != nil {
+			for _, connection := range connections {
+				_ = connection.Close()
+			}
+			return nil, errors.Annotate(err, "new lsd")
+		}
+
+		connections = append(connections, connection)
+
+		if len(interfaceNames) > 0 {
+			networks = append(networks, interfaceNetworks(networkInterface)...)
+		}
+	}
+
+	// system chooses the interface
+	if len(connections) == 0 {
+		connection, err := net.ListenMulticastUDP("udp4", nil, group)
+		if err != nil {
+			return nil, errors.Annotate(err, "new lsd")
+		}
+		connections = append(connections, connection)
+	}
+
+	return newLSD(connections, group, networks), nil
+}
+
+func newLSD(connections []*net.UDPConn, group *net.UDPAddr, networks []*net.IPNet) (lsd *LSD) {
+
+	lsd = new(LSD)
+
+	lsd.connections = connections
+	lsd.group = group
+	lsd.networks = networks
+
+	cookie := make([]byte, 8)
+	_, _ = rand.Read(cookie)
+	lsd.cookie = hex.EncodeToString(cookie)
+
+	lsd.subscribers = make(map[string]chan []string)
+	lsd.lastAnnounce = make(map[string]time.Time)
+	lsd.closeChannel = make(chan struct{})
+
+	return lsd
+}
+
+func multicastInterfaces(names []string) (interfaces []*net.Interface, err error) {
+
+	if len(names) > 0 {
+		for _, name := range names {
+			networkInterface, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, errors.Annotate(err, "multicast interfaces")
+			}
+			interfaces = append(interfaces, networkInterface)
+		}
+		return interfaces, nil
+	}
+
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.Annotate(err, "multicast interfaces")
+	}
+
+	for i := range all {
+
+		flags := all[i].Flags
+		if flags&net.FlagUp == 0 || flags&net.FlagMulticast == 0 || flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		if len(interfaceNetworks(&all[i])) == 0 {
+			continue
+		}
+
+		interfaces = append(interfaces, &all[i])
+	}
+
+	return interfaces, nil
+}
+
+// interfaceNetworks returns IPv4 networks of the interface
+func interfaceNetworks(networkInterface *net.Interface) (networks []*net.IPNet) {
+
+	addresses, err := networkInterface.Addrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, address := range addresses {
+		network, ok := address.(*net.IPNet)
+		if ok && network.IP.To4() != nil {
+			networks = append(networks, network)
+		}
+	}
+
+	return networks
+}
+
+// Start receives announces until the service is closed
+func (l *LSD) Start() (err error) {
+
+	l.wait.Add(1)
+	defer l.wait.Done()
+
+	errorChannel := make(chan error, len(l.connections))
+
+	for _, connection := range l.connections {
+		go func(connection *net.UDPConn) {
+
+			buffer := make([]byte, maxDatagramLength)
+
+			for {
+
+				n, source, err := connection.ReadFromUDP(buffer)
+				if err != nil {
+					errorChannel <- err
+					return
+				}
+
+				l.handleMessage(buffer[:n], source)
+			}
+		}(connection)
+	}
+
+	err = <-errorChannel
+
+	select {
+	case <-l.closeChannel:
+		return nil
+	default:
+		return errors.Annotate(err, "lsd start")
+	}
+}
+
+func (l *LSD) Close() {
+
+	l.closeOnce.Do(func() {
+		close(l.closeChannel)
+		for _, connection := range l.connections {
+			_ = connection.Close()
+		}
+	})
+
+	l.wait.Wait()
+}
+
+// Subscribe returns the channel receiving addresses of peers
+// announced the torrent in the local network
+func (l *LSD) Subscribe(infoHash []byte) (peers chan []string) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	peers = make(chan []string, 16)
+	l.subscribers[string(infoHash)] = peers
+
+	return peers
+}
+
+func (l *LSD) Unsubscribe(infoHash []byte) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.subscribers, string(infoHash))
+	delete(l.lastAnnounce, string(infoHash))
+}
+
+// Announce sends the announce of the torrent to every interface,
+// announces more frequent than once a minute are skipped
+func (l *LSD) Announce(infoHash []byte, port uint16) (err error) {
+
+	l.mutex.Lock()
+
+	last, ok := l.lastAnnounce[string(infoHash)]
+	if ok && time.Since(last) < minAnnounceInterval {
+		l.mutex.Unlock()
+		return nil
+	}
+
+	l.lastAnnounce[string(infoHash)] = time.Now()
+	l.mutex.Unlock()
+
+	message := makeSearchMessage(l.group.String(), port, [][]byte{infoHash}, l.cookie)
+
+	sent := 0
+
+	for _, connection := range l.connections {
+
+		_, err = connection.WriteToUDP(message, l.group)
+		if err != nil {
+			lsdLogger.WithFields(logrus.Fields{
+				"address": connection.LocalAddr(),
+			}).Debug(err.Error())
+			continue
+		}
+
+		sent++
+	}
+
+	if sent == 0 {
+		return errors.Annotate(err, "lsd announce")
+	}
+
+	return nil
+}
+
+func (l *LSD) accepted(source *net.UDPAddr) bool {
+
+	if len(l.networks) == 0 {
+		return true
+	}
+
+	for _, network := range l.networks {
+		if network.Contains(source.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (l *LSD) handleMessage(data []byte, source *net.UDPAddr) {
+
+	if !l.accepted(source) {
+		return
+	}
+
+	port, infoHashes, cookie, err := parseSearchMessage(data)
+	if err != nil {
+		lsdLogger.WithFields(logrus.Fields{
+			"source": source,
+		}).Debug(err.Error())
+		return
+	}
+
+	if cookie == l.cookie {
+		return
+	}
+
+	peer := net.JoinHostPort(source.IP.String(), strconv.Itoa(int(port)))
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, infoHash := range infoHashes {
+
+		peers, ok := l.subscribers[string(infoHash)]
+		if !ok {
+			continue
+		}
+
+		lsdLogger.WithFields(logrus.Fields{
+			"peer":     peer,
+			"infoHash": infoHash,
+		}).Debug("local peer found")
+
+		select {
+		case peers <- []string{peer}:
+		default:
+		}
+	}
+}
+
+func makeSearchMessage(host string, port uint16, infoHashes [][]byte, cookie string) (message []byte) {
+
+	var buffer bytes.Buffer
+
+	buffer.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	buffer.WriteString(fmt.Sprintf("Host: %s\r\n", host))
+	buffer.WriteString(fmt.Sprintf("Port: %d\r\n", port))
+
+	for _, infoHash := range infoHashes {
+		buffer.WriteString(fmt.Sprintf("Infohash: %s\r\n", hex.EncodeToString(infoHash)))
+	}
+
+	if cookie != "" {
+		buffer.WriteString(fmt.Sprintf("cookie: %s\r\n", cookie))
+	}
+
+	buffer.WriteString("\r\n\r\n")
+
+	return buffer.Bytes()
+}
+
+func parseSearchMessage(data []byte) (port uint16, infoHashes [][]byte, cookie string, err error) {
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	line, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, "", errors.Errorf("parse search message: unexpected request line")
+	}
+
+	for {
+
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			break
+		}
+
+		separator := strings.Index(line, ":")
+		if separator < 0 {
+			return 0, nil, "", errors.Errorf("parse search message: unexpected header %s", line)
+		}
+
+		value := strings.TrimSpace(line[separator+1:])
+
+		switch http.CanonicalHeaderKey(strings.TrimSpace(line[:separator])) {
+
+		case "Port":
+			parsedPort, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || parsedPort == 0 {
+				return 0, nil, "", errors.Errorf("parse search message: wrong port %s", value)
+			}
+			port = uint16(parsedPort)
+
+		case "Infohash":
+			infoHash, err := hex.DecodeString(value)
+			if err != nil || len(infoHash) != 20 {
+				return 0, nil, "", errors.Errorf("parse search message: wrong info hash %s", value)
+			}
+			infoHashes = append(infoHashes, infoHash)
+
+		case "Cookie":
+			cookie = value
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if port == 0 || len(infoHashes) == 0 {
+		return 0, nil, "", errors.Errorf("parse search message: port or info hash is absent")
+	}
+
+	return port, infoHashes, cookie, nil
+}
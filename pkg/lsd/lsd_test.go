@@ -0,0 +1,143 @@
+package lsd
+
+import (
+	"crypto/rand"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	lsdLogger.SetLevel(logrus.ErrorLevel)
+	os.Exit(m.Run())
+}
+
+// startTestLSD uses unicast loopback socket instead of multicast group,
+// messages are sent to the group address
+func startTestLSD(t *testing.T, networks []*net.IPNet) (lsd *LSD) {
+
+	connection, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsd = newLSD([]*net.UDPConn{connection}, connection.LocalAddr().(*net.UDPAddr), networks)
+
+	go func() {
+		_ = lsd.Start()
+	}()
+
+	return lsd
+}
+
+func makeTestInfoHash() (infoHash []byte) {
+	infoHash = make([]byte, 20)
+	_, _ = rand.Read(infoHash)
+	return infoHash
+}
+
+func TestLSD_SearchMessage(t *testing.T) {
+
+	infoHashes := [][]byte{makeTestInfoHash(), makeTestInfoHash()}
+
+	message := makeSearchMessage(multicastAddress, 6881, infoHashes, "abc")
+
+	port, parsedInfoHashes, cookie, err := parseSearchMessage(message)
+	assert.NoError(t, err, "parse finished with error")
+	assert.EqualValues(t, 6881, port, "wrong port")
+	assert.Equal(t, infoHashes, parsedInfoHashes, "wrong info hashes")
+	assert.Equal(t, "abc", cookie, "wrong cookie")
+
+	// header names are case insensitive and the end can be omitted
+	port, parsedInfoHashes, cookie, err = parseSearchMessage([]byte("BT-SEARCH * HTTP/1.1\r\n" +
+		"host: 239.192.152.143:6771\r\nport: 6882\r\n" +
+		"infohash: 0123456789abcdef0123456789abcdef01234567"))
+	assert.NoError(t, err, "parse finished with error")
+	assert.EqualValues(t, 6882, port, "wrong port")
+	assert.Len(t, parsedInfoHashes, 1, "wrong info hashes")
+	assert.Equal(t, "", cookie, "wrong cookie")
+
+	_, _, _, err = parseSearchMessage([]byte("NOTIFY * HTTP/1.1\r\nPort: 6881\r\n\r\n"))
+	assert.Error(t, err, "wrong request line is accepted")
+
+	_, _, _, err = parseSearchMessage([]byte("BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n"))
+	assert.Error(t, err, "message without info hash is accepted")
+
+	_, _, _, err = parseSearchMessage([]byte("BT-SEARCH * HTTP/1.1\r\n" +
+		"Port: 70000\r\nInfohash: 0123456789abcdef0123456789abcdef01234567\r\n\r\n"))
+	assert.Error(t, err, "wrong port is accepted")
+}
+
+func TestLSD_Announce(t *testing.T) {
+
+	sender := startTestLSD(t, nil)
+	defer sender.Close()
+
+	receiver := startTestLSD(t, nil)
+	defer receiver.Close()
+
+	// sender announces to the receiver and the receiver to itself
+	sender.group = receiver.group
+
+	infoHash := makeTestInfoHash()
+	peers := receiver.Subscribe(infoHash)
+
+	err := sender.Announce(makeTestInfoHash(), 6882)
+	assert.NoError(t, err, "announce finished with error")
+
+	err = receiver.Announce(infoHash, 6883)
+	assert.NoError(t, err, "announce finished with error")
+
+	err = sender.Announce(infoHash, 6881)
+	assert.NoError(t, err, "announce finished with error")
+
+	select {
+	case received := <-peers:
+		assert.Equal(t, []string{"127.0.0.1:6881"}, received, "wrong peer")
+	case <-time.After(time.Second):
+		t.Fatal("peer is not received")
+	}
+
+	// announce is skipped because of the rate limit
+	err = sender.Announce(infoHash, 6881)
+	assert.NoError(t, err, "announce finished with error")
+
+	select {
+	case received := <-peers:
+		t.Fatalf("unexpected peers %v", received)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	receiver.Unsubscribe(infoHash)
+}
+
+func TestLSD_Interfaces(t *testing.T) {
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+
+	sender := startTestLSD(t, nil)
+	defer sender.Close()
+
+	receiver := startTestLSD(t, []*net.IPNet{network})
+	defer receiver.Close()
+
+	sender.group = receiver.group
+
+	infoHash := makeTestInfoHash()
+	peers := receiver.Subscribe(infoHash)
+
+	err := sender.Announce(infoHash, 6881)
+	assert.NoError(t, err, "announce finished with error")
+
+	select {
+	case received := <-peers:
+		t.Fatalf("peers from other network are accepted %v", received)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = NewLSD([]string{"absent-interface"})
+	assert.Error(t, err, "absent interface is used")
+}
@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// connection reads and writes are limited by chunks of this size
+// to keep waits short for low rates
+const chunkLength = 4 * 1024
+
+// Limiter is a token bucket limiting the number of bytes per second,
+// the bucket holds tokens for one second
+type Limiter struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// NewLimiter returns the limiter with the rate in bytes per second,
+// zero rate means no limit
+func NewLimiter(rate int64) (l *Limiter) {
+	l = new(Limiter)
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate in bytes per second, zero rate means no limit
+func (l *Limiter) SetRate(rate int64) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+
+	now := time.Now()
+
+	if l.rate == 0 {
+		// bucket of unlimited limiter is full
+		l.tokens = float64(rate)
+	} else {
+		// tokens are kept, the bucket can not hold more than one second of the new rate
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(rate) {
+			l.tokens = float64(rate)
+		}
+	}
+
+	l.rate = rate
+	l.last = now
+}
+
+func (l *Limiter) Rate() int64 {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.rate
+}
+
+// reserve takes n tokens and returns the time to wait until they are available
+func (l *Limiter) reserve(n int) time.Duration {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate == 0 {
+		return 0
+	}
+
+	now := time.Now()
+
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+
+	l.last = now
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Wait blocks until n bytes are allowed by every limiter
+func Wait(limiters []*Limiter, n int) {
+
+	wait := time.Duration(0)
+
+	for _, limiter := range limiters {
+		if reserved := limiter.reserve(n); reserved > wait {
+			wait = reserved
+		}
+	}
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Conn limits reads and writes of the connection
+type Conn struct {
+	net.Conn
+
+	readLimiters  []*Limiter
+	writeLimiters []*Limiter
+}
+
+func NewConn(connection net.Conn, readLimiters, writeLimiters []*Limiter) (c *Conn) {
+
+	c = new(Conn)
+
+	c.Conn = connection
+	c.readLimiters = readLimiters
+	c.writeLimiters = writeLimiters
+
+	return c
+}
+
+func (c *Conn) Read(data []byte) (n int, err error) {
+
+	if len(data) > chunkLength {
+		data = data[:chunkLength]
+	}
+
+	n, err = c.Conn.Read(data)
+	if n > 0 {
+		Wait(c.readLimiters, n)
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(data []byte) (n int, err error) {
+
+	for len(data) > 0 {
+
+		chunk := data
+		if len(chunk) > chunkLength {
+			chunk = chunk[:chunkLength]
+		}
+
+		Wait(c.writeLimiters, len(chunk))
+
+		written, err := c.Conn.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+
+		data = data[written:]
+	}
+
+	return n, nil
+}
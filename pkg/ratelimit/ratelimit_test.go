@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Reserve(t *testing.T) {
+
+	limiter := NewLimiter(1000)
+
+	// the bucket is full initially
+	assert.EqualValues(t, 0, limiter.reserve(1000), "full bucket is not used")
+
+	wait := limiter.reserve(500)
+	assert.InDelta(t, 500*time.Millisecond, wait, float64(50*time.Millisecond), "unexpected wait")
+
+	limiter.SetRate(0)
+	assert.EqualValues(t, 0, limiter.reserve(1000000), "unlimited limiter waits")
+	assert.EqualValues(t, 0, limiter.Rate(), "unexpected rate")
+}
+
+func TestLimiter_SetRate(t *testing.T) {
+
+	limiter := NewLimiter(1000)
+	assert.EqualValues(t, 0, limiter.reserve(1000), "full bucket is not used")
+
+	// empty bucket is not refilled by the rate change
+	limiter.SetRate(2000)
+	wait := limiter.reserve(1000)
+	assert.InDelta(t, 500*time.Millisecond, wait, float64(50*time.Millisecond), "unexpected wait")
+
+	// tokens are clamped to the lower rate
+	limiter = NewLimiter(1000)
+	limiter.SetRate(100)
+	wait = limiter.reserve(200)
+	assert.InDelta(t, time.Second, wait, float64(50*time.Millisecond), "unexpected wait")
+}
+
+func TestConn_Limits(t *testing.T) {
+
+	interiorConn, exteriorConn := net.Pipe()
+
+	global := NewLimiter(0)
+	limiter := NewLimiter(16 * 1024)
+
+	conn := NewConn(interiorConn, nil, []*Limiter{global, limiter})
+
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, exteriorConn)
+	}()
+
+	start := time.Now()
+
+	// the first second is in the bucket
+	n, err := conn.Write(make([]byte, 24*1024))
+	assert.NoError(t, err, "write finished with error")
+	assert.Equal(t, 24*1024, n, "unexpected written length")
+
+	elapsed := time.Since(start)
+	assert.True(t, elapsed > 400*time.Millisecond && elapsed < 2*time.Second,
+		"unexpected write time %v", elapsed)
+
+	// the rate is changed at runtime
+	limiter.SetRate(0)
+	start = time.Now()
+
+	_, err = conn.Write(make([]byte, 64*1024))
+	assert.NoError(t, err, "write finished with error")
+	assert.True(t, time.Since(start) < 200*time.Millisecond, "unlimited write is limited")
+
+	_ = conn.Close()
+}
@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"github.com/lezhenin/gotorrentclient/pkg/bitfield"
+)
+
+// Availability returns the number of connected peers having each piece
+func (m *Manager) Availability() (availability []int) {
+
+	m.availabilityMutex.RLock()
+	defer m.availabilityMutex.RUnlock()
+
+	availability = make([]int, len(m.pieceAvailability))
+	copy(availability, m.pieceAvailability)
+
+	return availability
+}
+
+// addAvailability counts pieces of the peer bitfield with the delta
+func (m *Manager) addAvailability(peerBitfield *bitfield.Bitfield, delta int) {
+
+	if peerBitfield == nil {
+		return
+	}
+
+	m.availabilityMutex.Lock()
+	defer m.availabilityMutex.Unlock()
+
+	index := peerBitfield.GetFirstIndex(0, 1)
+	for index < uint(m.pieceCount) {
+		m.pieceAvailability[index] += delta
+		index = peerBitfield.GetFirstIndex(index+1, 1)
+	}
+}
+
+// setPeerBitfield replaces the bitfield of the peer and updates availability
+func (m *Manager) setPeerBitfield(seeder *Seeder, peerBitfield *bitfield.Bitfield) {
+	m.addAvailability(seeder.PeerBitfield, -1)
+	seeder.PeerBitfield = peerBitfield
+	m.addAvailability(seeder.PeerBitfield, 1)
+}
+
+func (m *Manager) setPeerPiece(seeder *Seeder, pieceIndex uint) {
+
+	if seeder.PeerBitfield.Get(pieceIndex) == 1 {
+		return
+	}
+
+	seeder.PeerBitfield.Set(pieceIndex)
+
+	m.availabilityMutex.Lock()
+	m.pieceAvailability[pieceIndex] += 1
+	m.availabilityMutex.Unlock()
+}
@@ -0,0 +1,532 @@
+package torrent
+
+import (
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+// DefaultCacheSize is the memory budget of the block cache in bytes
+const DefaultCacheSize = 64 << 20
+
+// cache shared by all downloads
+var globalBlockCache = newBlockCache(DefaultCacheSize)
+
+// SetCacheSize sets the memory budget of the block cache shared by all downloads in bytes,
+// zero size disables the cache, it can be changed at runtime
+func SetCacheSize(size int64) {
+	globalBlockCache.setSize(size)
+}
+
+type cacheKey struct {
+	manager *Manager
+	index   int
+}
+
+// cachedPiece keeps the blocks of the piece, dirty blocks are not written to the storage yet
+type cachedPiece struct {
+	data     []byte
+	present  []bool
+	dirty    []bool
+	lastUsed uint64
+
+	// version is changed by the written blocks, the evicted piece
+	// is kept while its dirty blocks are written
+	version uint64
+	writing bool
+}
+
+// dirtyRun is the copy of the consecutive dirty blocks from start to end
+type dirtyRun struct {
+	start int
+	end   int
+	data  []byte
+}
+
+// pieceWrite is the copy of the dirty blocks of the piece written without the cache lock
+type pieceWrite struct {
+	key     cacheKey
+	piece   *cachedPiece
+	version uint64
+	runs    []dirtyRun
+}
+
+// blockCache keeps the blocks of the downloading pieces until the pieces are verified
+// and the recently used pieces for uploading, when the cache is full the least recently
+// used piece is evicted and its dirty blocks are written to the storage,
+// the storage is accessed without the lock
+type blockCache struct {
+	size int64
+	used int64
+
+	// memory of the evicted pieces which are being written
+	evicting int64
+
+	pieces map[cacheKey]*cachedPiece
+	uses   uint64
+
+	mutex sync.Mutex
+}
+
+func newBlockCache(size int64) *blockCache {
+	return &blockCache{
+		size:   size,
+		pieces: make(map[cacheKey]*cachedPiece),
+	}
+}
+
+func (c *blockCache) setSize(size int64) {
+
+	c.mutex.Lock()
+	c.size = size
+	writes := c.evict(cacheKey{})
+	c.mutex.Unlock()
+
+	c.writeEvicted(writes)
+}
+
+// piece returns the cached piece or adds the piece if it fits the cache,
+// it returns nil if the piece is larger than the cache, the evicted pieces
+// have to be written with writeEvicted after unlocking
+func (c *blockCache) piece(key cacheKey, pieceLength int64) (*cachedPiece, []pieceWrite) {
+
+	c.uses += 1
+
+	piece, ok := c.pieces[key]
+	if ok {
+		piece.lastUsed = c.uses
+		return piece, nil
+	}
+
+	if pieceLength > c.size {
+		return nil, nil
+	}
+
+	blockCount := (pieceLength + int64(blockLength) - 1) / int64(blockLength)
+
+	piece = &cachedPiece{
+		data:     make([]byte, pieceLength),
+		present:  make([]bool, blockCount),
+		dirty:    make([]bool, blockCount),
+		lastUsed: c.uses,
+	}
+
+	c.pieces[key] = piece
+	c.used += pieceLength
+
+	return piece, c.evict(key)
+}
+
+// evict removes the least recently used clean pieces until the cache fits its size,
+// the pieces with dirty blocks are returned to be written, the kept piece is not removed
+func (c *blockCache) evict(kept cacheKey) (writes []pieceWrite) {
+
+	for c.used-c.evicting > c.size {
+
+		var oldestKey cacheKey
+		var oldest *cachedPiece
+
+		for key, piece := range c.pieces {
+			if key != kept && !piece.writing && (oldest == nil || piece.lastUsed < oldest.lastUsed) {
+				oldestKey, oldest = key, piece
+			}
+		}
+
+		if oldest == nil {
+			return writes
+		}
+
+		if !oldest.isDirty() {
+			c.remove(oldestKey)
+			continue
+		}
+
+		oldest.writing = true
+		c.evicting += int64(len(oldest.data))
+
+		writes = append(writes, pieceWrite{oldestKey, oldest, oldest.version, oldest.dirtyRuns()})
+	}
+
+	return writes
+}
+
+// writeEvicted writes the dirty blocks of the evicted pieces and removes the pieces,
+// the piece stays in the cache if the write fails or its blocks are written meanwhile
+func (c *blockCache) writeEvicted(writes []pieceWrite) {
+
+	for _, write := range writes {
+
+		err := write.write()
+
+		c.mutex.Lock()
+
+		write.piece.writing = false
+		c.evicting -= int64(len(write.piece.data))
+
+		if err != nil {
+			managerLogger.WithFields(logrus.Fields{
+				"pieceIndex": write.key.index,
+				"infoHash":   write.key.manager.infoHash,
+			}).Error(errors.Annotate(err, "block cache evict"))
+		} else if c.pieces[write.key] == write.piece && write.piece.version == write.version {
+			c.remove(write.key)
+		}
+
+		c.mutex.Unlock()
+	}
+}
+
+func (c *blockCache) remove(key cacheKey) {
+
+	piece, ok := c.pieces[key]
+	if !ok {
+		return
+	}
+
+	delete(c.pieces, key)
+	c.used -= int64(len(piece.data))
+}
+
+func (p *cachedPiece) isDirty() bool {
+	for _, dirty := range p.dirty {
+		if dirty {
+			return true
+		}
+	}
+	return false
+}
+
+// dirtyRuns copies the consecutive dirty blocks of the piece, so they are written with one write
+func (p *cachedPiece) dirtyRuns() (runs []dirtyRun) {
+
+	for start := 0; start < len(p.dirty); start++ {
+
+		if !p.dirty[start] {
+			continue
+		}
+
+		end := start
+		for end < len(p.dirty) && p.dirty[end] {
+			end++
+		}
+
+		startOffset := start * blockLength
+		endOffset := end * blockLength
+		if endOffset > len(p.data) {
+			endOffset = len(p.data)
+		}
+
+		data := make([]byte, endOffset-startOffset)
+		copy(data, p.data[startOffset:endOffset])
+
+		runs = append(runs, dirtyRun{start, end, data})
+
+		start = end
+	}
+
+	return runs
+}
+
+// write writes the copied blocks to the storage, it is called without the cache lock
+func (w *pieceWrite) write() (err error) {
+
+	storage := w.key.manager.storage.Piece(w.key.index)
+
+	for _, run := range w.runs {
+		_, err = storage.WriteAt(run.data, int64(run.start*blockLength))
+		if err != nil {
+			return errors.Annotate(err, "block cache write")
+		}
+	}
+
+	return nil
+}
+
+// writeBlock keeps the downloaded block in the cache,
+// the block is written to the storage if the piece does not fit the cache
+func (c *blockCache) writeBlock(m *Manager, pieceIndex int, pieceLength int64, b []byte, off int64) (err error) {
+
+	c.mutex.Lock()
+
+	piece, writes := c.piece(cacheKey{m, pieceIndex}, pieceLength)
+	if piece != nil {
+
+		copy(piece.data[off:], b)
+
+		for i := off / int64(blockLength); i*int64(blockLength) < off+int64(len(b)); i++ {
+			piece.present[i] = true
+			piece.dirty[i] = true
+		}
+
+		piece.version += 1
+	}
+
+	c.mutex.Unlock()
+
+	c.writeEvicted(writes)
+
+	if piece == nil {
+		_, err = m.storage.Piece(pieceIndex).WriteAt(b, off)
+		if err != nil {
+			return errors.Annotate(err, "block cache write block")
+		}
+	}
+
+	return nil
+}
+
+// readPiece reads the piece for hashing, the blocks which are not cached are read from the storage
+func (c *blockCache) readPiece(m *Manager, pieceIndex int, b []byte) (err error) {
+
+	var present []bool
+
+	c.mutex.Lock()
+	piece, cached := c.pieces[cacheKey{m, pieceIndex}]
+	if cached {
+		present = append(present, piece.present...)
+		copy(b, piece.data)
+	}
+	c.mutex.Unlock()
+
+	storage := m.storage.Piece(pieceIndex)
+
+	if !cached {
+		_, err = storage.ReadAt(b, 0)
+		if err != nil {
+			return errors.Annotate(err, "block cache read piece")
+		}
+		return nil
+	}
+
+	for i := range present {
+
+		if present[i] {
+			continue
+		}
+
+		start := i * blockLength
+		end := start + blockLength
+		if end > len(b) {
+			end = len(b)
+		}
+
+		_, err = storage.ReadAt(b[start:end], int64(start))
+		if err != nil {
+			return errors.Annotate(err, "block cache read piece")
+		}
+	}
+
+	return nil
+}
+
+// completePiece writes the verified piece to the storage with one write,
+// the piece stays in the cache for uploading
+func (c *blockCache) completePiece(m *Manager, pieceIndex int, b []byte) (err error) {
+
+	key := cacheKey{m, pieceIndex}
+
+	// blocks of the pieces which do not fit the cache or are evicted are already written
+	c.mutex.Lock()
+	_, ok := c.pieces[key]
+	c.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	_, err = m.storage.Piece(pieceIndex).WriteAt(b, 0)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err != nil {
+		err = errors.Annotate(err, "block cache complete piece")
+	}
+
+	// the piece may be evicted meanwhile
+	piece, ok := c.pieces[key]
+	if !ok {
+		return err
+	}
+
+	copy(piece.data, b)
+
+	// the piece which is not written is kept dirty until it is flushed
+	for i := range piece.present {
+		piece.present[i] = true
+		piece.dirty[i] = err != nil
+	}
+
+	if err != nil {
+		piece.version += 1
+	}
+
+	return err
+}
+
+// discardPiece removes the piece which failed the hash check
+func (c *blockCache) discardPiece(m *Manager, pieceIndex int) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.remove(cacheKey{m, pieceIndex})
+}
+
+// readBlock reads the uploaded block, the whole piece is read from the storage
+// and cached if the block is not cached, it is called from the upload routines
+func (c *blockCache) readBlock(m *Manager, pieceIndex int, pieceLength int64, b []byte, off int64) (err error) {
+
+	key := cacheKey{m, pieceIndex}
+
+	if c.readCached(key, b, off) {
+		return nil
+	}
+
+	c.mutex.Lock()
+	fits := pieceLength <= c.size
+	c.mutex.Unlock()
+
+	storage := m.storage.Piece(pieceIndex)
+
+	if !fits {
+		_, err = storage.ReadAt(b, off)
+		if err != nil {
+			return errors.Annotate(err, "block cache read block")
+		}
+		return nil
+	}
+
+	data := make([]byte, pieceLength)
+
+	_, err = storage.ReadAt(data, 0)
+	if err != nil {
+		return errors.Annotate(err, "block cache read block")
+	}
+
+	copy(b, data[off:])
+
+	c.mutex.Lock()
+
+	// the piece may be cached by another routine meanwhile
+	if _, ok := c.pieces[key]; ok {
+		c.mutex.Unlock()
+		return nil
+	}
+
+	piece, writes := c.piece(key, pieceLength)
+	if piece != nil {
+		copy(piece.data, data)
+		for i := range piece.present {
+			piece.present[i] = true
+		}
+	}
+
+	c.mutex.Unlock()
+
+	c.writeEvicted(writes)
+
+	return nil
+}
+
+// readCached copies the data from the cache if all its blocks are cached
+func (c *blockCache) readCached(key cacheKey, b []byte, off int64) bool {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	piece, ok := c.pieces[key]
+	if !ok || off+int64(len(b)) > int64(len(piece.data)) {
+		return false
+	}
+
+	for i := off / int64(blockLength); i*int64(blockLength) < off+int64(len(b)); i++ {
+		if !piece.present[i] {
+			return false
+		}
+	}
+
+	c.uses += 1
+	piece.lastUsed = c.uses
+
+	copy(b, piece.data[off:])
+
+	return true
+}
+
+// flush writes the dirty blocks of the manager to the storage,
+// the blocks stay dirty if they are written again meanwhile
+func (c *blockCache) flush(m *Manager) (err error) {
+
+	var writes []pieceWrite
+
+	c.mutex.Lock()
+	for key, piece := range c.pieces {
+		if key.manager == m && piece.isDirty() {
+			writes = append(writes, pieceWrite{key, piece, piece.version, piece.dirtyRuns()})
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, write := range writes {
+
+		err = write.write()
+		if err != nil {
+			return errors.Annotate(err, "block cache flush")
+		}
+
+		c.mutex.Lock()
+		if c.pieces[write.key] == write.piece && write.piece.version == write.version {
+			for _, run := range write.runs {
+				for i := run.start; i < run.end; i++ {
+					write.piece.dirty[i] = false
+				}
+			}
+		}
+		c.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// release removes the pieces of the manager without writing them
+func (c *blockCache) release(m *Manager) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key := range c.pieces {
+		if key.manager == m {
+			c.remove(key)
+		}
+	}
+}
+
+// releaseClean removes the pieces of the stopped manager which are written to the storage
+func (c *blockCache) releaseClean(m *Manager) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, piece := range c.pieces {
+		if key.manager == m && !piece.writing && !piece.isDirty() {
+			c.remove(key)
+		}
+	}
+}
+
+// flushStorage writes the cached blocks to the storage and makes them persistent
+func (m *Manager) flushStorage() (err error) {
+
+	err = m.cache.flush(m)
+	if err != nil {
+		return errors.Annotate(err, "manager flush storage")
+	}
+
+	err = m.storage.Flush()
+	if err != nil {
+		return errors.Annotate(err, "manager flush storage")
+	}
+
+	return nil
+}
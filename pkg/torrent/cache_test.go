@@ -0,0 +1,186 @@
+package torrent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+
+	info := Info{PieceLength: 2 * blockSize, PieceCount: 4, TotalLength: 8 * blockSize}
+
+	storage, err := NewMemoryStorageProvider().OpenTorrent(&info, make([]byte, 20))
+	assert.NoError(t, err, "can not open storage")
+
+	manager := NewManager(make([]byte, 20), make([]byte, 20), &info, NewState(8*blockSize, 4), storage)
+
+	// two pieces fit the cache
+	cache := newBlockCache(2 * info.PieceLength)
+	manager.cache = cache
+
+	data := make([]byte, info.TotalLength)
+	rand.Read(data)
+
+	readData := make([]byte, info.PieceLength)
+
+	// the blocks are not written until the piece is verified
+	for offset := int64(0); offset < info.PieceLength; offset += blockSize {
+		err = cache.writeBlock(manager, 0, info.PieceLength, data[offset:offset+blockSize], offset)
+		assert.NoError(t, err, "can not write block")
+	}
+
+	_, err = storage.Piece(0).ReadAt(readData, 0)
+	assert.NoError(t, err, "can not read from storage")
+	assert.EqualValues(t, make([]byte, info.PieceLength), readData, "block is written before verification")
+
+	assert.NoError(t, cache.readPiece(manager, 0, readData), "can not read piece")
+	assert.EqualValues(t, data[:info.PieceLength], readData, "bytes doesnt match")
+
+	assert.NoError(t, cache.completePiece(manager, 0, readData), "can not complete piece")
+
+	_, err = storage.Piece(0).ReadAt(readData, 0)
+	assert.NoError(t, err, "can not read from storage")
+	assert.EqualValues(t, data[:info.PieceLength], readData, "verified piece is not written")
+
+	// the verified piece is evicted without writing, the dirty block is written on eviction
+	assert.NoError(t, cache.writeBlock(manager, 1, info.PieceLength, data[2*blockSize:3*blockSize], 0))
+	assert.NoError(t, cache.writeBlock(manager, 2, info.PieceLength, data[4*blockSize:5*blockSize], 0))
+	assert.NotContains(t, cache.pieces, cacheKey{manager, 0}, "verified piece is not evicted")
+
+	assert.NoError(t, cache.writeBlock(manager, 3, info.PieceLength, data[6*blockSize:7*blockSize], 0))
+	assert.NotContains(t, cache.pieces, cacheKey{manager, 1}, "piece is not evicted")
+	assert.EqualValues(t, 2*info.PieceLength, cache.used, "wrong used memory")
+
+	_, err = storage.Piece(1).ReadAt(readData[:blockSize], 0)
+	assert.NoError(t, err, "can not read from storage")
+	assert.EqualValues(t, data[2*blockSize:3*blockSize], readData[:blockSize], "evicted block is not written")
+
+	// the blocks which are not cached are read from the storage
+	assert.NoError(t, cache.writeBlock(manager, 1, info.PieceLength, data[3*blockSize:4*blockSize], blockSize))
+	assert.NoError(t, cache.readPiece(manager, 1, readData), "can not read piece")
+	assert.EqualValues(t, data[2*blockSize:4*blockSize], readData, "bytes doesnt match")
+
+	// the failed piece is removed
+	cache.discardPiece(manager, 1)
+	assert.NotContains(t, cache.pieces, cacheKey{manager, 1}, "failed piece is not removed")
+
+	// dirty blocks are written on flush
+	assert.NoError(t, manager.flushStorage(), "can not flush cache")
+
+	_, err = storage.Piece(3).ReadAt(readData[:blockSize], 0)
+	assert.NoError(t, err, "can not read from storage")
+	assert.EqualValues(t, data[6*blockSize:7*blockSize], readData[:blockSize], "flushed block is not written")
+
+	// the written pieces of the stopped download are released
+	assert.NoError(t, cache.writeBlock(manager, 1, info.PieceLength, data[2*blockSize:3*blockSize], 0))
+	cache.releaseClean(manager)
+	assert.NotContains(t, cache.pieces, cacheKey{manager, 3}, "clean piece is not released")
+	assert.Contains(t, cache.pieces, cacheKey{manager, 1}, "dirty piece is released")
+
+	cache.release(manager)
+	assert.Empty(t, cache.pieces, "pieces are not released")
+	assert.EqualValues(t, 0, cache.used, "wrong used memory")
+}
+
+func TestBlockCache_WriteError(t *testing.T) {
+
+	info := Info{PieceLength: 2 * blockSize, PieceCount: 2, TotalLength: 4 * blockSize}
+
+	storage, err := NewMemoryStorageProvider().OpenTorrent(&info, make([]byte, 20))
+	assert.NoError(t, err, "can not open storage")
+
+	manager := NewManager(make([]byte, 20), make([]byte, 20), &info, NewState(4*blockSize, 2), storage)
+
+	cache := newBlockCache(info.PieceLength)
+	manager.cache = cache
+
+	data := make([]byte, info.TotalLength)
+	rand.Read(data)
+
+	assert.NoError(t, cache.writeBlock(manager, 0, info.PieceLength, data[:blockSize], 0))
+
+	// the piece is kept if its blocks can not be written on eviction
+	assert.NoError(t, storage.Close(), "can not close storage")
+	cache.setSize(0)
+
+	assert.Contains(t, cache.pieces, cacheKey{manager, 0}, "piece is removed after failed write")
+	assert.EqualValues(t, 0, cache.evicting, "wrong evicting memory")
+
+	readData := make([]byte, blockSize)
+	assert.True(t, cache.readCached(cacheKey{manager, 0}, readData, 0), "block is not cached")
+	assert.EqualValues(t, data[:blockSize], readData, "bytes doesnt match")
+
+	assert.Error(t, cache.flush(manager), "flush to closed storage")
+	assert.True(t, cache.pieces[cacheKey{manager, 0}].isDirty(), "block is not dirty after failed flush")
+}
+
+func TestBlockCache_CompletePieceWriteError(t *testing.T) {
+
+	info := Info{PieceLength: 2 * blockSize, PieceCount: 2, TotalLength: 4 * blockSize}
+
+	storage, err := NewMemoryStorageProvider().OpenTorrent(&info, make([]byte, 20))
+	assert.NoError(t, err, "can not open storage")
+
+	manager := NewManager(make([]byte, 20), make([]byte, 20), &info, NewState(4*blockSize, 2), storage)
+
+	cache := newBlockCache(4 * info.PieceLength)
+	manager.cache = cache
+
+	data := make([]byte, info.TotalLength)
+	rand.Read(data)
+
+	assert.NoError(t, cache.writeBlock(manager, 0, info.PieceLength, data[:blockSize], 0))
+	assert.NoError(t, cache.writeBlock(manager, 0, info.PieceLength, data[blockSize:2*blockSize], blockSize))
+
+	// the verified piece is kept dirty if it can not be written
+	assert.NoError(t, storage.Close(), "can not close storage")
+	assert.Error(t, cache.completePiece(manager, 0, data[:info.PieceLength]), "write to closed storage")
+
+	piece, ok := cache.pieces[cacheKey{manager, 0}]
+	assert.True(t, ok, "piece is removed after failed write")
+	assert.True(t, piece.isDirty(), "piece is not dirty after failed write")
+
+	readData := make([]byte, info.PieceLength)
+	assert.NoError(t, cache.readPiece(manager, 0, readData))
+	assert.EqualValues(t, data[:info.PieceLength], readData, "bytes doesnt match")
+}
+
+func TestBlockCache_ReadBlock(t *testing.T) {
+
+	info := Info{PieceLength: 2 * blockSize, PieceCount: 2, TotalLength: 3 * blockSize}
+
+	storage, err := NewMemoryStorageProvider().OpenTorrent(&info, make([]byte, 20))
+	assert.NoError(t, err, "can not open storage")
+
+	manager := NewManager(make([]byte, 20), make([]byte, 20), &info, NewState(3*blockSize, 2), storage)
+
+	cache := newBlockCache(info.PieceLength)
+	manager.cache = cache
+
+	data := make([]byte, info.TotalLength)
+	rand.Read(data)
+
+	_, err = storage.Piece(0).WriteAt(data[:info.PieceLength], 0)
+	assert.NoError(t, err, "can not write to storage")
+
+	// the piece is cached on the first read
+	readData := make([]byte, blockSize)
+	assert.NoError(t, cache.readBlock(manager, 0, info.PieceLength, readData, blockSize))
+	assert.EqualValues(t, data[blockSize:2*blockSize], readData, "bytes doesnt match")
+	assert.Contains(t, cache.pieces, cacheKey{manager, 0}, "piece is not cached")
+
+	// the next reads are served from the cache
+	_, err = storage.Piece(0).WriteAt(make([]byte, info.PieceLength), 0)
+	assert.NoError(t, err, "can not write to storage")
+
+	assert.NoError(t, cache.readBlock(manager, 0, info.PieceLength, readData, 0))
+	assert.EqualValues(t, data[:blockSize], readData, "block is not read from cache")
+
+	// the pieces are read from the storage if the cache is disabled
+	cache.setSize(0)
+	assert.Empty(t, cache.pieces, "pieces are not evicted")
+
+	assert.NoError(t, cache.readBlock(manager, 0, info.PieceLength, readData, 0))
+	assert.EqualValues(t, make([]byte, blockSize), readData, "block is not read from storage")
+}
@@ -0,0 +1,132 @@
+package torrent
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// DefaultUploadSlots is the number of peers unchoked for their rate
+const DefaultUploadSlots = 4
+
+const rechokeInterval = 10 * time.Second
+
+const optimisticUnchokeInterval = 30 * time.Second
+
+// newly connected peers are three times more likely to be unchoked optimistically
+const newPeerInterval = time.Minute
+const newPeerWeight = 3
+
+// SetUploadSlots sets the number of peers unchoked for their rate,
+// one more peer is unchoked optimistically
+func (m *Manager) SetUploadSlots(slots int) {
+	if slots < 1 {
+		slots = 1
+	}
+	m.uploadSlots = slots
+}
+
+func (m *Manager) chokePeer(seeder *Seeder) {
+	seeder.AmChoking = true
+	seeder.outcoming <- Message{Choke, nil, m.peerId}
+	m.clearUploads(seeder)
+}
+
+func (m *Manager) unchokePeer(seeder *Seeder) {
+	seeder.AmChoking = false
+	seeder.outcoming <- Message{Unchoke, nil, m.peerId}
+}
+
+func (m *Manager) unchokedCount() (count int) {
+	for _, seeder := range m.getSeederSlice() {
+		if !seeder.AmChoking && seeder.PeerInterested {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (m *Manager) handleRechokeTimer() {
+	m.rechokeCount += 1
+	rotate := m.rechokeCount%int(optimisticUnchokeInterval/rechokeInterval) == 0
+	m.rechoke(rotate)
+}
+
+// rechoke unchokes interested peers with the best download rate,
+// or upload rate when seeding, and the optimistically unchoked peer,
+// snubbed peers are not unchoked for their rate while downloading
+func (m *Manager) rechoke(rotate bool) {
+
+	seeding := m.completed()
+
+	rate := func(seeder *Seeder) float64 {
+		if seeding {
+			return seeder.uploadRate
+		}
+		return seeder.downloadRate
+	}
+
+	seeders := m.getSeederSlice()
+
+	var candidates []*Seeder
+	for _, seeder := range seeders {
+		if seeder.PeerInterested {
+			candidates = append(candidates, seeder)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return rate(candidates[i]) > rate(candidates[j])
+	})
+
+	unchoked := make(map[*Seeder]bool)
+	for i, slots := 0, 0; i < len(candidates) && slots < m.uploadSlots; i++ {
+		if seeding || !candidates[i].snubbed {
+			unchoked[candidates[i]] = true
+			slots += 1
+		}
+	}
+
+	optimistic := m.optimisticSeeder
+	if rotate || optimistic == nil || !optimistic.PeerInterested || unchoked[optimistic] {
+		optimistic = m.selectOptimistic(candidates, unchoked)
+	}
+
+	m.optimisticSeeder = optimistic
+	if optimistic != nil {
+		unchoked[optimistic] = true
+	}
+
+	for _, seeder := range seeders {
+		if unchoked[seeder] && seeder.AmChoking {
+			m.unchokePeer(seeder)
+		} else if !unchoked[seeder] && !seeder.AmChoking {
+			m.chokePeer(seeder)
+		}
+	}
+}
+
+// selectOptimistic selects random choked candidate favouring newly connected peers
+func (m *Manager) selectOptimistic(candidates []*Seeder, unchoked map[*Seeder]bool) (selected *Seeder) {
+
+	totalWeight := 0
+
+	for _, seeder := range candidates {
+
+		if unchoked[seeder] {
+			continue
+		}
+
+		weight := 1
+		if time.Since(seeder.connected) < newPeerInterval {
+			weight = newPeerWeight
+		}
+
+		totalWeight += weight
+		if rand.Intn(totalWeight) < weight {
+			selected = seeder
+		}
+	}
+
+	return selected
+}
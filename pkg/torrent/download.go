@@ -2,10 +2,13 @@ package torrent
 
 import (
 	"crypto/rand"
+	"fmt"
 	"github.com/juju/errors"
+	"github.com/lezhenin/gotorrentclient/pkg/dht"
+	"github.com/lezhenin/gotorrentclient/pkg/lsd"
 	log "github.com/sirupsen/logrus"
 	"net"
-	"net/url"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +16,18 @@ import (
 
 const blockLength int = 16 * 1024
 
+const dhtAnnounceInterval = 15 * time.Minute
+const lsdAnnounceInterval = 5 * time.Minute
+
+// announce is retried after the interval if all trackers failed,
+// the interval is doubled after each failure up to the maximum
+const announceRetryInterval = 30 * time.Second
+const maxAnnounceRetryInterval = 30 * time.Minute
+
+// ports tried by the listener of the download
+const listenPortRangeStart = 8861
+const listenPortRangeEnd = 8871
+
 type Download struct {
 	Metadata     *Metadata
 	PeerId       []byte
@@ -24,15 +39,48 @@ type Download struct {
 
 	State   *State
 	manager *Manager
-	tracker *Tracker
-	storage *Storage
+	tracker *TrackerList
+	storage TorrentStorage
+
+	// DHT and LSD are optional peer sources, they must be set before start
+	DHT *dht.DHT
+	LSD *lsd.LSD
+
+	// RequestQueueDepth is the maximal number of outstanding requests to a peer
+	RequestQueueDepth int
+
+	// UploadSlots is the number of peers unchoked for their rate
+	UploadSlots int
+
+	// MaxConnections is the maximal number of connected peers
+	MaxConnections int
+
+	// SnubInterval is the time without received blocks after which a peer is snubbed
+	SnubInterval time.Duration
+
+	// ResumePath is the file with resume data, empty path disables resume data
+	ResumePath string
+
+	// ForceRecheck makes the first start verify the files instead of loading resume data
+	ForceRecheck bool
+
+	resumed bool
 
 	peerStatus map[string]bool
 
+	peersChannel chan []string
+
 	Done chan struct{}
 
+	// completed event is sent once, the download may be reopened by priority change
+	completedAnnounced bool
+
 	announceTimer *time.Timer
 
+	// first retry interval of failed announce and the current one
+	announceRetryInterval time.Duration
+	retryInterval         time.Duration
+
 	wg sync.WaitGroup
 
 	exit                   bool
@@ -46,6 +94,18 @@ func (d *Download) Start() (err error) {
 		return
 	}
 
+	if !d.resumed {
+		err = d.resume()
+		if err != nil {
+			err = errors.Annotate(err, "download start")
+			log.WithFields(log.Fields{
+				"infoHash": d.InfoHash,
+			}).Error(err)
+			return err
+		}
+		d.resumed = true
+	}
+
 	d.wg.Add(4)
 
 	// drain timer
@@ -53,18 +113,6 @@ func (d *Download) Start() (err error) {
 
 	// tracker
 
-	announceUrl, _ := url.Parse(d.Metadata.Announce)
-	conn, _ := net.Dial("udp", announceUrl.Host)
-
-	d.tracker, err = NewTracker(d.PeerId, d.InfoHash, conn)
-	if err != nil {
-		err = errors.Annotate(err, "download start")
-		log.WithFields(log.Fields{
-			"infoHash": d.InfoHash,
-		}).Error(err)
-		return err
-	}
-
 	go func() {
 		defer d.wg.Done()
 		err = d.tracker.Run()
@@ -78,7 +126,7 @@ func (d *Download) Start() (err error) {
 
 	// listener
 
-	listener, err := NewListener(8861, 8871)
+	listener, err := NewListener(listenPortRangeStart, listenPortRangeEnd)
 	if err != nil {
 		err = errors.Annotate(err, "download start")
 		log.WithFields(log.Fields{
@@ -88,6 +136,11 @@ func (d *Download) Start() (err error) {
 	}
 
 	d.ListenPort = uint16(listener.Port)
+	d.manager.SetListenPort(d.ListenPort)
+	d.manager.SetRequestQueueDepth(d.RequestQueueDepth)
+	d.manager.SetUploadSlots(d.UploadSlots)
+	d.manager.SetSnubInterval(d.SnubInterval)
+	d.manager.SetMaxConnections(d.MaxConnections)
 
 	go func() {
 		defer d.wg.Done()
@@ -109,9 +162,29 @@ func (d *Download) Start() (err error) {
 
 	// main routine
 
+	// peers added before start are handled only if download is not stopped
+	d.State.SetStopped(false)
+
 	d.exit = false
 	log.Debug(d.exit)
 
+	sourcesStop := make(chan struct{})
+
+	d.retryInterval = d.announceRetryInterval
+
+	// private torrents get peers only from their trackers (BEP 27)
+	private := d.Metadata.Info.Private
+
+	if d.DHT != nil && !private {
+		d.wg.Add(1)
+		go d.announceDHT(sourcesStop)
+	}
+
+	if d.LSD != nil && !private {
+		d.wg.Add(1)
+		go d.announceLSD(sourcesStop)
+	}
+
 	go func() {
 
 		defer d.wg.Done()
@@ -119,66 +192,73 @@ func (d *Download) Start() (err error) {
 		for !d.exit {
 
 			select {
-			case response := <-d.tracker.announceResponseChannel:
+			case result := <-d.tracker.announceResponseChannel:
 
 				atomic.AddInt32(&d.unhandledAnnounceCount, -1)
 
-				interval := time.Duration(response.AnnounceInterval)
-				d.announceTimer.Reset(time.Second * interval)
+				if result.err != nil {
+					d.announceTimer.Reset(d.retryInterval)
+					d.retryInterval *= 2
+					if d.retryInterval > maxAnnounceRetryInterval {
+						d.retryInterval = maxAnnounceRetryInterval
+					}
+				} else {
+					d.retryInterval = d.announceRetryInterval
+					interval := time.Duration(result.response.AnnounceInterval)
+					d.announceTimer.Reset(time.Second * interval)
+				}
 
 				if atomic.LoadInt32(&d.unhandledAnnounceCount) == 0 && d.State.Stopped() {
 					d.exit = true
 					continue
 				}
 
-				if d.State.Finished() || d.State.Stopped() {
+				if result.err != nil || d.State.Finished() || d.State.Stopped() {
 					continue
 				}
 
-				for _, peer := range response.Peers {
+				d.connectPeers(result.response.Peers, listener)
 
-					if d.State.Finished() || d.State.Stopped() {
-						break
-					}
+			case peers := <-d.peersChannel:
 
-					addr, err := net.ResolveTCPAddr("tcp", peer)
-					if err != nil {
-						err = errors.Annotate(err, "download start")
-						log.WithFields(log.Fields{
-							"infoHash": d.InfoHash,
-						}).Error(err)
-						continue
-					}
+				if d.State.Finished() || d.State.Stopped() {
+					continue
+				}
 
-					conn, err := net.DialTimeout(addr.Network(), addr.String(), time.Second)
-					if err != nil {
-						err = errors.Annotate(err, "download start")
-						log.WithFields(log.Fields{
-							"infoHash": d.InfoHash,
-						}).Error(err)
-						continue
-					}
+				d.connectPeers(peers, listener)
 
-					err = d.manager.AddSeeder(conn, false)
-					if err != nil {
-						err = errors.Annotate(err, "download start")
-						log.WithFields(log.Fields{
-							"infoHash": d.InfoHash,
-						}).Error(err)
-						continue
-					}
+			case peers := <-d.manager.Peers:
 
+				if d.State.Finished() || d.State.Stopped() {
+					continue
 				}
 
+				d.connectPeers(peers, listener)
+
 			case conn := <-listener.Connections:
 				log.Debug("conn accept")
 				_ = d.manager.AddSeeder(conn, true)
 
 			case <-d.manager.Done:
 				log.Debug("done")
-				d.State.SetFinished(true)
-				d.announce(Completed, 0)
-				d.Done <- struct{}{}
+				if !d.State.Finished() {
+					d.State.SetFinished(true)
+					if !d.completedAnnounced {
+						d.completedAnnounced = true
+						d.announce(Completed, 0)
+					}
+				}
+				select {
+				case d.Done <- struct{}{}:
+				default:
+				}
+
+			case err := <-d.manager.Errors:
+				log.WithFields(log.Fields{
+					"infoHash": d.InfoHash,
+				}).Error(errors.Annotate(err, "download stopped"))
+				// stop waits for this routine
+				go d.Stop()
 
 			case <-d.announceTimer.C:
 				log.Debug("announce timer")
@@ -193,11 +273,10 @@ func (d *Download) Start() (err error) {
 
 		listener.Close()
 		d.tracker.Close()
+		close(sourcesStop)
 
 	}()
 
-	d.State.SetStopped(false)
-
 	d.announce(Started, 100)
 
 	d.wg.Wait()
@@ -222,6 +301,192 @@ func (d *Download) Stop() {
 
 }
 
+// resume opens the files and restores the state from the resume data,
+// the files are verified if the data is absent or stale
+func (d *Download) resume() (err error) {
+
+	err = d.manager.openFiles()
+	if err != nil {
+		return errors.Annotate(err, "download resume")
+	}
+
+	d.manager.SetResumePath(d.ResumePath)
+	d.manager.updatePriorities()
+
+	if !d.ForceRecheck && d.ResumePath != "" {
+
+		err := d.manager.LoadResume(d.ResumePath)
+		if err == nil {
+			d.State.SetFinished(d.manager.completed())
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"infoHash": d.InfoHash,
+		}).Debug(errors.Annotate(err, "download resume"))
+	}
+
+	// files created by the storage have nothing to verify
+	storage, ok := d.storage.(fileStorage)
+	if d.ForceRecheck || (ok && storage.hasData()) {
+		err := d.manager.Recheck()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"infoHash": d.InfoHash,
+			}).Error(errors.Annotate(err, "download resume"))
+		}
+	}
+
+	d.State.SetFinished(d.manager.completed())
+
+	return nil
+}
+
+// Close stops the download and closes its storage
+func (d *Download) Close() (err error) {
+
+	d.Stop()
+
+	// the blocks are written to the storage on stop
+	d.manager.cache.release(d.manager)
+
+	err = d.storage.Close()
+	if err != nil {
+		return errors.Annotate(err, "download close")
+	}
+
+	return nil
+}
+
+func (d *Download) connectPeers(peers []string, listener *Listener) {
+
+	for _, peer := range peers {
+
+		if d.State.Finished() || d.State.Stopped() {
+			break
+		}
+
+		addr, err := net.ResolveTCPAddr("tcp", peer)
+		if err != nil {
+			err = errors.Annotate(err, "download connect peers")
+			log.WithFields(log.Fields{
+				"infoHash": d.InfoHash,
+			}).Error(err)
+			continue
+		}
+
+		if addr.IP.To4() == nil && !listener.IPv6 {
+			log.WithFields(log.Fields{
+				"infoHash": d.InfoHash,
+				"peer":     addr.String(),
+			}).Debug("ipv6 is not available, peer is skipped")
+			continue
+		}
+
+		conn, err := net.DialTimeout(addr.Network(), addr.String(), time.Second)
+		if err != nil {
+			err = errors.Annotate(err, "download connect peers")
+			log.WithFields(log.Fields{
+				"infoHash": d.InfoHash,
+			}).Error(err)
+			continue
+		}
+
+		err = d.manager.AddSeeder(conn, false)
+		if err != nil {
+			err = errors.Annotate(err, "download connect peers")
+			log.WithFields(log.Fields{
+				"infoHash": d.InfoHash,
+			}).Error(err)
+			continue
+		}
+	}
+}
+
+// announceDHT periodically announces the download to DHT
+// and passes found peers to the main routine
+func (d *Download) announceDHT(stop chan struct{}) {
+
+	defer d.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+
+		select {
+		case <-timer.C:
+		case <-stop:
+			return
+		}
+
+		peers, err := d.DHT.AnnouncePeer(d.InfoHash, d.ListenPort)
+		if err != nil {
+			err = errors.Annotate(err, "download announce dht")
+			log.WithFields(log.Fields{
+				"infoHash": d.InfoHash,
+			}).Warn(err)
+		}
+
+		if len(peers) > 0 {
+			select {
+			case d.peersChannel <- peers:
+			case <-stop:
+				return
+			}
+		}
+
+		timer.Reset(dhtAnnounceInterval)
+	}
+}
+
+// announceLSD periodically announces the download to the local network
+// and passes found peers to the main routine
+func (d *Download) announceLSD(stop chan struct{}) {
+
+	defer d.wg.Done()
+
+	peers := d.LSD.Subscribe(d.InfoHash)
+	defer d.LSD.Unsubscribe(d.InfoHash)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+
+		select {
+
+		case <-timer.C:
+
+			err := d.LSD.Announce(d.InfoHash, d.ListenPort)
+			if err != nil {
+				err = errors.Annotate(err, "download announce lsd")
+				log.WithFields(log.Fields{
+					"infoHash": d.InfoHash,
+				}).Warn(err)
+			}
+
+			timer.Reset(lsdAnnounceInterval)
+
+		case found := <-peers:
+
+			select {
+			case d.peersChannel <- found:
+			case <-stop:
+				return
+			}
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+// AddPeers passes peer addresses from other sources than trackers to the download
+func (d *Download) AddPeers(peers []string) {
+	d.peersChannel <- peers
+}
+
 func (d *Download) announce(event Event, peersCount uint32) {
 
 	atomic.AddInt32(&d.unhandledAnnounceCount, 1)
@@ -237,7 +502,78 @@ func (d *Download) announce(event Event, peersCount uint32) {
 
 }
 
+func (d *Download) TrackerStatus() []TrackerStatus {
+	return d.tracker.Status()
+}
+
+// SetUploadLimit sets the upload rate of the download in bytes per second
+// in addition to the global limit, zero rate means no limit
+func (d *Download) SetUploadLimit(rate int64) {
+	d.manager.SetUploadLimit(rate)
+}
+
+// SetDownloadLimit sets the download rate of the download in bytes per second
+// in addition to the global limit, zero rate means no limit
+func (d *Download) SetDownloadLimit(rate int64) {
+	d.manager.SetDownloadLimit(rate)
+}
+
+// SetFilePriority sets the priority of the file with the index in Metadata.Info.Files,
+// pieces of skipped files are not downloaded and the files are not created
+func (d *Download) SetFilePriority(index int, priority Priority) (err error) {
+	err = d.manager.SetFilePriority(index, priority)
+	if err != nil {
+		return errors.Annotate(err, "download set file priority")
+	}
+	return nil
+}
+
+// FilePriorities returns the priorities of the files
+func (d *Download) FilePriorities() []Priority {
+	return d.manager.FilePriorities()
+}
+
+// Availability returns the number of connected peers having each piece
+func (d *Download) Availability() []int {
+	return d.manager.Availability()
+}
+
+func (d *Download) Scrape() (response ScrapeResponse, err error) {
+
+	responses, err := d.tracker.scrape([][]byte{d.InfoHash})
+	if err != nil {
+		return ScrapeResponse{}, errors.Annotate(err, "download scrape")
+	}
+
+	return responses[0], nil
+}
+
+// NewDownload returns the download keeping the data in the files in the directory
 func NewDownload(metadata *Metadata, downloadPath string) (d *Download, err error) {
+	return newFileDownload(metadata, downloadPath, NewFileStorageProvider(downloadPath))
+}
+
+// NewMmapDownload returns the download keeping the data in the files in the directory,
+// the files are accessed through memory mappings
+func NewMmapDownload(metadata *Metadata, downloadPath string) (d *Download, err error) {
+	return newFileDownload(metadata, downloadPath, NewMmapStorageProvider(downloadPath))
+}
+
+func newFileDownload(metadata *Metadata, downloadPath string, provider StorageProvider) (d *Download, err error) {
+
+	d, err = NewDownloadWithStorage(metadata, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	d.ResumePath = filepath.Join(downloadPath, fmt.Sprintf(".%x.resume", d.InfoHash))
+
+	return d, nil
+}
+
+// NewDownloadWithStorage returns the download keeping the data in the storage opened by the provider,
+// resume data is not saved unless ResumePath is set
+func NewDownloadWithStorage(metadata *Metadata, provider StorageProvider) (d *Download, err error) {
 
 	d = new(Download)
 
@@ -258,7 +594,13 @@ func NewDownload(metadata *Metadata, downloadPath string) (d *Download, err erro
 	d.State = NewState(uint64(d.Metadata.Info.TotalLength), uint(d.Metadata.Info.PieceCount))
 	d.State.SetStopped(true)
 
-	d.storage, err = NewStorage(d.Metadata.Info, downloadPath)
+	// files are opened on the first start when their priorities are known
+	d.storage, err = provider.OpenTorrent(&d.Metadata.Info, d.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	d.tracker, err = NewTrackerList(d.PeerId, d.InfoHash, d.Metadata.Announce, d.Metadata.AnnounceList)
 	if err != nil {
 		return nil, err
 	}
@@ -268,11 +610,22 @@ func NewDownload(metadata *Metadata, downloadPath string) (d *Download, err erro
 		return nil, err
 	}
 
+	d.RequestQueueDepth = DefaultRequestQueueDepth
+	d.UploadSlots = DefaultUploadSlots
+	d.SnubInterval = DefaultSnubInterval
+	d.MaxConnections = DefaultMaxConnections
+
 	d.peerStatus = make(map[string]bool)
-	d.Done = make(chan struct{})
+	d.Done = make(chan struct{}, 1)
+
+	d.peersChannel = make(chan []string, 16)
+	if len(d.Metadata.Peers) > 0 {
+		d.AddPeers(d.Metadata.Peers)
+	}
 
 	d.announceTimer = time.NewTimer(0)
 	<-d.announceTimer.C
+	d.announceRetryInterval = announceRetryInterval
 
 	d.exitTimer = time.NewTimer(0)
 	//<-d.exitTimer.C
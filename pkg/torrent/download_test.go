@@ -5,12 +5,17 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/zeebo/bencode"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -340,3 +345,129 @@ func TestDownload_Finish(t *testing.T) {
 	trackerConn.Close()
 	seederListener.Close()
 }
+
+func TestDownload_AnnounceRetry(t *testing.T) {
+
+	var requestCount int32
+	requests := make(chan string, 16)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		response := map[string]interface{}{"interval": 1800, "peers": ""}
+
+		// the tracker is down for the first two announces
+		if atomic.AddInt32(&requestCount, 1) <= 2 {
+			response = map[string]interface{}{"failure reason": "tracker is down"}
+		}
+
+		data, err := bencode.EncodeBytes(response)
+		assert.NoError(t, err, "can not encode response")
+		_, _ = w.Write(data)
+
+		requests <- r.URL.Query().Get("event")
+	}))
+
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "TestDownload_AnnounceRetry")
+	assert.NoError(t, err, "can not create directory")
+	defer os.RemoveAll(tempDir)
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not read metadata")
+
+	metadata.Announce = server.URL + "/announce"
+	metadata.AnnounceList = nil
+
+	download, err := NewDownload(metadata, tempDir)
+	assert.NoError(t, err, "can not create download")
+
+	download.announceRetryInterval = 50 * time.Millisecond
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		err := download.Start()
+		assert.NoError(t, err, "download finished with error")
+	}()
+
+	// failed announces are retried until the tracker recovers
+	for _, event := range []string{"started", "", ""} {
+		select {
+		case received := <-requests:
+			assert.EqualValues(t, event, received, "wrong event")
+		case <-time.After(5 * time.Second):
+			t.Fatal("announce is not retried")
+		}
+	}
+
+	download.Stop()
+	wg.Wait()
+
+	assert.EqualValues(t, "stopped", <-requests, "wrong event")
+	assert.EqualValues(t, 0, atomic.LoadInt32(&download.unhandledAnnounceCount),
+		"failed announces are not handled")
+}
+
+func TestDownload_CompletedOnce(t *testing.T) {
+
+	requests := make(chan string, 16)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		data, err := bencode.EncodeBytes(map[string]interface{}{"interval": 1800, "peers": ""})
+		assert.NoError(t, err, "can not encode response")
+		_, _ = w.Write(data)
+
+		requests <- r.URL.Query().Get("event")
+	}))
+
+	defer server.Close()
+
+	tempDir, err := ioutil.TempDir("", "TestDownload_CompletedOnce")
+	assert.NoError(t, err, "can not create directory")
+	defer os.RemoveAll(tempDir)
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not read metadata")
+
+	metadata.Announce = server.URL + "/announce"
+	metadata.AnnounceList = nil
+
+	download, err := NewDownload(metadata, tempDir)
+	assert.NoError(t, err, "can not create download")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		err := download.Start()
+		assert.NoError(t, err, "download finished with error")
+	}()
+
+	assert.EqualValues(t, "started", <-requests, "wrong event")
+
+	download.manager.Done <- struct{}{}
+	assert.EqualValues(t, "completed", <-requests, "wrong event")
+
+	// download is reopened by priority change and completed again,
+	// nobody waits for the done signal
+	download.State.SetFinished(false)
+	download.manager.Done <- struct{}{}
+
+	for i := 0; !download.State.Finished(); i++ {
+		if i == 100 {
+			t.Fatal("download is not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	download.Stop()
+	wg.Wait()
+
+	assert.EqualValues(t, "stopped", <-requests, "completed is announced twice")
+	assert.Len(t, download.Done, 1, "done is not signalled")
+}
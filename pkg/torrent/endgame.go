@@ -0,0 +1,100 @@
+package torrent
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// endGame reports whether all remaining blocks of wanted pieces are requested,
+// then the blocks are requested from several peers
+func (m *Manager) endGame() bool {
+
+	remaining := false
+
+	for index := 0; index < int(m.pieceCount); index++ {
+
+		if m.piecePriorities[index] == PrioritySkip || m.downloadedPieceBitfield.Get(uint(index)) == 1 {
+			continue
+		}
+
+		startIndex := uint(m.convertPieceToGlobalBlockIndex(index, 0))
+		endIndex := startIndex + uint(m.blocksPerPiece)
+		if int64(index) == m.pieceCount-1 {
+			endIndex = uint(m.blockCount)
+		}
+
+		if m.downloadingBlockBitfield.GetFirstIndex(startIndex, 0) < endIndex {
+			return false
+		}
+
+		remaining = true
+	}
+
+	return remaining
+}
+
+// requestEndGameBlock requests the block already requested from other peers,
+// the block with the least number of requests is selected
+func (m *Manager) requestEndGameBlock(seeder *Seeder) (pieceIndex, blockIndex int, interested bool) {
+
+	selectedIndex := int64(-1)
+	selectedCount := 0
+
+	index := m.downloadedBlockBitfield.GetFirstIndex(0, 0)
+	for index < uint(m.blockCount) {
+
+		pieceIndex, _ = m.convertGlobalBlockToPieceIndex(int64(index))
+
+		if !seeder.requests[int64(index)] && m.canRequest(seeder, pieceIndex) {
+			count := m.requestCount(int64(index))
+			if selectedIndex < 0 || count < selectedCount {
+				selectedIndex = int64(index)
+				selectedCount = count
+			}
+		}
+
+		index = m.downloadedBlockBitfield.GetFirstIndex(index+1, 0)
+	}
+
+	if selectedIndex < 0 {
+		return 0, 0, false
+	}
+
+	seeder.requests[selectedIndex] = true
+
+	pieceIndex, blockIndex = m.convertGlobalBlockToPieceIndex(selectedIndex)
+
+	managerLogger.WithFields(logrus.Fields{
+		"pieceIndex": pieceIndex,
+		"blockIndex": blockIndex,
+		"requests":   selectedCount + 1,
+		"infoHash":   m.infoHash,
+	}).Trace("block requested in end game")
+
+	return pieceIndex, blockIndex, true
+}
+
+func (m *Manager) requestCount(globalBlockIndex int64) (count int) {
+	for _, seeder := range m.getSeederSlice() {
+		if seeder.requests[globalBlockIndex] {
+			count += 1
+		}
+	}
+	return count
+}
+
+// cancelRequests cancels the received block at the peers it is requested from
+func (m *Manager) cancelRequests(globalBlockIndex int64) {
+
+	for _, seeder := range m.getSeederSlice() {
+
+		if !seeder.requests[globalBlockIndex] {
+			continue
+		}
+
+		delete(seeder.requests, globalBlockIndex)
+
+		pieceIndex, blockIndex := m.convertGlobalBlockToPieceIndex(globalBlockIndex)
+		index, offset, length := m.convertPieceIndexToOffset(pieceIndex, blockIndex)
+		seeder.outcoming <- Message{Cancel, MakeCancelPayload(index, offset, length), m.peerId}
+	}
+}
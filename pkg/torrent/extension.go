@@ -0,0 +1,146 @@
+package torrent
+
+import (
+	"github.com/juju/errors"
+	"github.com/zeebo/bencode"
+	"sync"
+)
+
+// Extension is a named extension of the extension protocol (BEP 10),
+// its handlers are called from the reading routine of the seeder
+type Extension interface {
+	Name() string
+	// ExtendHandshake adds extension fields to the extended handshake
+	ExtendHandshake(handshake map[string]interface{})
+	HandleHandshake(seeder *Seeder, handshake dictionary) error
+	// HandleMessage receives payload without extended message id
+	HandleMessage(seeder *Seeder, payload []byte) error
+}
+
+// ExtensionRegistry assigns local message ids to extensions,
+// the id of an extension is its registration number starting from 1
+type ExtensionRegistry struct {
+	extensions []Extension
+	mutex      sync.RWMutex
+}
+
+func NewExtensionRegistry(extensions ...Extension) (registry *ExtensionRegistry) {
+
+	registry = new(ExtensionRegistry)
+
+	for _, extension := range extensions {
+		registry.Register(extension)
+	}
+
+	return registry
+}
+
+func (r *ExtensionRegistry) Register(extension Extension) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.extensions = append(r.extensions, extension)
+}
+
+func (r *ExtensionRegistry) extension(localId byte) (extension Extension, ok bool) {
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if localId == extendedHandshakeId || int(localId) > len(r.extensions) {
+		return nil, false
+	}
+
+	return r.extensions[localId-1], true
+}
+
+func (r *ExtensionRegistry) makeHandshakePayload() (payload []byte) {
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	ids := make(map[string]interface{})
+	handshake := map[string]interface{}{"m": ids}
+
+	for i, extension := range r.extensions {
+		ids[extension.Name()] = int64(i + 1)
+		extension.ExtendHandshake(handshake)
+	}
+
+	data, err := bencode.EncodeBytes(handshake)
+	if err != nil {
+		panic(err)
+	}
+
+	return append([]byte{extendedHandshakeId}, data...)
+}
+
+func (r *ExtensionRegistry) handleMessage(seeder *Seeder, payload []byte) (err error) {
+
+	if len(payload) == 0 {
+		return errors.Errorf("handle extended message: message is empty")
+	}
+
+	if payload[0] == extendedHandshakeId {
+
+		handshake, err := parseExtendedHandshakePayload(payload)
+		if err != nil {
+			return errors.Annotate(err, "handle extended message")
+		}
+
+		ids, err := getDict(handshake, "m")
+		if err != nil {
+			return errors.Annotate(err, "handle extended message")
+		}
+
+		seeder.setPeerExtensionIds(ids)
+
+		r.mutex.RLock()
+		extensions := append([]Extension{}, r.extensions...)
+		r.mutex.RUnlock()
+
+		for _, extension := range extensions {
+			err = extension.HandleHandshake(seeder, handshake)
+			if err != nil {
+				return errors.Annotate(err, "handle extended message")
+			}
+		}
+
+		return nil
+	}
+
+	extension, ok := r.extension(payload[0])
+	if !ok {
+		return errors.Errorf("handle extended message: unknown extended message id %d", payload[0])
+	}
+
+	err = extension.HandleMessage(seeder, payload[1:])
+	if err != nil {
+		return errors.Annotate(err, "handle extended message")
+	}
+
+	return nil
+}
+
+func parseExtendedHandshakePayload(payload []byte) (handshake dictionary, err error) {
+
+	if len(payload) < 1 || payload[0] != extendedHandshakeId {
+		return nil, errors.Errorf("parse extended handshake: message is not handshake")
+	}
+
+	var decoded interface{}
+
+	err = bencode.DecodeBytes(payload[1:], &decoded)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse extended handshake")
+	}
+
+	handshake, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.Annotate(DecodeError{decoded, "handshake"},
+			"parse extended handshake")
+	}
+
+	return handshake, nil
+}
@@ -0,0 +1,180 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+type testExtension struct {
+	name       string
+	handshakes chan dictionary
+	messages   chan []byte
+}
+
+func newTestExtension(name string) *testExtension {
+	return &testExtension{name, make(chan dictionary, 1), make(chan []byte, 1)}
+}
+
+func (e *testExtension) Name() string {
+	return e.name
+}
+
+func (e *testExtension) ExtendHandshake(handshake map[string]interface{}) {
+	handshake["test"] = e.name
+}
+
+func (e *testExtension) HandleHandshake(seeder *Seeder, handshake dictionary) error {
+	e.handshakes <- handshake
+	return nil
+}
+
+func (e *testExtension) HandleMessage(seeder *Seeder, payload []byte) error {
+	e.messages <- payload
+	return nil
+}
+
+func makeTestExtendedSeeders(t *testing.T, local, remote *ExtensionRegistry) (localSeeder, remoteSeeder *Seeder) {
+
+	infoHash := make([]byte, 20)
+	rand.Read(infoHash)
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	localSeeder, _ = makeTestSeeder(infoHash, peerId)
+	localSeeder.EnableExtensions(local)
+
+	rand.Read(peerId)
+
+	remoteSeeder, _ = makeTestSeeder(infoHash, peerId)
+	remoteSeeder.EnableExtensions(remote)
+
+	interiorConn, exteriorConn := net.Pipe()
+
+	errorChannel := make(chan error, 1)
+
+	go func() {
+		errorChannel <- remoteSeeder.Accept(exteriorConn)
+	}()
+
+	assert.NoError(t, localSeeder.Dial(interiorConn), "dial finished with error")
+	assert.NoError(t, <-errorChannel, "accept finished with error")
+
+	go localSeeder.Start()
+	go remoteSeeder.Start()
+
+	return localSeeder, remoteSeeder
+}
+
+func TestExtensionRegistry_Handshake(t *testing.T) {
+
+	first := newTestExtension("first")
+	second := newTestExtension("second")
+	remote := newTestExtension("second")
+
+	localSeeder, remoteSeeder := makeTestExtendedSeeders(t,
+		NewExtensionRegistry(first, second), NewExtensionRegistry(remote))
+
+	defer localSeeder.Close()
+	defer remoteSeeder.Close()
+
+	assert.True(t, localSeeder.SupportsExtensions(), "extension bit is not set")
+
+	select {
+	case handshake := <-remote.handshakes:
+		ids, err := getDict(handshake, "m")
+		assert.NoError(t, err, "handshake has no ids")
+		assert.EqualValues(t, 1, ids["first"], "wrong id of first extension")
+		assert.EqualValues(t, 2, ids["second"], "wrong id of second extension")
+		assert.EqualValues(t, "second", handshake["test"], "handshake is not extended")
+	case <-time.After(time.Second):
+		t.Fatal("handshake was not received")
+	}
+
+	select {
+	case <-second.handshakes:
+	case <-time.After(time.Second):
+		t.Fatal("handshake was not received")
+	}
+
+	<-first.handshakes
+
+	assert.True(t, localSeeder.PeerSupports("second"), "peer doesn't support extension")
+	assert.False(t, localSeeder.PeerSupports("first"), "peer supports unknown extension")
+
+	err := localSeeder.SendExtended("first", []byte{1})
+	assert.Error(t, err, "message was sent with unsupported extension")
+
+	err = localSeeder.SendExtended("second", []byte{1, 2, 3})
+	assert.NoError(t, err, "message was not sent")
+
+	select {
+	case payload := <-remote.messages:
+		assert.Equal(t, []byte{1, 2, 3}, payload, "wrong payload")
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+
+	err = remoteSeeder.SendExtended("second", []byte{4})
+	assert.NoError(t, err, "message was not sent")
+
+	select {
+	case payload := <-second.messages:
+		assert.Equal(t, []byte{4}, payload, "wrong payload")
+	case <-first.messages:
+		t.Fatal("message was dispatched to wrong extension")
+	case <-time.After(time.Second):
+		t.Fatal("message was not received")
+	}
+}
+
+func TestExtensionRegistry_UnknownId(t *testing.T) {
+
+	extension := newTestExtension("test")
+	registry := NewExtensionRegistry(extension)
+
+	seeder, _ := makeTestSeeder(make([]byte, 20), make([]byte, 20))
+
+	err := registry.handleMessage(seeder, []byte{2, 1})
+	assert.Error(t, err, "message with unknown id was handled")
+
+	err = registry.handleMessage(seeder, []byte{})
+	assert.Error(t, err, "empty message was handled")
+
+	err = registry.handleMessage(seeder, []byte{1, 5})
+	assert.NoError(t, err, "message was not handled")
+	assert.Equal(t, []byte{5}, <-extension.messages, "wrong payload")
+}
+
+func TestExtension_ServeMetadata(t *testing.T) {
+
+	infoBytes := makeTestInfoBytes(3)
+	infoHash := sha1.Sum(infoBytes)
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	seeder, _ := makeTestSeeder(infoHash[:], peerId)
+	seeder.EnableExtensions(NewExtensionRegistry(newMetadataExtension(infoHash[:], infoBytes)))
+
+	interiorConn, exteriorConn := net.Pipe()
+
+	go func() {
+		if seeder.Accept(exteriorConn) == nil {
+			seeder.Start()
+		}
+	}()
+
+	defer seeder.Close()
+
+	rand.Read(peerId)
+
+	received, err := fetchMetadata(interiorConn, infoHash[:], peerId)
+	assert.NoError(t, err, "fetch finished with error")
+	assert.True(t, bytes.Equal(infoBytes, received), "received metadata is wrong")
+}
@@ -0,0 +1,418 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/bencode"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const httpTrackerTimeout = 30 * time.Second
+
+type HttpTracker struct {
+	announceUrl string
+	trackerId   string
+
+	client *http.Client
+
+	peerId   []byte
+	infoHash []byte
+
+	context context.Context
+	cancel  context.CancelFunc
+
+	closeOnce sync.Once
+}
+
+func NewHttpTracker(peerId, infoHash []byte, announceUrl string) (tracker *HttpTracker, err error) {
+
+	parsedUrl, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, errors.Annotate(err, "new http tracker")
+	}
+
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return nil, errors.Errorf("new http tracker: unsupported scheme %s", parsedUrl.Scheme)
+	}
+
+	tracker = new(HttpTracker)
+
+	tracker.announceUrl = announceUrl
+	tracker.client = &http.Client{Timeout: httpTrackerTimeout}
+
+	tracker.infoHash = infoHash
+	tracker.peerId = peerId
+
+	tracker.context, tracker.cancel = context.WithCancel(context.Background())
+
+	return tracker, nil
+}
+
+func (t *HttpTracker) Close() {
+	t.closeOnce.Do(func() {
+		t.cancel()
+
+		trackerLogger.WithFields(logrus.Fields{
+			"url": t.announceUrl,
+		}).Info("tracker connection is closed")
+
+	})
+}
+
+func (t *HttpTracker) announce(request AnnounceRequest) (response AnnounceResponse, err error) {
+
+	requestUrl := makeHttpAnnounceUrl(t.announceUrl, t.peerId, t.infoHash, t.trackerId, request)
+
+	httpRequest, err := http.NewRequest(http.MethodGet, requestUrl, nil)
+	if err != nil {
+		return AnnounceResponse{},
+			errors.Annotate(err, "http tracker announce")
+	}
+
+	httpResponse, err := t.client.Do(httpRequest.WithContext(t.context))
+	if err != nil {
+		return AnnounceResponse{},
+			errors.Annotate(err, "http tracker announce")
+	}
+
+	defer httpResponse.Body.Close()
+
+	trackerLogger.WithFields(logrus.Fields{
+		"url":   t.announceUrl,
+		"event": request.Event,
+		"port":  request.Port,
+	}).Trace("announce request sent")
+
+	data, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return AnnounceResponse{},
+			errors.Annotate(err, "http tracker announce")
+	}
+
+	response, trackerId, warning, err := parseHttpAnnounceResponse(data)
+
+	if err != nil {
+		if httpResponse.StatusCode != http.StatusOK {
+			if _, ok := errors.Cause(err).(TrackerError); !ok {
+				err = errors.Errorf("unexpected status %s", httpResponse.Status)
+			}
+		}
+		return AnnounceResponse{},
+			errors.Annotate(err, "http tracker announce")
+	}
+
+	if warning != "" {
+		trackerLogger.WithFields(logrus.Fields{
+			"url": t.announceUrl,
+		}).Warn(warning)
+	}
+
+	if trackerId != "" {
+		t.trackerId = trackerId
+	}
+
+	trackerLogger.WithFields(logrus.Fields{
+		"url":         t.announceUrl,
+		"interval":    response.AnnounceInterval,
+		"peers_count": len(response.Peers),
+		"peers":       response.Peers,
+	}).Trace("announce response received")
+
+	return response, nil
+}
+
+func (t *HttpTracker) scrape(infoHashes [][]byte) (responses []ScrapeResponse, err error) {
+
+	for start := 0; start < len(infoHashes); start += maxScrapeInfoHashes {
+
+		end := start + maxScrapeInfoHashes
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		requestUrl, err := makeHttpScrapeUrl(t.announceUrl, infoHashes[start:end])
+		if err != nil {
+			return nil, errors.Annotate(err, "http tracker scrape")
+		}
+
+		httpRequest, err := http.NewRequest(http.MethodGet, requestUrl, nil)
+		if err != nil {
+			return nil, errors.Annotate(err, "http tracker scrape")
+		}
+
+		httpResponse, err := t.client.Do(httpRequest.WithContext(t.context))
+		if err != nil {
+			return nil, errors.Annotate(err, "http tracker scrape")
+		}
+
+		trackerLogger.WithFields(logrus.Fields{
+			"url":   t.announceUrl,
+			"count": end - start,
+		}).Trace("scrape request sent")
+
+		data, err := ioutil.ReadAll(httpResponse.Body)
+		_ = httpResponse.Body.Close()
+		if err != nil {
+			return nil, errors.Annotate(err, "http tracker scrape")
+		}
+
+		batch, err := parseHttpScrapeResponse(data, infoHashes[start:end])
+		if err != nil {
+			if httpResponse.StatusCode != http.StatusOK {
+				if _, ok := errors.Cause(err).(TrackerError); !ok {
+					err = errors.Errorf("unexpected status %s", httpResponse.Status)
+				}
+			}
+			return nil, errors.Annotate(err, "http tracker scrape")
+		}
+
+		responses = append(responses, batch...)
+	}
+
+	trackerLogger.WithFields(logrus.Fields{
+		"url":   t.announceUrl,
+		"count": len(responses),
+	}).Trace("scrape response received")
+
+	return responses, nil
+}
+
+func makeHttpAnnounceUrl(announceUrl string, peerId, infoHash []byte, trackerId string, request AnnounceRequest) string {
+
+	query := []string{
+		"info_hash=" + escapeBytes(infoHash),
+		"peer_id=" + escapeBytes(peerId),
+		"port=" + strconv.FormatUint(uint64(request.Port), 10),
+		"uploaded=" + strconv.FormatUint(request.Uploaded, 10),
+		"downloaded=" + strconv.FormatUint(request.Downloaded, 10),
+		"left=" + strconv.FormatUint(request.Left, 10),
+		"numwant=" + strconv.FormatUint(uint64(request.PeersCount), 10),
+		"compact=1",
+	}
+
+	switch request.Event {
+	case Started:
+		query = append(query, "event=started")
+	case Completed:
+		query = append(query, "event=completed")
+	case Stopped:
+		query = append(query, "event=stopped")
+	}
+
+	if trackerId != "" {
+		query = append(query, "trackerid="+url.QueryEscape(trackerId))
+	}
+
+	separator := "?"
+	if strings.Contains(announceUrl, "?") {
+		separator = "&"
+	}
+
+	return announceUrl + separator + strings.Join(query, "&")
+}
+
+// scrape url is derived from announce url by replacing "announce"
+// in the beginning of the last path segment with "scrape"
+func makeHttpScrapeUrl(announceUrl string, infoHashes [][]byte) (scrapeUrl string, err error) {
+
+	parsedUrl, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", errors.Annotate(err, "make http scrape url")
+	}
+
+	index := strings.LastIndex(parsedUrl.Path, "/")
+	segment := parsedUrl.Path[index+1:]
+
+	if !strings.HasPrefix(segment, "announce") {
+		return "", errors.Errorf("make http scrape url: tracker %s doesn't support scrape", announceUrl)
+	}
+
+	parsedUrl.Path = parsedUrl.Path[:index+1] + "scrape" + strings.TrimPrefix(segment, "announce")
+
+	query := make([]string, 0, len(infoHashes)+1)
+	if parsedUrl.RawQuery != "" {
+		query = append(query, parsedUrl.RawQuery)
+	}
+
+	for _, infoHash := range infoHashes {
+		query = append(query, "info_hash="+escapeBytes(infoHash))
+	}
+
+	parsedUrl.RawQuery = strings.Join(query, "&")
+
+	return parsedUrl.String(), nil
+}
+
+// escape every byte except unreserved characters (RFC 3986),
+// url.QueryEscape would turn spaces into '+'
+func escapeBytes(data []byte) string {
+
+	var builder strings.Builder
+
+	for _, b := range data {
+		if (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '.' || b == '_' || b == '~' {
+			builder.WriteByte(b)
+		} else {
+			builder.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+
+	return builder.String()
+}
+
+func parseHttpAnnounceResponse(data []byte) (response AnnounceResponse, trackerId, warning string, err error) {
+
+	var bencodedData interface{}
+
+	err = bencode.DecodeBytes(data, &bencodedData)
+	if err != nil {
+		return AnnounceResponse{}, "", "",
+			errors.Annotate(err, "parse http announce response")
+	}
+
+	responseDict, ok := bencodedData.(map[string]interface{})
+	if !ok {
+		return AnnounceResponse{}, "", "",
+			errors.Annotate(errors.New("root element is not dictionary"),
+				"parse http announce response")
+	}
+
+	failureReason, err := getString(responseDict, "failure reason")
+	if err == nil {
+		return AnnounceResponse{}, "", "",
+			errors.Annotate(TrackerError{failureReason}, "parse http announce response")
+	}
+
+	interval, err := getInt(responseDict, "interval")
+	if err != nil {
+		return AnnounceResponse{}, "", "",
+			errors.Annotate(err, "parse http announce response")
+	}
+
+	response.AnnounceInterval = uint32(interval)
+
+	seeders, err := getInt(responseDict, "complete")
+	if err == nil {
+		response.SeedersCount = uint32(seeders)
+	}
+
+	leechers, err := getInt(responseDict, "incomplete")
+	if err == nil {
+		response.LechersCount = uint32(leechers)
+	}
+
+	warning, _ = getString(responseDict, "warning message")
+	trackerId, _ = getString(responseDict, "tracker id")
+
+	switch peers := responseDict["peers"].(type) {
+
+	case string:
+		response.Peers = parseCompactPeers([]byte(peers), net.IPv4len)
+
+	case []interface{}:
+		response.Peers = make([]string, 0, len(peers))
+		for _, peer := range peers {
+			peerDict, ok := peer.(map[string]interface{})
+			if !ok {
+				return AnnounceResponse{}, "", "",
+					errors.Annotate(DecodeError{peer, "peers"},
+						"parse http announce response")
+			}
+
+			ip, err := getString(peerDict, "ip")
+			if err != nil {
+				return AnnounceResponse{}, "", "",
+					errors.Annotate(err, "parse http announce response")
+			}
+
+			port, err := getInt(peerDict, "port")
+			if err != nil {
+				return AnnounceResponse{}, "", "",
+					errors.Annotate(err, "parse http announce response")
+			}
+
+			response.Peers = append(response.Peers,
+				net.JoinHostPort(ip, strconv.FormatInt(port, 10)))
+		}
+
+	case nil:
+		response.Peers = []string{}
+
+	default:
+		return AnnounceResponse{}, "", "",
+			errors.Annotate(DecodeError{peers, "peers"},
+				"parse http announce response")
+	}
+
+	switch peers6 := responseDict["peers6"].(type) {
+
+	case string:
+		response.Peers = append(response.Peers, parseCompactPeers([]byte(peers6), net.IPv6len)...)
+
+	case nil:
+
+	default:
+		return AnnounceResponse{}, "", "",
+			errors.Annotate(DecodeError{peers6, "peers6"},
+				"parse http announce response")
+	}
+
+	return response, trackerId, warning, nil
+}
+
+func parseHttpScrapeResponse(data []byte, infoHashes [][]byte) (responses []ScrapeResponse, err error) {
+
+	var bencodedData interface{}
+
+	err = bencode.DecodeBytes(data, &bencodedData)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse http scrape response")
+	}
+
+	responseDict, ok := bencodedData.(map[string]interface{})
+	if !ok {
+		return nil,
+			errors.Annotate(errors.New("root element is not dictionary"),
+				"parse http scrape response")
+	}
+
+	failureReason, err := getString(responseDict, "failure reason")
+	if err == nil {
+		return nil,
+			errors.Annotate(TrackerError{failureReason}, "parse http scrape response")
+	}
+
+	files, err := getDict(responseDict, "files")
+	if err != nil {
+		return nil, errors.Annotate(err, "parse http scrape response")
+	}
+
+	responses = make([]ScrapeResponse, len(infoHashes))
+
+	for i, infoHash := range infoHashes {
+
+		// tracker omits torrents it doesn't know
+		fileDict, err := getDict(files, string(infoHash))
+		if err != nil {
+			continue
+		}
+
+		seeders, _ := getInt(fileDict, "complete")
+		completed, _ := getInt(fileDict, "downloaded")
+		leechers, _ := getInt(fileDict, "incomplete")
+
+		responses[i] = ScrapeResponse{uint32(seeders), uint32(completed), uint32(leechers)}
+	}
+
+	return responses, nil
+}
@@ -0,0 +1,302 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/zeebo/bencode"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHttpTracker_Announce(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	myPeerId := make([]byte, 20)
+
+	rand.Read(infoHash)
+	rand.Read(myPeerId)
+
+	downloaded := rand.Uint64()
+	uploaded := rand.Uint64()
+	left := rand.Uint64()
+	port := uint16(rand.Int())
+	peersCount := rand.Uint32()
+
+	interval := rand.Int63n(3600)
+	seeders := rand.Int63n(100)
+	leechers := rand.Int63n(100)
+	ips := []uint32{rand.Uint32(), rand.Uint32()}
+	ports := []uint16{uint16(rand.Uint32()), uint16(rand.Uint32())}
+
+	compactPeers := make([]byte, 12)
+	binary.BigEndian.PutUint32(compactPeers[0:4], ips[0])
+	binary.BigEndian.PutUint16(compactPeers[4:6], ports[0])
+	binary.BigEndian.PutUint32(compactPeers[6:10], ips[1])
+	binary.BigEndian.PutUint16(compactPeers[10:12], ports[1])
+
+	requestCount := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		query := r.URL.Query()
+
+		assert.EqualValues(t, "/announce", r.URL.Path, "wrong path")
+		assert.EqualValues(t, "secret", query.Get("passkey"), "passkey is lost")
+		assert.True(t, bytes.Compare(infoHash, []byte(query.Get("info_hash"))) == 0, "wrong info hash")
+		assert.True(t, bytes.Compare(myPeerId, []byte(query.Get("peer_id"))) == 0, "wrong peer id")
+		assert.EqualValues(t, fmt.Sprint(downloaded), query.Get("downloaded"), "wrong downloaded")
+		assert.EqualValues(t, fmt.Sprint(uploaded), query.Get("uploaded"), "wrong uploaded")
+		assert.EqualValues(t, fmt.Sprint(left), query.Get("left"), "wrong left")
+		assert.EqualValues(t, fmt.Sprint(port), query.Get("port"), "wrong port")
+		assert.EqualValues(t, fmt.Sprint(peersCount), query.Get("numwant"), "wrong peer count")
+		assert.EqualValues(t, "1", query.Get("compact"), "compact is not requested")
+
+		response := map[string]interface{}{
+			"interval":   interval,
+			"complete":   seeders,
+			"incomplete": leechers,
+		}
+
+		if requestCount == 0 {
+			assert.EqualValues(t, "started", query.Get("event"), "wrong event")
+			assert.EqualValues(t, "", query.Get("trackerid"), "unexpected tracker id")
+			response["peers"] = string(compactPeers)
+			response["tracker id"] = "tracker-42"
+		} else {
+			assert.EqualValues(t, "", query.Get("event"), "wrong event")
+			assert.EqualValues(t, "tracker-42", query.Get("trackerid"), "tracker id is not sent")
+			response["peers"] = []interface{}{
+				map[string]interface{}{"ip": "198.51.100.7", "port": 6881, "peer id": "-XX0000-000000000000"},
+				map[string]interface{}{"ip": "2001:db8::1", "port": 6882},
+			}
+		}
+
+		requestCount += 1
+
+		data, err := bencode.EncodeBytes(response)
+		assert.NoError(t, err, "can not encode response")
+		_, _ = w.Write(data)
+	}))
+
+	defer server.Close()
+
+	tracker, err := NewHttpTracker(myPeerId, infoHash, server.URL+"/announce?passkey=secret")
+	if err != nil {
+		panic(err)
+	}
+
+	response, err := tracker.announce(AnnounceRequest{
+		Started,
+		downloaded,
+		uploaded,
+		left,
+		port,
+		peersCount})
+	assert.NoError(t, err, "announce failed")
+
+	assert.EqualValues(t, interval, response.AnnounceInterval, "wrong announce interval")
+	assert.EqualValues(t, seeders, response.SeedersCount, "wrong seeder count")
+	assert.EqualValues(t, leechers, response.LechersCount, "wrong leecher count")
+	assert.EqualValues(t, 2, len(response.Peers), "wrong peer count")
+
+	for i := 0; i < 2; i++ {
+		ipBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(ipBytes, ips[i])
+		addrString := fmt.Sprintf("%d.%d.%d.%d:%d",
+			ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3], ports[i])
+		assert.EqualValues(t, addrString, response.Peers[i], "wrong peer address")
+	}
+
+	response, err = tracker.announce(AnnounceRequest{
+		None,
+		downloaded,
+		uploaded,
+		left,
+		port,
+		peersCount})
+	assert.NoError(t, err, "announce failed")
+
+	assert.EqualValues(t, []string{"198.51.100.7:6881", "[2001:db8::1]:6882"}, response.Peers,
+		"wrong peer address")
+
+	tracker.Close()
+
+}
+
+func TestHttpTracker_Announce_FailureReason(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	myPeerId := make([]byte, 20)
+
+	rand.Read(infoHash)
+	rand.Read(myPeerId)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := bencode.EncodeBytes(map[string]interface{}{
+			"failure reason": "torrent is not registered",
+		})
+		assert.NoError(t, err, "can not encode response")
+		_, _ = w.Write(data)
+	}))
+
+	defer server.Close()
+
+	tracker, err := NewHttpTracker(myPeerId, infoHash, server.URL+"/announce")
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = tracker.announce(AnnounceRequest{
+		Started,
+		rand.Uint64(),
+		rand.Uint64(),
+		rand.Uint64(),
+		uint16(rand.Int()),
+		rand.Uint32(),
+	})
+	assert.Error(t, err, "announce finished without error")
+	assert.EqualValues(t, TrackerError{"torrent is not registered"}, errors.Cause(err),
+		"unexpected error")
+
+	tracker.Close()
+}
+
+func TestHttpTracker_Announce_WrongResponse(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	myPeerId := make([]byte, 20)
+
+	rand.Read(infoHash)
+	rand.Read(myPeerId)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("not found"))
+	}))
+
+	defer server.Close()
+
+	tracker, err := NewHttpTracker(myPeerId, infoHash, server.URL+"/announce")
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = tracker.announce(AnnounceRequest{
+		Started,
+		rand.Uint64(),
+		rand.Uint64(),
+		rand.Uint64(),
+		uint16(rand.Int()),
+		rand.Uint32(),
+	})
+	assert.Error(t, err, "announce finished without error")
+
+	tracker.Close()
+}
+
+func TestHttpTracker_New_WrongScheme(t *testing.T) {
+
+	_, err := NewHttpTracker(make([]byte, 20), make([]byte, 20), "udp://198.51.100.5:8000")
+	assert.Error(t, err, "tracker created for udp url")
+
+	_, err = newTrackerClient(make([]byte, 20), make([]byte, 20), "wss://198.51.100.5/announce")
+	assert.Error(t, err, "tracker created for unsupported url")
+
+	tracker, err := newTrackerClient(make([]byte, 20), make([]byte, 20), "http://198.51.100.6/announce")
+	assert.NoError(t, err, "can not create http tracker")
+	assert.IsType(t, &HttpTracker{}, tracker, "unexpected tracker type")
+}
+
+func TestHttpTracker_Scrape(t *testing.T) {
+
+	infoHashes := [][]byte{make([]byte, 20), make([]byte, 20), make([]byte, 20)}
+	for _, infoHash := range infoHashes {
+		rand.Read(infoHash)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		assert.EqualValues(t, "/x/scrape.php", r.URL.Path, "wrong path")
+		assert.EqualValues(t, "secret", r.URL.Query().Get("passkey"), "passkey is lost")
+
+		requested := r.URL.Query()["info_hash"]
+		assert.Len(t, requested, 3, "wrong info hash count")
+
+		files := map[string]interface{}{}
+		for i, infoHash := range requested[:2] {
+			assert.True(t, bytes.Compare(infoHashes[i], []byte(infoHash)) == 0, "wrong info hash")
+			files[infoHash] = map[string]interface{}{
+				"complete":   10 + i,
+				"downloaded": 20 + i,
+				"incomplete": 30 + i,
+			}
+		}
+
+		data, err := bencode.EncodeBytes(map[string]interface{}{"files": files})
+		assert.NoError(t, err, "can not encode response")
+		_, _ = w.Write(data)
+	}))
+
+	defer server.Close()
+
+	responses, err := ScrapeTracker(server.URL+"/x/announce.php?passkey=secret", infoHashes)
+	assert.NoError(t, err, "scrape finished with error")
+
+	assert.EqualValues(t, []ScrapeResponse{{10, 20, 30}, {11, 21, 31}, {0, 0, 0}}, responses,
+		"wrong scrape responses")
+}
+
+func TestHttpTracker_MakeScrapeUrl(t *testing.T) {
+
+	infoHash := []byte("\x01\x02 abc~")
+
+	scrapeUrl, err := makeHttpScrapeUrl("http://198.51.100.6/announce", [][]byte{infoHash})
+	assert.NoError(t, err, "can not make scrape url")
+	assert.EqualValues(t, "http://198.51.100.6/scrape?info_hash=%01%02%20abc~", scrapeUrl,
+		"wrong scrape url")
+
+	scrapeUrl, err = makeHttpScrapeUrl("http://198.51.100.6/x/announce?x=y", [][]byte{infoHash, infoHash})
+	assert.NoError(t, err, "can not make scrape url")
+	assert.EqualValues(t, "http://198.51.100.6/x/scrape?x=y&info_hash=%01%02%20abc~&info_hash=%01%02%20abc~",
+		scrapeUrl, "wrong scrape url")
+
+	_, err = makeHttpScrapeUrl("http://198.51.100.6/a", [][]byte{infoHash})
+	assert.Error(t, err, "scrape url made for tracker without scrape")
+
+	_, err = makeHttpScrapeUrl("http://198.51.100.6/announce/x", [][]byte{infoHash})
+	assert.Error(t, err, "scrape url made for tracker without scrape")
+}
+
+func TestHttpTracker_ParseAnnounceResponse_Peers6(t *testing.T) {
+
+	peers6 := make([]byte, 18)
+	copy(peers6[0:16], net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(peers6[16:18], 6881)
+
+	data, err := bencode.EncodeBytes(map[string]interface{}{
+		"interval": 1800,
+		"peers":    string([]byte{198, 51, 100, 7, 0x1A, 0xE2}),
+		"peers6":   string(peers6),
+	})
+	assert.NoError(t, err, "can not encode response")
+
+	response, _, _, err := parseHttpAnnounceResponse(data)
+	assert.NoError(t, err, "can not parse response")
+	assert.EqualValues(t, []string{"198.51.100.7:6882", "[2001:db8::1]:6881"}, response.Peers,
+		"wrong peers")
+
+	data, err = bencode.EncodeBytes(map[string]interface{}{
+		"interval": 1800,
+		"peers6":   42,
+	})
+	assert.NoError(t, err, "can not encode response")
+
+	_, _, _, err = parseHttpAnnounceResponse(data)
+	assert.Error(t, err, "wrong peers6 parsed without error")
+}
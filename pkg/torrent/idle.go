@@ -0,0 +1,86 @@
+package torrent
+
+import (
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"time"
+)
+
+// DefaultMaxConnections is the maximal number of connected peers of a torrent
+const DefaultMaxConnections = 50
+
+// peers mutually not interested for the timeout are disconnected at the connection limit
+const uninterestedTimeout = 5 * time.Minute
+
+const idleCheckInterval = 30 * time.Second
+
+// SetMaxConnections sets the maximal number of connected peers
+func (m *Manager) SetMaxConnections(count int) {
+	if count < 1 {
+		count = 1
+	}
+	m.maxConnections = count
+}
+
+func (m *Manager) checkConnectionLimit() (err error) {
+
+	m.mapMutex.RLock()
+	defer m.mapMutex.RUnlock()
+
+	if len(m.seedersMap) >= m.maxConnections {
+		return errors.Errorf("check connection limit: %d peers are connected", len(m.seedersMap))
+	}
+
+	return nil
+}
+
+// handleIdleTimer disconnects peers mutually not interested for too long
+// if the connection limit is reached, the peers idle for the longest time are
+// disconnected until there is a free connection slot
+func (m *Manager) handleIdleTimer() {
+
+	seeders := m.getSeederSlice()
+
+	var idle []*Seeder
+
+	for _, seeder := range seeders {
+
+		if seeder.AmInterested || seeder.PeerInterested {
+			seeder.uninterestedSince = time.Time{}
+			continue
+		}
+
+		if seeder.uninterestedSince.IsZero() {
+			seeder.uninterestedSince = time.Now()
+			continue
+		}
+
+		if time.Since(seeder.uninterestedSince) > uninterestedTimeout {
+			idle = append(idle, seeder)
+		}
+	}
+
+	excess := len(seeders) - m.maxConnections + 1
+	if excess <= 0 {
+		return
+	}
+
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].uninterestedSince.Before(idle[j].uninterestedSince)
+	})
+
+	if len(idle) > excess {
+		idle = idle[:excess]
+	}
+
+	for _, seeder := range idle {
+
+		managerLogger.WithFields(logrus.Fields{
+			"peerId":   seeder.PeerId,
+			"infoHash": m.infoHash,
+		}).Debug("idle peer disconnected")
+
+		m.handleClosing(seeder)
+	}
+}
@@ -3,15 +3,17 @@ package torrent
 import (
 	"fmt"
 	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
 	"net"
 	"sync"
 )
 
 type Listener struct {
 	Port        int
+	IPv6        bool
 	Connections chan net.Conn
 
-	listener net.Listener
+	listeners []net.Listener
 
 	wait sync.WaitGroup
 }
@@ -21,9 +23,10 @@ func NewListener(portRangeStart, portRangeEnd int) (listener *Listener, err erro
 	listener = new(Listener)
 
 	for port := portRangeStart; port < portRangeEnd; port++ {
-		listener.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+		listener.listeners, err = listenDualStack(port)
 		if err == nil {
 			listener.Port = port
+			listener.IPv6 = len(listener.listeners) > 1
 			break
 		}
 	}
@@ -38,25 +41,78 @@ func NewListener(portRangeStart, portRangeEnd int) (listener *Listener, err erro
 	return listener, nil
 }
 
+// listenDualStack listens on the port with separate IPv4 and IPv6 sockets,
+// the listener is IPv4 only if IPv6 is not available on the host
+func listenDualStack(port int) (listeners []net.Listener, err error) {
+
+	ipv4Listener, err := net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		return nil, errors.Annotate(err, "listen dual stack")
+	}
+
+	listeners = append(listeners, ipv4Listener)
+
+	ipv6Listener, err := net.Listen("tcp6", fmt.Sprintf("[::]:%d", port))
+	if err != nil {
+		if isIPv6Available() {
+			_ = ipv4Listener.Close()
+			return nil, errors.Annotate(err, "listen dual stack")
+		}
+
+		managerLogger.WithFields(logrus.Fields{
+			"port": port,
+		}).Warn("ipv6 is not available, listening on ipv4 only")
+
+		return listeners, nil
+	}
+
+	listeners = append(listeners, ipv6Listener)
+
+	return listeners, nil
+}
+
+func isIPv6Available() bool {
+
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+
+	_ = listener.Close()
+
+	return true
+}
+
 func (l *Listener) Start() (err error) {
 
 	l.wait.Add(1)
 	defer l.wait.Done()
 
-	for {
+	errorChannel := make(chan error, len(l.listeners))
 
-		conn, err := l.listener.Accept()
-		if err != nil {
-			return err
-		}
+	for _, listener := range l.listeners {
+		go func(listener net.Listener) {
+			for {
 
-		l.Connections <- conn
+				conn, err := listener.Accept()
+				if err != nil {
+					errorChannel <- err
+					return
+				}
 
+				l.Connections <- conn
+
+			}
+		}(listener)
 	}
+
+	return <-errorChannel
 }
 
 func (l *Listener) Close() {
 
-	_ = l.listener.Close()
+	for _, listener := range l.listeners {
+		_ = listener.Close()
+	}
 	l.wait.Wait()
 }
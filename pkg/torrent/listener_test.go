@@ -1,7 +1,9 @@
 package torrent
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"net"
 	"sync"
 	"testing"
 )
@@ -36,3 +38,39 @@ func TestListener_New(t *testing.T) {
 
 	wait.Wait()
 }
+
+func TestListener_DualStack(t *testing.T) {
+
+	listener, err := NewListener(8090, 8099)
+	assert.NoError(t, err, "can not create listener")
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+
+	go func() {
+		defer wait.Done()
+		err := listener.Start()
+		assert.Error(t, err, "err")
+	}()
+
+	addresses := []string{fmt.Sprintf("127.0.0.1:%d", listener.Port)}
+	if listener.IPv6 {
+		addresses = append(addresses, fmt.Sprintf("[::1]:%d", listener.Port))
+	}
+
+	for _, address := range addresses {
+
+		conn, err := net.Dial("tcp", address)
+		assert.NoError(t, err, "can not connect to listener")
+
+		accepted := <-listener.Connections
+		assert.EqualValues(t, conn.LocalAddr().String(), accepted.RemoteAddr().String(),
+			"wrong accepted connection")
+
+		_ = conn.Close()
+		_ = accepted.Close()
+	}
+
+	listener.Close()
+	wait.Wait()
+}
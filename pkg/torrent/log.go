@@ -1,6 +1,8 @@
 package torrent
 
 import (
+	"github.com/lezhenin/gotorrentclient/pkg/dht"
+	"github.com/lezhenin/gotorrentclient/pkg/lsd"
 	"github.com/sirupsen/logrus"
 	"io"
 )
@@ -11,7 +13,9 @@ const (
 	SeederLogger  LoggerType = 0
 	TrackerLogger LoggerType = 1
 	ManagerLogger LoggerType = 2
-	AllLoggers    LoggerType = 3
+	DHTLogger     LoggerType = 3
+	LSDLogger     LoggerType = 4
+	AllLoggers    LoggerType = 5
 )
 
 type LoggerLevel logrus.Level
@@ -39,6 +43,8 @@ func init() {
 	loggers[SeederLogger] = seederLogger
 	loggers[TrackerLogger] = trackerLogger
 	loggers[ManagerLogger] = managerLogger
+	loggers[DHTLogger] = dht.Logger()
+	loggers[LSDLogger] = lsd.Logger()
 
 	//file, err := os.Create("seeder.log")
 	//if err == nil {
@@ -0,0 +1,203 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"github.com/juju/errors"
+	"github.com/lezhenin/gotorrentclient/pkg/dht"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/bencode"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Magnet struct {
+	InfoHash    []byte
+	DisplayName string
+	Trackers    []string
+	Peers       []string
+}
+
+func ParseMagnet(uri string) (magnet *Magnet, err error) {
+
+	parsedUri, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse magnet")
+	}
+
+	if parsedUri.Scheme != "magnet" {
+		return nil, errors.Errorf("parse magnet: unexpected scheme %s", parsedUri.Scheme)
+	}
+
+	query, err := url.ParseQuery(parsedUri.RawQuery)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse magnet")
+	}
+
+	magnet = new(Magnet)
+
+	for _, topic := range query["xt"] {
+
+		if !strings.HasPrefix(topic, "urn:btih:") {
+			continue
+		}
+
+		magnet.InfoHash, err = decodeMagnetInfoHash(strings.TrimPrefix(topic, "urn:btih:"))
+		if err != nil {
+			return nil, errors.Annotate(err, "parse magnet")
+		}
+	}
+
+	if magnet.InfoHash == nil {
+		return nil, errors.Errorf("parse magnet: there is no btih exact topic")
+	}
+
+	magnet.DisplayName = query.Get("dn")
+	magnet.Trackers = query["tr"]
+	magnet.Peers = query["x.pe"]
+
+	return magnet, nil
+}
+
+// decodeMagnetInfoHash decodes info hash encoded in hex (40 chars) or base32 (32 chars)
+func decodeMagnetInfoHash(encoded string) (infoHash []byte, err error) {
+
+	switch len(encoded) {
+
+	case 40:
+		infoHash, err = hex.DecodeString(encoded)
+
+	case 32:
+		infoHash, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+
+	default:
+		return nil, errors.Errorf("decode magnet info hash: unexpected length %d", len(encoded))
+	}
+
+	if err != nil {
+		return nil, errors.Annotate(err, "decode magnet info hash")
+	}
+
+	return infoHash, nil
+}
+
+// NewMetadataFromMagnet finds peers with trackers of the magnet and with
+// the DHT node, if it is not nil, and fetches info dictionary from them (BEP 9)
+func NewMetadataFromMagnet(magnet *Magnet, node *dht.DHT) (metadata *Metadata, err error) {
+
+	peerId := make([]byte, 20)
+	_, err = rand.Read(peerId)
+	if err != nil {
+		return nil, errors.Annotate(err, "new metadata from magnet")
+	}
+
+	peers := append([]string{}, magnet.Peers...)
+
+	if len(magnet.Trackers) > 0 {
+
+		trackers, err := NewTrackerList(peerId, magnet.InfoHash, "", magnetAnnounceList(magnet))
+		if err != nil {
+			return nil, errors.Annotate(err, "new metadata from magnet")
+		}
+
+		// port is held while announcing, the download listens on the same port later
+		listener, err := NewListener(listenPortRangeStart, listenPortRangeEnd)
+		if err != nil {
+			return nil, errors.Annotate(err, "new metadata from magnet")
+		}
+
+		go func() {
+			_ = trackers.Run()
+		}()
+
+		trackers.announceRequestChannel <- AnnounceRequest{
+			None,
+			0,
+			0,
+			unknownLeft,
+			uint16(listener.Port),
+			maxMetadataPeers,
+		}
+
+		select {
+		case result := <-trackers.announceResponseChannel:
+			peers = append(peers, result.response.Peers...)
+		case <-time.After(metadataExchangeTimeout * time.Second):
+		}
+
+		trackers.Close()
+		listener.Close()
+	}
+
+	if node != nil {
+		dhtPeers, err := node.GetPeers(magnet.InfoHash)
+		if err != nil {
+			managerLogger.WithFields(logrus.Fields{
+				"infoHash": magnet.InfoHash,
+			}).Warn(errors.Annotate(err, "new metadata from magnet"))
+		} else {
+			peers = append(peers, dhtPeers...)
+		}
+	}
+
+	if len(peers) == 0 {
+		return nil, errors.Errorf("new metadata from magnet: there are no peers")
+	}
+
+	infoBytes, err := fetchMetadataFromPeers(peers, magnet.InfoHash, peerId)
+	if err != nil {
+		return nil, errors.Annotate(err, "new metadata from magnet")
+	}
+
+	var infoDict interface{}
+
+	err = bencode.DecodeBytes(infoBytes, &infoDict)
+	if err != nil {
+		return nil, errors.Annotate(err, "new metadata from magnet")
+	}
+
+	dict, ok := infoDict.(map[string]interface{})
+	if !ok {
+		return nil,
+			errors.Annotate(errors.New("info is not dictionary"),
+				"new metadata from magnet")
+	}
+
+	metadata = new(Metadata)
+
+	metadata.Info, err = infoDictToStruct(dict)
+	if err != nil {
+		return nil, errors.Annotate(err, "new metadata from magnet")
+	}
+
+	// hash of received bytes is already verified
+	metadata.Info.HashSHA1 = magnet.InfoHash
+	metadata.Info.Bytes = infoBytes
+
+	if len(magnet.Trackers) > 0 {
+		metadata.Announce = magnet.Trackers[0]
+		metadata.AnnounceList = magnetAnnounceList(magnet)
+	}
+
+	metadata.Peers = magnet.Peers
+
+	managerLogger.WithFields(logrus.Fields{
+		"infoHash":    magnet.InfoHash,
+		"filesCount":  len(metadata.Info.Files),
+		"pieceCount":  metadata.Info.PieceCount,
+		"totalLength": metadata.Info.TotalLength,
+	}).Info("info dictionary decoded")
+
+	return metadata, nil
+}
+
+func magnetAnnounceList(magnet *Magnet) (announceList [][]string) {
+
+	for _, tracker := range magnet.Trackers {
+		announceList = append(announceList, []string{tracker})
+	}
+
+	return announceList
+}
@@ -0,0 +1,274 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/lezhenin/gotorrentclient/pkg/dht"
+	"github.com/stretchr/testify/assert"
+	"github.com/zeebo/bencode"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func makeTestInfoBytes(pieceCount int) []byte {
+
+	pieces := make([]byte, 20*pieceCount)
+	rand.Read(pieces)
+
+	data, err := bencode.EncodeBytes(map[string]interface{}{
+		"name":         "test_data",
+		"piece length": 32 * 1024,
+		"length":       32 * 1024 * pieceCount,
+		"pieces":       string(pieces),
+	})
+
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+func writeTestMessage(conn net.Conn, id MessageId, payload []byte) error {
+
+	message := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(message[0:4], uint32(1+len(payload)))
+	message[4] = byte(id)
+	copy(message[5:], payload)
+
+	_, err := conn.Write(message)
+	return err
+}
+
+// serveTestMetadata acts as a peer which sends metadata with ut_metadata id 3
+func serveTestMetadata(t *testing.T, conn net.Conn, infoHash, infoBytes []byte) {
+
+	defer conn.Close()
+
+	handshake := make([]byte, 68)
+	_, err := io.ReadFull(conn, handshake)
+	assert.NoError(t, err, "can not read handshake")
+	assert.True(t, handshake[25]&extensionProtocolBit != 0, "extension protocol bit is not set")
+
+	rand.Read(handshake[48:68])
+	copy(handshake[28:48], infoHash)
+
+	_, err = conn.Write(handshake)
+	assert.NoError(t, err, "can not write handshake")
+
+	for {
+
+		lengthBuffer := make([]byte, 4)
+		_, err := io.ReadFull(conn, lengthBuffer)
+		if err != nil {
+			return
+		}
+
+		message := make([]byte, binary.BigEndian.Uint32(lengthBuffer))
+		_, err = io.ReadFull(conn, message)
+		if err != nil {
+			return
+		}
+
+		if MessageId(message[0]) != Extended {
+			continue
+		}
+
+		switch message[1] {
+
+		case extendedHandshakeId:
+
+			data, err := bencode.EncodeBytes(map[string]interface{}{
+				"m":             map[string]interface{}{"ut_metadata": 3},
+				"metadata_size": len(infoBytes),
+			})
+			assert.NoError(t, err, "can not encode handshake")
+
+			err = writeTestMessage(conn, Extended, append([]byte{extendedHandshakeId}, data...))
+			assert.NoError(t, err, "can not write extended handshake")
+
+		case 3:
+
+			messageType, piece, _, _, err := parseMetadataPayload(message[2:])
+			assert.NoError(t, err, "can not parse metadata request")
+			assert.EqualValues(t, metadataRequest, messageType, "wrong message type")
+
+			end := (piece + 1) * metadataPieceLength
+			if end > int64(len(infoBytes)) {
+				end = int64(len(infoBytes))
+			}
+
+			// ut_metadata is the only extension of the fetcher
+			payload := append([]byte{1}, makeMetadataPayload(metadataData, piece, int64(len(infoBytes)),
+				infoBytes[piece*metadataPieceLength:end])...)
+
+			err = writeTestMessage(conn, Extended, payload)
+			assert.NoError(t, err, "can not write metadata piece")
+		}
+	}
+}
+
+func TestMagnet_Parse(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	rand.Read(infoHash)
+
+	uri := "magnet:?xt=urn:btih:" + hex.EncodeToString(infoHash) +
+		"&dn=" + url.QueryEscape("test data") +
+		"&tr=" + url.QueryEscape("udp://198.51.100.5:8000") +
+		"&tr=" + url.QueryEscape("http://198.51.100.6/announce") +
+		"&x.pe=198.51.100.7:6881&x.pe=[2001:db8::1]:6881"
+
+	magnet, err := ParseMagnet(uri)
+	assert.NoError(t, err, "can not parse magnet")
+
+	assert.EqualValues(t, infoHash, magnet.InfoHash, "wrong info hash")
+	assert.EqualValues(t, "test data", magnet.DisplayName, "wrong display name")
+	assert.EqualValues(t, []string{"udp://198.51.100.5:8000", "http://198.51.100.6/announce"},
+		magnet.Trackers, "wrong trackers")
+	assert.EqualValues(t, []string{"198.51.100.7:6881", "[2001:db8::1]:6881"}, magnet.Peers, "wrong peers")
+
+	magnet, err = ParseMagnet("magnet:?xt=urn:btih:" + base32.StdEncoding.EncodeToString(infoHash))
+	assert.NoError(t, err, "can not parse magnet with base32 info hash")
+	assert.EqualValues(t, infoHash, magnet.InfoHash, "wrong info hash")
+
+	_, err = ParseMagnet("http://198.51.100.6/?xt=urn:btih:" + hex.EncodeToString(infoHash))
+	assert.Error(t, err, "magnet parsed with wrong scheme")
+
+	_, err = ParseMagnet("magnet:?dn=test")
+	assert.Error(t, err, "magnet parsed without info hash")
+
+	_, err = ParseMagnet("magnet:?xt=urn:btih:abcdef")
+	assert.Error(t, err, "magnet parsed with wrong info hash")
+}
+
+func TestMagnet_NewMetadata(t *testing.T) {
+
+	// two metadata pieces
+	infoBytes := makeTestInfoBytes(1000)
+	hash := sha1.Sum(infoBytes)
+	infoHash := hash[:]
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err, "can not listen")
+
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestMetadata(t, conn, infoHash, infoBytes)
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// size is unknown and the port is the listen port of the download
+		assert.EqualValues(t, fmt.Sprint(unknownLeft), r.URL.Query().Get("left"), "wrong left")
+		assert.EqualValues(t, fmt.Sprint(listenPortRangeStart), r.URL.Query().Get("port"), "wrong port")
+
+		data, err := bencode.EncodeBytes(map[string]interface{}{
+			"interval": 1800,
+			"peers":    string([]byte{127, 0, 0, 1, byte(port >> 8), byte(port)}),
+		})
+		assert.NoError(t, err, "can not encode response")
+		_, _ = w.Write(data)
+	}))
+
+	defer server.Close()
+
+	magnet, err := ParseMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%x&tr=%s", infoHash,
+		url.QueryEscape(server.URL+"/announce")))
+	assert.NoError(t, err, "can not parse magnet")
+
+	metadata, err := NewMetadataFromMagnet(magnet, nil)
+	assert.NoError(t, err, "can not fetch metadata")
+
+	assert.EqualValues(t, infoHash, metadata.Info.HashSHA1, "wrong info hash")
+	assert.EqualValues(t, 1000, metadata.Info.PieceCount, "wrong piece count")
+	assert.EqualValues(t, 32*1024*1000, metadata.Info.TotalLength, "wrong total length")
+	assert.EqualValues(t, server.URL+"/announce", metadata.Announce, "wrong announce")
+
+	// peer from magnet link is used without trackers
+	magnet.Trackers = nil
+	magnet.Peers = []string{listener.Addr().String()}
+
+	metadata, err = NewMetadataFromMagnet(magnet, nil)
+	assert.NoError(t, err, "can not fetch metadata")
+	assert.EqualValues(t, magnet.Peers, metadata.Peers, "wrong peers")
+}
+
+func TestMagnet_NewMetadata_DHT(t *testing.T) {
+
+	infoBytes := makeTestInfoBytes(10)
+	hash := sha1.Sum(infoBytes)
+	infoHash := hash[:]
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err, "can not listen")
+
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestMetadata(t, conn, infoHash, infoBytes)
+		}
+	}()
+
+	var nodes []*dht.DHT
+	for i := 0; i < 2; i++ {
+		node, err := dht.NewDHT("127.0.0.1:0")
+		assert.NoError(t, err, "can not create dht node")
+		go func() {
+			_ = node.Start()
+		}()
+		defer node.Close()
+		nodes = append(nodes, node)
+	}
+
+	err = nodes[1].Bootstrap([]string{nodes[0].Address()})
+	assert.NoError(t, err, "bootstrap finished with error")
+
+	_, err = nodes[1].AnnouncePeer(infoHash, uint16(listener.Addr().(*net.TCPAddr).Port))
+	assert.NoError(t, err, "announce finished with error")
+
+	// magnet has neither trackers nor peers, the peer is found with dht
+	magnet, err := ParseMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%x", infoHash))
+	assert.NoError(t, err, "can not parse magnet")
+
+	metadata, err := NewMetadataFromMagnet(magnet, nodes[1])
+	assert.NoError(t, err, "can not fetch metadata")
+	assert.EqualValues(t, infoHash, metadata.Info.HashSHA1, "wrong info hash")
+}
+
+func TestMagnet_FetchMetadata_WrongHash(t *testing.T) {
+
+	infoBytes := makeTestInfoBytes(10)
+
+	infoHash := make([]byte, 20)
+	rand.Read(infoHash)
+
+	interiorConn, exteriorConn := net.Pipe()
+
+	go serveTestMetadata(t, exteriorConn, infoHash, infoBytes)
+
+	_, err := fetchMetadata(interiorConn, infoHash, make([]byte, 20))
+	assert.Error(t, err, "metadata with wrong hash is accepted")
+}
@@ -3,17 +3,24 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"github.com/juju/errors"
 	"github.com/lezhenin/gotorrentclient/pkg/bitfield"
+	"github.com/lezhenin/gotorrentclient/pkg/ratelimit"
 	"github.com/sirupsen/logrus"
-	"log"
+	"math/rand"
 	"net"
 	"sync"
+	"time"
 )
 
+// size of allowed fast set sent to peers (BEP 6)
+const allowedFastCount = 10
+
 type Manager struct {
 	info    *Info
 	state   *State
-	storage *Storage
+	storage TorrentStorage
+	cache   *blockCache
 
 	peerId   []byte
 	infoHash []byte
@@ -21,14 +28,52 @@ type Manager struct {
 	seedersMap map[string]*Seeder
 	mapMutex   sync.RWMutex
 
+	extensions *ExtensionRegistry
+	pex        *pexExtension
+
 	pieceDownloadProgress []uint8
 
+	// number of connected peers having each piece
+	pieceAvailability []int
+	availabilityMutex sync.RWMutex
+
 	downloadedPieceBitfield *bitfield.Bitfield
 	downloadedBlockBitfield *bitfield.Bitfield
 
 	downloadingBlockBitfield *bitfield.Bitfield
 
-	lastRequestedBlock map[string]uint64
+	// priorities of the files are set by the user, priorities of the pieces
+	// are updated from them in the manager routine
+	filePriorities  []Priority
+	priorityMutex   sync.RWMutex
+	piecePriorities []Priority
+
+	wantedPieceBitfield *bitfield.Bitfield
+
+	// completion of wanted pieces is signalled
+	done bool
+
+	maxRequestQueueDepth int
+
+	// peers sent the blocks of not verified pieces and hashes of the blocks of failed pieces
+	blockPeers   map[int64]string
+	failedBlocks map[int64][]blockRecord
+
+	banned      map[string]bool
+	bannedMutex sync.Mutex
+
+	uploadLimiter   *ratelimit.Limiter
+	downloadLimiter *ratelimit.Limiter
+
+	maxConnections int
+
+	// resume data is saved to the file, empty if saving is disabled
+	resumePath string
+
+	uploadSlots      int
+	snubInterval     time.Duration
+	rechokeCount     int
+	optimisticSeeder *Seeder
 
 	lastPieceLength int64
 	lastBlockLength int64
@@ -45,30 +90,65 @@ type Manager struct {
 	closedSeeders    chan *Seeder
 	addedSeeders     chan *Seeder
 
-	stopSignals chan struct{}
-	Done        chan struct{}
+	// blocks read for upload, reading routines are stopped with quit
+	uploadedBlocks chan uploadedBlock
+	quit           chan struct{}
+
+	stopSignals     chan struct{}
+	prioritySignals chan struct{}
+	Done            chan struct{}
+
+	// Errors receives the storage errors, the download is stopped on them
+	Errors chan error
+
+	// Peers receives addresses from peer exchange
+	Peers chan []string
 
 	wait sync.WaitGroup
 }
 
-func NewManager(peerId, infoHash []byte, info *Info, state *State, storage *Storage) (m *Manager) {
+func NewManager(peerId, infoHash []byte, info *Info, state *State, storage TorrentStorage) (m *Manager) {
 
 	m = new(Manager)
 
 	m.state = state
 	m.storage = storage
+	m.cache = globalBlockCache
 
 	m.infoHash = infoHash
 	m.peerId = peerId
 	m.info = info
 
 	m.seedersMap = make(map[string]*Seeder)
+
+	m.extensions = NewExtensionRegistry()
+	if len(info.Bytes) > 0 {
+		m.extensions.Register(newMetadataExtension(infoHash, info.Bytes))
+	}
+
+	// peer exchange is disabled for private torrents (BEP 27)
+	m.pex = newPexExtension()
+	if !info.Private {
+		m.extensions.Register(m.pex)
+	}
+	m.Peers = m.pex.peers
+
 	m.receivedMessages = make(chan Message, 32)
 
 	m.blocksPerPiece = uint8(info.PieceLength / int64(blockLength))
 	m.pieceCount = info.PieceCount
 
-	m.lastRequestedBlock = make(map[string]uint64)
+	m.maxRequestQueueDepth = DefaultRequestQueueDepth
+	m.uploadSlots = DefaultUploadSlots
+	m.maxConnections = DefaultMaxConnections
+
+	m.uploadLimiter = ratelimit.NewLimiter(0)
+	m.downloadLimiter = ratelimit.NewLimiter(0)
+
+	m.blockPeers = make(map[int64]string)
+	m.failedBlocks = make(map[int64][]blockRecord)
+	m.banned = make(map[string]bool)
+	m.snubInterval = DefaultSnubInterval
 
 	m.lastPieceLength = info.TotalLength % info.PieceLength
 	if m.lastPieceLength == 0 {
@@ -100,23 +180,53 @@ func NewManager(peerId, infoHash []byte, info *Info, state *State, storage *Stor
 
 	m.pieceDownloadProgress[m.pieceCount-1] = m.blocksPerLastPiece
 
+	m.pieceAvailability = make([]int, m.pieceCount)
+
+	m.filePriorities = make([]Priority, len(info.Files))
+	for index := range m.filePriorities {
+		m.filePriorities[index] = PriorityNormal
+	}
+
+	m.piecePriorities = make([]Priority, m.pieceCount)
+	m.updatePriorities()
+
 	m.Done = make(chan struct{}, 1)
+	m.Errors = make(chan error, 1)
 	m.stopSignals = make(chan struct{}, 1)
+	m.prioritySignals = make(chan struct{}, 1)
 
 	m.closedSeeders = make(chan *Seeder, 4)
 	m.addedSeeders = make(chan *Seeder, 4)
 
+	m.uploadedBlocks = make(chan uploadedBlock, 16)
+	m.quit = make(chan struct{})
+
 	return m
 }
 
 func (m *Manager) AddSeeder(conn net.Conn, accept bool) (err error) {
 
+	err = m.checkBanned(conn)
+	if err == nil {
+		err = m.checkConnectionLimit()
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
 	seeder, err := NewSeeder(m.infoHash, m.peerId, m.receivedMessages)
 	if err != nil {
 		return err
 	}
 
 	seeder.PeerBitfield = bitfield.NewBitfield(uint(m.info.PieceCount))
+	seeder.EnableExtensions(m.extensions)
+	seeder.EnableFast()
+	seeder.SetRateLimiters(
+		[]*ratelimit.Limiter{globalDownloadLimiter, m.downloadLimiter},
+		[]*ratelimit.Limiter{globalUploadLimiter, m.uploadLimiter})
 
 	if accept {
 		err = seeder.Accept(conn)
@@ -133,19 +243,36 @@ func (m *Manager) AddSeeder(conn net.Conn, accept bool) (err error) {
 		return nil
 	}
 
+	// the same peer can be connected over both ipv4 and ipv6
 	for _, connectedSeeder := range m.getSeederSlice() {
 		if bytes.Compare(seeder.PeerId, connectedSeeder.PeerId) == 0 {
+			managerLogger.WithFields(logrus.Fields{
+				"peerId":    seeder.PeerId,
+				"address":   seeder.Address,
+				"connected": connectedSeeder.Address,
+			}).Debug("peer is already connected")
 			seeder.Close()
 			return nil
 		}
 	}
 
+	m.pex.addSeeder(seeder, !accept)
 	m.addedSeeders <- seeder
 
 	return nil
 
 }
 
+// SetListenPort sets the port advertised to peers in the extended handshake
+func (m *Manager) SetListenPort(port uint16) {
+	m.pex.setListenPort(port)
+}
+
+// RegisterExtension adds extension for seeders connected after the call
+func (m *Manager) RegisterExtension(extension Extension) {
+	m.extensions.Register(extension)
+}
+
 func (m *Manager) Start() {
 
 	managerLogger.WithFields(logrus.Fields{
@@ -166,12 +293,38 @@ func (m *Manager) Start() {
 		"totalLength":       m.info.TotalLength,
 	}).Debug("download params")
 
+	select {
+	case <-m.quit:
+		m.quit = make(chan struct{})
+	default:
+	}
+
+	m.updatePriorities()
+
+	// download restored from the files is completed already
+	m.checkCompleted()
+
 	m.wait.Add(1)
 
 	go func() {
 
 		defer m.wait.Done()
 
+		pexTicker := time.NewTicker(pexInterval)
+		defer pexTicker.Stop()
+
+		rateTicker := time.NewTicker(rateInterval)
+		defer rateTicker.Stop()
+
+		rechokeTicker := time.NewTicker(rechokeInterval)
+		defer rechokeTicker.Stop()
+
+		idleTicker := time.NewTicker(idleCheckInterval)
+		defer idleTicker.Stop()
+
+		resumeTicker := time.NewTicker(resumeInterval)
+		defer resumeTicker.Stop()
+
 		for {
 
 			select {
@@ -185,6 +338,28 @@ func (m *Manager) Start() {
 			case message := <-m.receivedMessages:
 				m.handleMessage(&message)
 
+			case block := <-m.uploadedBlocks:
+				m.handleUploadedBlock(block)
+
+			case <-pexTicker.C:
+				m.handlePexTimer()
+
+			case <-rateTicker.C:
+				m.handleRateTimer()
+				m.handleSnubTimer()
+
+			case <-rechokeTicker.C:
+				m.handleRechokeTimer()
+
+			case <-idleTicker.C:
+				m.handleIdleTimer()
+
+			case <-resumeTicker.C:
+				m.handleResumeTimer()
+
+			case <-m.prioritySignals:
+				m.handlePriorityChange()
+
 			case <-m.stopSignals:
 				m.handleStopSignal()
 				return
@@ -214,19 +389,49 @@ func (m *Manager) handleStopSignal() {
 
 	for _, seeder := range m.getSeederSlice() {
 		seeder.Close()
+		m.releaseRequests(seeder)
+		m.setPeerBitfield(seeder, nil)
 		m.deleteSeeder(seeder.PeerId)
+		m.pex.removeSeeder(seeder)
 	}
 
+	m.optimisticSeeder = nil
+
+	close(m.quit)
+
 	m.downloadingBlockBitfield =
 		bitfield.And(m.downloadingBlockBitfield, m.downloadedBlockBitfield)
 
+	err := m.flushStorage()
+	if err != nil {
+		managerLogger.WithFields(logrus.Fields{
+			"infoHash": m.infoHash,
+		}).Error(errors.Annotate(err, "handle stop signal"))
+	}
+
+	// stopped download keeps only the blocks which are not written in the shared cache
+	m.cache.releaseClean(m)
+
+	m.handleResumeTimer()
+
 }
 
 func (m *Manager) handleAdding(seeder *Seeder) {
 
+	seeder.connected = time.Now()
 	m.addSeeder(seeder)
 
-	if m.state.Downloaded() > 0 {
+	downloadedPieceCount := m.downloadedPieceBitfield.Count(1)
+
+	switch {
+
+	case seeder.SupportsFast() && downloadedPieceCount == uint(m.pieceCount):
+		seeder.outcoming <- Message{HaveAll, nil, m.peerId}
+
+	case seeder.SupportsFast() && downloadedPieceCount == 0:
+		seeder.outcoming <- Message{HaveNone, nil, m.peerId}
+
+	case downloadedPieceCount > 0:
 		seeder.outcoming <- Message{Bitfield, m.state.BitfieldBytes(), m.peerId}
 		managerLogger.WithFields(logrus.Fields{
 			"peerId":   seeder.PeerId,
@@ -236,6 +441,10 @@ func (m *Manager) handleAdding(seeder *Seeder) {
 
 	}
 
+	if seeder.SupportsFast() {
+		m.sendAllowedFast(seeder)
+	}
+
 	go func() {
 		seeder.Start()
 		m.closedSeeders <- seeder
@@ -257,24 +466,41 @@ func (m *Manager) handleClosing(seeder *Seeder) {
 	seeder.Close()
 
 	m.deleteSeeder(seeder.PeerId)
+	m.pex.removeSeeder(seeder)
+
+	m.setPeerBitfield(seeder, nil)
+
+	if m.optimisticSeeder == seeder {
+		m.optimisticSeeder = nil
+	}
 
-	blockIndex, ok := m.lastRequestedBlock[string(seeder.PeerId)]
+	m.releaseRequests(seeder)
+	m.redistributeRequests(seeder)
+}
+
+func (m *Manager) handlePexTimer() {
 
-	if !ok || m.downloadedBlockBitfield.Get(uint(blockIndex)) == 1 {
+	if m.info.Private {
 		return
 	}
 
-	m.downloadingBlockBitfield.Clear(uint(blockIndex))
+	seeders := m.getSeederSlice()
+
+	seeds := make(map[*Seeder]bool)
+	for _, seeder := range seeders {
+		seeds[seeder] = seeder.PeerBitfield.Count(1) == uint(m.pieceCount)
+	}
 
-	pieceIndex, _ := m.convertGlobalBlockToPieceIndex(int64(blockIndex))
+	for seeder, payload := range m.pex.makeMessages(seeders, seeds) {
 
-	for _, anotherSeeder := range m.getSeederSlice() {
-		if anotherSeeder.AmInterested == false && anotherSeeder.PeerBitfield.Get(uint(pieceIndex)) == 1 {
-			anotherSeeder.outcoming <- Message{Interested, nil, m.peerId}
-			m.interestingPeerCount += 1
+		err := seeder.SendExtended(utPexName, payload)
+		if err != nil {
+			managerLogger.WithFields(logrus.Fields{
+				"peerId":   seeder.PeerId,
+				"infoHash": m.infoHash,
+			}).Debug(err.Error())
 		}
 	}
-
 }
 
 func (m *Manager) handleMessage(message *Message) {
@@ -309,22 +535,62 @@ func (m *Manager) handleMessage(message *Message) {
 	case Request:
 		m.handleRequestMessage(seeder, message.Payload)
 
+	case Cancel:
+		m.handleCancelMessage(seeder, message.Payload)
+
 	case Piece:
 		m.handlePieceMessage(seeder, message.Payload)
 
+	case HaveAll:
+		m.handleHaveAllMessage(seeder)
+
+	case HaveNone:
+		m.handleHaveNoneMessage(seeder)
+
+	case SuggestPiece:
+		m.handleSuggestPieceMessage(seeder, message.Payload)
+
+	case RejectRequest:
+		m.handleRejectRequestMessage(seeder, message.Payload)
+
+	case AllowedFast:
+		m.handleAllowedFastMessage(seeder, message.Payload)
+
+	}
+}
+
+// sendAllowedFast sends the pieces of allowed fast set of the peer
+// which are already downloaded, the peer can request them while choked
+func (m *Manager) sendAllowedFast(seeder *Seeder) {
+
+	host, _, err := net.SplitHostPort(seeder.Address)
+	if err != nil {
+		return
+	}
+
+	pieces := makeAllowedFastSet(net.ParseIP(host), m.infoHash, uint32(m.pieceCount), allowedFastCount)
+
+	for _, pieceIndex := range pieces {
+
+		seeder.AllowedFast[pieceIndex] = true
+
+		if m.downloadedPieceBitfield.Get(uint(pieceIndex)) == 1 {
+			seeder.outcoming <- Message{AllowedFast, MakeHavePayload(pieceIndex), m.peerId}
+		}
 	}
 }
 
 func (m *Manager) handleBitfiedMessage(seeder *Seeder, payload []byte) {
 
-	seeder.PeerBitfield, _ = bitfield.NewBitfieldFromBytes(payload, uint(m.pieceCount))
-	interestedPieceCount := bitfield.AndNot(seeder.PeerBitfield, m.downloadedPieceBitfield).Count(1)
-	if interestedPieceCount > 0 && seeder.AmInterested == false {
-		seeder.AmInterested = true
-		seeder.outcoming <- Message{Interested, nil, m.peerId}
-		m.interestingPeerCount += 1
+	peerBitfield, err := bitfield.NewBitfieldFromBytes(payload, uint(m.pieceCount))
+	if err != nil {
+		seeder.Close()
+		return
 	}
 
+	m.setPeerBitfield(seeder, peerBitfield)
+	m.updateInterest(seeder)
+
 	managerLogger.WithFields(logrus.Fields{
 		"peerId":   seeder.PeerId,
 		"data":     payload,
@@ -334,6 +600,101 @@ func (m *Manager) handleBitfiedMessage(seeder *Seeder, payload []byte) {
 
 }
 
+func (m *Manager) updateInterest(seeder *Seeder) {
+
+	if m.interesting(seeder) && seeder.AmInterested == false {
+		seeder.AmInterested = true
+		seeder.outcoming <- Message{Interested, nil, m.peerId}
+		m.interestingPeerCount += 1
+	}
+}
+
+func (m *Manager) handleHaveAllMessage(seeder *Seeder) {
+
+	for index := uint(0); index < uint(m.pieceCount); index++ {
+		m.setPeerPiece(seeder, index)
+	}
+
+	m.updateInterest(seeder)
+}
+
+func (m *Manager) handleHaveNoneMessage(seeder *Seeder) {
+
+	m.setPeerBitfield(seeder, bitfield.NewBitfield(uint(m.pieceCount)))
+}
+
+func (m *Manager) handleSuggestPieceMessage(seeder *Seeder, payload []byte) {
+
+	pieceIndex, err := ParseHavePayload(payload)
+	if err != nil {
+		seeder.Close()
+		return
+	}
+
+	managerLogger.WithFields(logrus.Fields{
+		"peerId":     seeder.PeerId,
+		"pieceIndex": pieceIndex,
+		"infoHash":   m.infoHash,
+	}).Trace("piece suggested")
+}
+
+// handleRejectRequestMessage returns rejected block to not requested blocks
+func (m *Manager) handleRejectRequestMessage(seeder *Seeder, payload []byte) {
+
+	index, offset, _, err := ParseRequestPayload(payload)
+	if err != nil {
+		seeder.Close()
+		return
+	}
+
+	pieceIndex, blockIndex := m.convertOffsetToPieceIndex(index, offset)
+	globalBlockIndex := m.convertPieceToGlobalBlockIndex(pieceIndex, blockIndex)
+
+	// the block is not requested from the peer again immediately
+	if !m.releaseRequest(seeder, globalBlockIndex) {
+		return
+	}
+
+	m.redistributeRequests(seeder)
+
+	managerLogger.WithFields(logrus.Fields{
+		"peerId":     seeder.PeerId,
+		"pieceIndex": pieceIndex,
+		"blockIndex": blockIndex,
+		"infoHash":   m.infoHash,
+	}).Trace("request rejected")
+}
+
+// handleAllowedFastMessage starts downloading of the allowed piece
+// if the peer chokes us and there is no request to the peer
+func (m *Manager) handleAllowedFastMessage(seeder *Seeder, payload []byte) {
+
+	pieceIndex, err := ParseHavePayload(payload)
+	if err != nil {
+		seeder.Close()
+		return
+	}
+
+	if int64(pieceIndex) >= m.pieceCount {
+		return
+	}
+
+	seeder.PeerAllowedFast[pieceIndex] = true
+
+	if !seeder.PeerChoking || m.downloadedPieceBitfield.Get(uint(pieceIndex)) == 1 ||
+		seeder.PeerBitfield.Get(uint(pieceIndex)) == 0 || m.piecePriorities[pieceIndex] == PrioritySkip {
+		return
+	}
+
+	if seeder.AmInterested == false {
+		seeder.AmInterested = true
+		seeder.outcoming <- Message{Interested, nil, m.peerId}
+		m.interestingPeerCount += 1
+	}
+
+	m.fillRequests(seeder)
+}
+
 func (m *Manager) handleHaveMessage(seeder *Seeder, payload []byte) {
 
 	pieceIndex, err := ParseHavePayload(payload)
@@ -342,8 +703,14 @@ func (m *Manager) handleHaveMessage(seeder *Seeder, payload []byte) {
 		return
 	}
 
-	seeder.PeerBitfield.Set(uint(pieceIndex))
-	if m.downloadedPieceBitfield.Get(uint(pieceIndex)) == 0 && seeder.AmInterested == false {
+	if int64(pieceIndex) >= m.pieceCount {
+		seeder.Close()
+		return
+	}
+
+	m.setPeerPiece(seeder, uint(pieceIndex))
+	if m.downloadedPieceBitfield.Get(uint(pieceIndex)) == 0 && m.piecePriorities[pieceIndex] != PrioritySkip &&
+		seeder.AmInterested == false {
 		seeder.AmInterested = true
 		seeder.outcoming <- Message{Interested, nil, m.peerId}
 		m.interestingPeerCount += 1
@@ -354,25 +721,30 @@ func (m *Manager) handleChokeMessage(seeder *Seeder) {
 
 	seeder.PeerChoking = true
 
+	// fast extension peer rejects the requests explicitly (BEP 6)
+	if !seeder.SupportsFast() {
+		m.releaseRequests(seeder)
+		m.redistributeRequests(seeder)
+	}
 }
 
 func (m *Manager) handleUnchokeMessage(seeder *Seeder) {
 
 	seeder.PeerChoking = false
+	seeder.snubbed = false
+
 	if seeder.AmInterested == true {
-		pieceIndex, blockIndex, _ := m.requestPiece(seeder)
-		index, offset, length := m.convertPieceIndexToOffset(pieceIndex, blockIndex)
-		payload := MakeRequestPayload(index, offset, length)
-		seeder.outcoming <- Message{Request, payload, m.peerId}
+		m.fillRequests(seeder)
 	}
 }
 
 func (m *Manager) handleInterestedMessage(seeder *Seeder) {
 
 	seeder.PeerInterested = true
-	if true { // todo condition
-		seeder.AmChoking = false
-		seeder.outcoming <- Message{Unchoke, nil, m.peerId}
+
+	// free upload slot is taken until the next rechoke
+	if seeder.AmChoking && m.unchokedCount() < m.uploadSlots {
+		m.unchokePeer(seeder)
 	}
 }
 
@@ -381,31 +753,41 @@ func (m *Manager) handleNotInterestedMessage(seeder *Seeder) {
 	seeder.PeerInterested = false
 	seeder.AmChoking = true
 	seeder.outcoming <- Message{Choke, nil, m.peerId}
+
+	m.clearUploads(seeder)
 }
 
 func (m *Manager) handleRequestMessage(seeder *Seeder, payload []byte) {
 
-	if seeder.AmChoking == true {
+	index, offset, length, err := ParseRequestPayload(payload)
+	if err != nil {
+		seeder.Close()
 		return
 	}
 
-	index, offset, length, _ := ParseRequestPayload(payload)
-
-	//if seeder.PeerBitfield.Get(uint(index)) == 1 {
-	//	return
-	//}
+	request := blockRequest{index, offset, length}
 
-	data := make([]byte, length)
-	_, err := m.storage.ReadAt(data, int64(index)*m.info.PieceLength+int64(offset))
+	err = m.validateRequest(request)
 	if err != nil {
-		log.Println(err)
+		managerLogger.WithFields(logrus.Fields{
+			"peerId":   seeder.PeerId,
+			"infoHash": m.infoHash,
+		}).Debug(err.Error())
+		m.rejectRequest(seeder, request)
 		return
 	}
 
-	seeder.outcoming <- Message{Piece, MakePiecePayload(index, offset, data), m.peerId}
+	// allowed fast pieces are served while the peer is choked
+	allowed := !seeder.AmChoking || (seeder.SupportsFast() && seeder.AllowedFast[index])
 
-	m.state.IncrementUploaded(uint64(length))
+	if !allowed || m.downloadedPieceBitfield.Get(uint(index)) == 0 ||
+		len(seeder.uploadQueue) >= maxUploadQueueLength {
+		m.rejectRequest(seeder, request)
+		return
+	}
 
+	seeder.uploadQueue = append(seeder.uploadQueue, request)
+	m.dispatchUpload(seeder)
 }
 
 func (m *Manager) handlePieceMessage(seeder *Seeder, payload []byte) {
@@ -417,19 +799,44 @@ func (m *Manager) handlePieceMessage(seeder *Seeder, payload []byte) {
 	}
 
 	pieceIndex, blockIndex := m.convertOffsetToPieceIndex(index, offset)
+	globalBlockIndex := m.convertPieceToGlobalBlockIndex(pieceIndex, blockIndex)
+
+	// blocks which are not requested from the peer are dropped
+	if !seeder.requests[globalBlockIndex] {
+		managerLogger.WithFields(logrus.Fields{
+			"peerId":     seeder.PeerId,
+			"pieceIndex": pieceIndex,
+			"blockIndex": blockIndex,
+			"infoHash":   m.infoHash,
+		}).Trace("unexpected block received")
+		return
+	}
+
+	delete(seeder.requests, globalBlockIndex)
+	seeder.downloadedBytes += int64(len(data))
+	seeder.lastBlock = time.Now()
+
+	m.cancelRequests(globalBlockIndex)
+
+	if m.downloadedBlockBitfield.Get(uint(globalBlockIndex)) == 0 {
+		m.blockPeers[globalBlockIndex] = peerHost(seeder.Address)
+	}
+
 	m.acceptPiece(pieceIndex, blockIndex, data)
 
-	if seeder.PeerChoking || !seeder.AmInterested {
+	// the peer is banned for the piece
+	if current, ok := m.getSeeder(seeder.PeerId); !ok || current != seeder {
+		return
+	}
+
+	if !seeder.AmInterested || (seeder.PeerChoking && len(seeder.PeerAllowedFast) == 0) {
 		return
 	}
 
-	pieceIndex, blockIndex, interested := m.requestPiece(seeder)
+	interested := m.fillRequests(seeder)
 
-	if interested {
-		index, offset, length := m.convertPieceIndexToOffset(pieceIndex, blockIndex)
-		payload := MakeRequestPayload(index, offset, length)
-		seeder.outcoming <- Message{Request, payload, m.peerId}
-	} else {
+	if !interested && len(seeder.requests) == 0 && !seeder.PeerChoking {
+		seeder.AmInterested = false
 		seeder.outcoming <- Message{NotInterested, nil, m.peerId}
 		m.interestingPeerCount -= 1
 	}
@@ -492,32 +899,97 @@ func (m *Manager) convertOffsetToPieceIndex(index, offset uint32) (pieceIndex, b
 	return pieceIndex, blockIndex
 }
 
+// canRequest reports whether the piece can be requested from the peer,
+// only allowed fast pieces can be requested from choking peer
+func (m *Manager) canRequest(seeder *Seeder, pieceIndex int) bool {
+	return m.piecePriorities[pieceIndex] != PrioritySkip &&
+		seeder.PeerBitfield.Get(uint(pieceIndex)) == 1 &&
+		(!seeder.PeerChoking || seeder.PeerAllowedFast[uint32(pieceIndex)])
+}
+
+// requestPiece selects the block to request from the peer, blocks of pieces with higher priority
+// are requested first, then blocks of started pieces, then blocks of the rarest pieces
+// with random tie-breaking
 func (m *Manager) requestPiece(seeder *Seeder) (pieceIndex, blockIndex int, interested bool) {
 
-	index := m.downloadingBlockBitfield.GetFirstIndex(0, 0)
+	m.availabilityMutex.RLock()
+	defer m.availabilityMutex.RUnlock()
 
-	for index < m.downloadingBlockBitfield.Length() {
+	selectedIndex := uint(0)
+	selectedPriority := PrioritySkip
+	selectedStarted := false
+	selectedAvailability := 0
+	tieCount := 0
 
-		pieceIndex, blockIndex = m.convertGlobalBlockToPieceIndex(int64(index))
+	for index := 0; index < int(m.pieceCount); index++ {
 
-		if seeder.PeerBitfield.Get(uint(pieceIndex)) == 1 {
-			m.downloadingBlockBitfield.Set(index)
-			m.lastRequestedBlock[string(seeder.PeerId)] = uint64(index)
+		if !m.canRequest(seeder, index) {
+			continue
+		}
 
-			managerLogger.WithFields(logrus.Fields{
-				"pieceIndex": pieceIndex,
-				"blockIndex": blockIndex,
-				"infoHash":   m.infoHash,
-			}).Trace("block requested")
+		startIndex := uint(m.convertPieceToGlobalBlockIndex(index, 0))
+		endIndex := startIndex + uint(m.blocksPerPiece)
+		if int64(index) == m.pieceCount-1 {
+			endIndex = uint(m.blockCount)
+		}
+
+		freeIndex := m.downloadingBlockBitfield.GetFirstIndex(startIndex, 0)
+		if freeIndex >= endIndex {
+			continue
+		}
+
+		priority := m.piecePriorities[index]
+		started := m.downloadingBlockBitfield.GetFirstIndex(startIndex, 1) < endIndex
+		availability := m.pieceAvailability[index]
+
+		switch {
+
+		case tieCount == 0 || priority > selectedPriority:
+			tieCount = 1
+
+		case priority < selectedPriority:
+			continue
 
-			return pieceIndex, blockIndex, true
+		case (started && !selectedStarted) ||
+			(started == selectedStarted && availability < selectedAvailability):
+			tieCount = 1
+
+		case started == selectedStarted && availability == selectedAvailability:
+			tieCount += 1
+			if rand.Intn(tieCount) != 0 {
+				continue
+			}
+
+		default:
+			continue
 		}
 
-		index = m.downloadingBlockBitfield.GetFirstIndex(index+1, 0)
+		selectedIndex = freeIndex
+		selectedPriority = priority
+		selectedStarted = started
+		selectedAvailability = availability
+	}
+
+	if tieCount == 0 {
+		if m.endGame() {
+			return m.requestEndGameBlock(seeder)
+		}
+		return 0, 0, false
 	}
 
-	return 0, 0, false
+	m.downloadingBlockBitfield.Set(selectedIndex)
+	seeder.requests[int64(selectedIndex)] = true
 
+	pieceIndex, blockIndex = m.convertGlobalBlockToPieceIndex(int64(selectedIndex))
+
+	managerLogger.WithFields(logrus.Fields{
+		"pieceIndex":   pieceIndex,
+		"blockIndex":   blockIndex,
+		"availability": selectedAvailability,
+		"infoHash":     m.infoHash,
+	}).Trace("block requested")
+
+	return pieceIndex, blockIndex, true
 }
 
 func (m *Manager) acceptPiece(pieceIndex, blockIndex int, data []byte) {
@@ -528,26 +1000,31 @@ func (m *Manager) acceptPiece(pieceIndex, blockIndex int, data []byte) {
 		"infoHash":   m.infoHash,
 	}).Trace("Block accepted")
 
+	globalBlockIndex := m.convertPieceToGlobalBlockIndex(pieceIndex, blockIndex)
+
+	// the block is received from several peers
+	if m.downloadedBlockBitfield.Get(uint(globalBlockIndex)) == 1 {
+		return
+	}
+
 	pieceLength := int(m.info.PieceLength)
-	offset := pieceIndex*pieceLength + blockIndex*blockLength
-	if _, err := m.storage.WriteAt(data, int64(offset)); err != nil {
+	if int64(pieceIndex) == m.pieceCount-1 {
+		pieceLength = int(m.lastPieceLength)
+	}
+
+	err := m.cache.writeBlock(m, pieceIndex, int64(pieceLength), data, int64(blockIndex*blockLength))
+	if err != nil {
 		panic(err)
 	}
 
-	globalBlockIndex := m.convertPieceToGlobalBlockIndex(pieceIndex, blockIndex)
 	m.downloadedBlockBitfield.Set(uint(globalBlockIndex))
 	m.pieceDownloadProgress[pieceIndex] -= 1
 
 	if m.pieceDownloadProgress[pieceIndex] == 0 {
 
-		offset := pieceIndex * pieceLength
-
-		if int64(pieceIndex) == m.pieceCount-1 {
-			pieceLength = int(m.lastPieceLength)
-		}
-
+		// the blocks are hashed from the cache
 		data = make([]byte, pieceLength)
-		if _, err := m.storage.ReadAt(data, int64(offset)); err != nil {
+		if err := m.cache.readPiece(m, pieceIndex, data); err != nil {
 			panic(err)
 		}
 
@@ -574,8 +1051,12 @@ func (m *Manager) acceptPiece(pieceIndex, blockIndex int, data []byte) {
 			endIndex := m.convertPieceToGlobalBlockIndex(pieceIndex+1, 0)
 			for i := startIndex; i < endIndex; i++ {
 				m.downloadingBlockBitfield.Clear(uint(i))
+				m.downloadedBlockBitfield.Clear(uint(i))
 			}
 
+			m.cache.discardPiece(m, pieceIndex)
+			m.handleHashFailure(pieceIndex, data)
+
 			return
 		}
 
@@ -584,6 +1065,19 @@ func (m *Manager) acceptPiece(pieceIndex, blockIndex int, data []byte) {
 			"infoHash":   m.infoHash,
 		}).Trace("Piece accepted")
 
+		m.handleHashSuccess(pieceIndex, data)
+
+		// the piece which is not written stays in the cache and is not marked downloaded
+		if err := m.cache.completePiece(m, pieceIndex, data); err != nil {
+			m.handleStorageError(errors.Annotate(err, "accept piece"))
+			return
+		}
+
+		if err := m.storage.Piece(pieceIndex).MarkComplete(); err != nil {
+			m.handleStorageError(errors.Annotate(err, "accept piece"))
+			return
+		}
+
 		m.state.IncrementDownloaded(uint64(pieceLength))
 		m.state.DecrementLeft(uint64(pieceLength))
 
@@ -598,14 +1092,19 @@ func (m *Manager) acceptPiece(pieceIndex, blockIndex int, data []byte) {
 			}
 		}
 
-		if m.downloadedPieceBitfield.GetFirstIndex(0, 0) == m.downloadedPieceBitfield.Length() {
-			m.Done <- struct{}{}
-			managerLogger.WithFields(logrus.Fields{
-				"downloaded": m.state.Downloaded(),
-				"uploaded":   m.state.Uploaded(),
-				"left":       m.state.Left(),
-				"infoHash":   m.infoHash,
-			}).Info("Download completed")
-		}
+		m.checkCompleted()
+	}
+}
+
+// handleStorageError passes the error to the download, which stops the torrent
+func (m *Manager) handleStorageError(err error) {
+
+	managerLogger.WithFields(logrus.Fields{
+		"infoHash": m.infoHash,
+	}).Error(err)
+
+	select {
+	case m.Errors <- err:
+	default:
 	}
 }
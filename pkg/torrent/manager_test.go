@@ -3,12 +3,17 @@ package torrent
 import (
 	"bytes"
 	"fmt"
+	"github.com/lezhenin/gotorrentclient/pkg/bitfield"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"os"
+	"path"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestManager_Start(t *testing.T) {
@@ -103,7 +108,7 @@ func TestManager_Start(t *testing.T) {
 	receivedMessage = <-exteriorSeeder.incoming
 	assert.EqualValues(t, Unchoke, receivedMessage.Id, "unexpected received message")
 
-	index, begin, length := uint32(3), uint32(0), uint32(32*1024)
+	index, begin, length := uint32(3), uint32(0), uint32(16*1024)
 	exteriorSeeder.outcoming <- Message{Request, MakeRequestPayload(index, begin, length), nil}
 
 	receivedMessage = <-exteriorSeeder.incoming
@@ -118,7 +123,7 @@ func TestManager_Start(t *testing.T) {
 	assert.NoError(t, err, "can not parse piece payload")
 	assert.EqualValues(t, 3, index, "unexpected index in received piece")
 	assert.EqualValues(t, 0, begin, "unexpected begin in received piece")
-	assert.EqualValues(t, 32*1024, len(block), "unexpected length in received piece")
+	assert.EqualValues(t, 16*1024, len(block), "unexpected length in received piece")
 	assert.True(t, bytes.Compare(block, data) == 0, "unexpected data in received piece")
 
 	exteriorSeeder.outcoming <- Message{NotInterested, MakeRequestPayload(index, begin, length), nil}
@@ -232,16 +237,13 @@ func TestManager_Start_WrongData(t *testing.T) {
 	requestPayload = receivedMessage.Payload
 	piecePayload = makePiecePayload(t, requestPayload, exteriorStorage, metadata)
 
+	// the peer sent corrupt block is disconnected when the piece is verified
 	exteriorSeeder.outcoming <- Message{Piece, piecePayload, nil}
-	receivedMessage = <-exteriorSeeder.incoming
-	assert.EqualValues(t, NotInterested, receivedMessage.Id, "unexpected received message")
+	seederWait.Wait()
 
-	exteriorSeeder.outcoming <- Message{NotInterested, nil, nil}
-	receivedMessage = <-exteriorSeeder.incoming
-	assert.EqualValues(t, Choke, receivedMessage.Id, "unexpected received message")
+	assert.True(t, manager.Banned(interiorConn.RemoteAddr().String()), "peer is not banned")
 
 	exteriorSeeder.Close()
-	seederWait.Wait()
 
 	manager.Stop()
 	wait.Wait()
@@ -262,3 +264,998 @@ func makePiecePayload(t *testing.T, requestPayload []byte, storage *Storage, met
 	return MakePiecePayload(index, begin, data)
 
 }
+
+func TestManager_Start_Fast(t *testing.T) {
+
+	filename := "../../test/test_download/test_data_localhost.torrent"
+	metadata, err := NewMetadata(filename)
+	assert.NoError(t, err, "can not decode metadata")
+
+	bitfieldLength := uint(metadata.Info.PieceCount) / 8
+	if metadata.Info.PieceCount%8 > 0 {
+		bitfieldLength += 1
+	}
+
+	state := NewState(uint64(metadata.Info.TotalLength), bitfieldLength)
+
+	tempDir, err := ioutil.TempDir("", "TestManager_Start_Fast")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := NewStorage(metadata.Info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	infoHash := metadata.Info.HashSHA1
+
+	manager := NewManager(peerId, infoHash, &metadata.Info, state, storage)
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+
+	go func() {
+		defer wait.Done()
+		manager.Start()
+	}()
+
+	interiorConn, exteriorConn := net.Pipe()
+
+	exteriorPeerId := make([]byte, 20)
+	rand.Read(exteriorPeerId)
+
+	exteriorSeeder, _ := makeTestSeeder(infoHash, exteriorPeerId)
+	exteriorSeeder.EnableFast()
+
+	exteriorStorage, err := NewStorage(metadata.Info, "../../test/test_download/")
+
+	var seederWait sync.WaitGroup
+	seederWait.Add(1)
+
+	go func() {
+		defer seederWait.Done()
+		err := exteriorSeeder.Accept(exteriorConn)
+		assert.NoError(t, err, "can not accept seeder connection")
+	}()
+
+	err = manager.AddSeeder(interiorConn, false)
+	assert.NoError(t, err, "manager can not accept seeder connection")
+
+	seederWait.Wait()
+
+	assert.True(t, exteriorSeeder.SupportsFast(), "fast extension is not negotiated")
+
+	seederWait.Add(1)
+	go func() {
+		defer seederWait.Done()
+		exteriorSeeder.Start()
+	}()
+
+	receivedMessage := <-exteriorSeeder.incoming
+	assert.EqualValues(t, HaveNone, receivedMessage.Id, "unexpected received message")
+
+	exteriorSeeder.outcoming <- Message{HaveAll, nil, nil}
+	receivedMessage = <-exteriorSeeder.incoming
+	assert.EqualValues(t, Interested, receivedMessage.Id, "unexpected received message")
+
+	// blocks of allowed piece are requested while choked
+	exteriorSeeder.outcoming <- Message{AllowedFast, MakeHavePayload(3), nil}
+	receivedMessage = <-exteriorSeeder.incoming
+	assert.EqualValues(t, Request, receivedMessage.Id, "unexpected received message")
+
+	requestPayload := receivedMessage.Payload
+	index, begin, _, _ := ParseRequestPayload(requestPayload)
+	assert.EqualValues(t, 3, index, "request wrong index")
+	assert.EqualValues(t, 0, begin, "request wrong begin")
+
+	receivedMessage = <-exteriorSeeder.incoming
+	assert.EqualValues(t, Request, receivedMessage.Id, "unexpected received message")
+
+	secondRequestPayload := receivedMessage.Payload
+	index, begin, _, _ = ParseRequestPayload(secondRequestPayload)
+	assert.EqualValues(t, 3, index, "request wrong index")
+	assert.EqualValues(t, blockLength, begin, "request wrong begin")
+
+	// rejected block is requested again
+	exteriorSeeder.outcoming <- Message{RejectRequest, requestPayload, nil}
+	exteriorSeeder.outcoming <- Message{AllowedFast, MakeHavePayload(3), nil}
+	receivedMessage = <-exteriorSeeder.incoming
+	assert.EqualValues(t, Request, receivedMessage.Id, "unexpected received message")
+	assert.Equal(t, requestPayload, receivedMessage.Payload, "rejected block is not requested")
+
+	piecePayload := makePiecePayload(t, receivedMessage.Payload, exteriorStorage, metadata)
+	exteriorSeeder.outcoming <- Message{Piece, piecePayload, nil}
+
+	piecePayload = makePiecePayload(t, secondRequestPayload, exteriorStorage, metadata)
+	exteriorSeeder.outcoming <- Message{Piece, piecePayload, nil}
+
+	// choked peer requests are rejected
+	requestPayload = MakeRequestPayload(3, 0, uint32(blockLength))
+	exteriorSeeder.outcoming <- Message{Request, requestPayload, nil}
+	receivedMessage = <-exteriorSeeder.incoming
+	assert.EqualValues(t, RejectRequest, receivedMessage.Id, "unexpected received message")
+	assert.Equal(t, requestPayload, receivedMessage.Payload, "unexpected rejected request")
+
+	exteriorSeeder.outcoming <- Message{Interested, nil, nil}
+	receivedMessage = <-exteriorSeeder.incoming
+	assert.EqualValues(t, Unchoke, receivedMessage.Id, "unexpected received message")
+
+	// requests of not downloaded pieces are rejected
+	requestPayload = MakeRequestPayload(5, 0, uint32(blockLength))
+	exteriorSeeder.outcoming <- Message{Request, requestPayload, nil}
+	receivedMessage = <-exteriorSeeder.incoming
+	assert.EqualValues(t, RejectRequest, receivedMessage.Id, "unexpected received message")
+
+	requestPayload = MakeRequestPayload(3, 0, uint32(blockLength))
+	exteriorSeeder.outcoming <- Message{Request, requestPayload, nil}
+	receivedMessage = <-exteriorSeeder.incoming
+	assert.EqualValues(t, Piece, receivedMessage.Id, "unexpected received message")
+
+	exteriorSeeder.Close()
+	seederWait.Wait()
+
+	manager.Stop()
+	wait.Wait()
+
+}
+
+func TestManager_Upload(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	bitfieldLength := uint(metadata.Info.PieceCount) / 8
+	if metadata.Info.PieceCount%8 > 0 {
+		bitfieldLength += 1
+	}
+
+	state := NewState(uint64(metadata.Info.TotalLength), bitfieldLength)
+
+	storage, err := NewStorage(metadata.Info, "../../test/test_download/")
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+	manager.downloadedPieceBitfield.Set(3)
+
+	seeder, _ := makeTestSeeder(metadata.Info.HashSHA1, peerId)
+	seeder.PeerId = make([]byte, 20)
+	rand.Read(seeder.PeerId)
+	seeder.EnableFast()
+	seeder.PeerReserved = []byte{0, 0, 0, 0, 0, 0, 0, fastExtensionBit}
+	seeder.AmChoking = false
+	manager.addSeeder(seeder)
+
+	expectMessage := func(id MessageId, index, begin, length uint32) {
+		select {
+		case message := <-seeder.outcoming:
+			assert.Equal(t, id, message.Id, "unexpected message")
+			if id == Piece {
+				parsedIndex, parsedBegin, block, err := ParsePiecePayload(message.Payload)
+				assert.NoError(t, err, "can not parse piece")
+				assert.Equal(t, []uint32{index, begin, length},
+					[]uint32{parsedIndex, parsedBegin, uint32(len(block))}, "unexpected piece")
+			} else if id == RejectRequest {
+				assert.Equal(t, MakeRequestPayload(index, begin, length), message.Payload, "unexpected payload")
+			}
+		default:
+			t.Fatalf("message %d is not sent", id)
+		}
+	}
+
+	// oversized, out of piece and out of range requests are rejected
+	manager.handleRequestMessage(seeder, MakeRequestPayload(3, 0, 32*1024))
+	expectMessage(RejectRequest, 3, 0, 32*1024)
+
+	pieceLength := uint32(metadata.Info.PieceLength)
+	manager.handleRequestMessage(seeder, MakeRequestPayload(3, pieceLength-1024, 16*1024))
+	expectMessage(RejectRequest, 3, pieceLength-1024, 16*1024)
+
+	manager.handleRequestMessage(seeder, MakeRequestPayload(uint32(metadata.Info.PieceCount), 0, 16*1024))
+	expectMessage(RejectRequest, uint32(metadata.Info.PieceCount), 0, 16*1024)
+
+	// the first request is read, the others wait in the queue
+	manager.handleRequestMessage(seeder, MakeRequestPayload(3, 0, 16*1024))
+	manager.handleRequestMessage(seeder, MakeRequestPayload(3, 16*1024, 16*1024))
+	manager.handleRequestMessage(seeder, MakeRequestPayload(3, 0, 1024))
+	assert.Len(t, seeder.uploadQueue, 2, "unexpected queue length")
+
+	manager.handleCancelMessage(seeder, MakeCancelPayload(3, 16*1024, 16*1024))
+	expectMessage(RejectRequest, 3, 16*1024, 16*1024)
+	assert.Len(t, seeder.uploadQueue, 1, "cancelled request is not removed")
+
+	manager.handleUploadedBlock(<-manager.uploadedBlocks)
+	expectMessage(Piece, 3, 0, 16*1024)
+
+	manager.handleUploadedBlock(<-manager.uploadedBlocks)
+	expectMessage(Piece, 3, 0, 1024)
+
+	assert.EqualValues(t, 17*1024, state.Uploaded(), "unexpected uploaded")
+
+	// queue of choked peer is rejected
+	manager.handleRequestMessage(seeder, MakeRequestPayload(3, 0, 16*1024))
+	manager.handleRequestMessage(seeder, MakeRequestPayload(3, 0, 1024))
+	manager.handleNotInterestedMessage(seeder)
+	expectMessage(Choke, 0, 0, 0)
+	expectMessage(RejectRequest, 3, 0, 1024)
+	assert.Len(t, seeder.uploadQueue, 0, "queue of choked peer is not cleared")
+
+	manager.handleUploadedBlock(<-manager.uploadedBlocks)
+	expectMessage(Piece, 3, 0, 16*1024)
+}
+
+func TestManager_Requests(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	tempDir, err := ioutil.TempDir("", "TestManager_Requests")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := NewStorage(metadata.Info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+	manager.SetRequestQueueDepth(8)
+
+	seeder, _ := makeTestSeeder(metadata.Info.HashSHA1, peerId)
+	seeder.PeerId = make([]byte, 20)
+	rand.Read(seeder.PeerId)
+	seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+	manager.addSeeder(seeder)
+
+	// queue depth follows the peer rate
+	assert.Equal(t, minRequestQueueDepth, manager.requestQueueDepth(seeder), "unexpected depth")
+
+	seeder.downloadedBytes = int64(2 * blockLength)
+	manager.handleRateTimer()
+	assert.EqualValues(t, blockLength, seeder.downloadRate, "unexpected rate")
+	assert.Equal(t, 3, manager.requestQueueDepth(seeder), "unexpected depth")
+
+	seeder.downloadRate = float64(100 * blockLength)
+	assert.Equal(t, 8, manager.requestQueueDepth(seeder), "depth is not limited")
+
+	manager.handleHaveAllMessage(seeder)
+	assert.EqualValues(t, Interested, (<-seeder.outcoming).Id, "unexpected message")
+
+	manager.handleUnchokeMessage(seeder)
+	assert.Len(t, seeder.outcoming, 8, "unexpected number of requests")
+	assert.Len(t, seeder.requests, 8, "unexpected number of requests")
+
+	for len(seeder.outcoming) > 0 {
+		assert.EqualValues(t, Request, (<-seeder.outcoming).Id, "unexpected message")
+	}
+
+	// unrequested block is dropped
+	unrequested := int64(0)
+	for seeder.requests[unrequested] {
+		unrequested += 1
+	}
+
+	pieceIndex, blockIndex := manager.convertGlobalBlockToPieceIndex(unrequested)
+	index, offset, _ := manager.convertPieceIndexToOffset(pieceIndex, blockIndex)
+	manager.handlePieceMessage(seeder, MakePiecePayload(index, offset, []byte{1}))
+	assert.EqualValues(t, 0, manager.downloadedBlockBitfield.Count(1), "unrequested block is accepted")
+
+	// requests are released when the peer chokes
+	manager.handleChokeMessage(seeder)
+	assert.Len(t, seeder.requests, 0, "requests are not released")
+	assert.EqualValues(t, 0, manager.downloadingBlockBitfield.Count(1), "blocks are not released")
+}
+
+func TestManager_RarestFirst(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	tempDir, err := ioutil.TempDir("", "TestManager_RarestFirst")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := NewStorage(metadata.Info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+
+	makeSeeder := func(pieces ...uint32) (seeder *Seeder) {
+
+		seeder, _ = makeTestSeeder(metadata.Info.HashSHA1, peerId)
+		seeder.PeerId = make([]byte, 20)
+		rand.Read(seeder.PeerId)
+		seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+		seeder.PeerChoking = false
+		seeder.connection, _ = net.Pipe()
+		manager.addSeeder(seeder)
+
+		for _, piece := range pieces {
+			manager.handleHaveMessage(seeder, MakeHavePayload(piece))
+		}
+
+		return seeder
+	}
+
+	first := makeSeeder(1, 2)
+	makeSeeder(2)
+	third := makeSeeder(1, 2, 3)
+
+	availability := manager.Availability()
+	assert.Equal(t, []int{0, 2, 3, 1}, availability[:4], "unexpected availability")
+
+	pieceIndex, blockIndex, ok := manager.requestPiece(first)
+	assert.True(t, ok, "nothing is requested")
+	assert.Equal(t, []int{1, 0}, []int{pieceIndex, blockIndex}, "rarest piece is not requested")
+
+	// started piece is finished before the rarer one
+	pieceIndex, blockIndex, ok = manager.requestPiece(third)
+	assert.True(t, ok, "nothing is requested")
+	assert.Equal(t, []int{1, 1}, []int{pieceIndex, blockIndex}, "started piece is not requested")
+
+	pieceIndex, blockIndex, ok = manager.requestPiece(third)
+	assert.True(t, ok, "nothing is requested")
+	assert.Equal(t, []int{3, 0}, []int{pieceIndex, blockIndex}, "rarest piece is not requested")
+
+	manager.handleClosing(third)
+
+	availability = manager.Availability()
+	assert.Equal(t, []int{0, 1, 2, 0}, availability[:4], "availability of closed peer is counted")
+}
+
+func TestManager_EndGame(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	tempDir, err := ioutil.TempDir("", "TestManager_EndGame")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := NewStorage(metadata.Info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+
+	// only blocks of the piece 3 are not downloaded
+	for index := uint(0); index < uint(manager.blockCount); index++ {
+		if pieceIndex, _ := manager.convertGlobalBlockToPieceIndex(int64(index)); pieceIndex != 3 {
+			manager.downloadingBlockBitfield.Set(index)
+			manager.downloadedBlockBitfield.Set(index)
+		}
+	}
+
+	makeSeeder := func() (seeder *Seeder) {
+		seeder, _ = makeTestSeeder(metadata.Info.HashSHA1, peerId)
+		seeder.PeerId = make([]byte, 20)
+		rand.Read(seeder.PeerId)
+		seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+		seeder.PeerBitfield.Set(3)
+		seeder.PeerChoking = false
+		manager.addSeeder(seeder)
+		return seeder
+	}
+
+	first := makeSeeder()
+	second := makeSeeder()
+
+	_, _, ok := manager.requestPiece(first)
+	assert.True(t, ok, "nothing is requested")
+	assert.False(t, manager.endGame(), "end game is started")
+
+	_, _, ok = manager.requestPiece(first)
+	assert.True(t, ok, "nothing is requested")
+	assert.True(t, manager.endGame(), "end game is not started")
+
+	_, _, ok = manager.requestPiece(first)
+	assert.False(t, ok, "block is requested twice from the peer")
+
+	// requested blocks are requested from another peer
+	pieceIndex, blockIndex, ok := manager.requestPiece(second)
+	assert.True(t, ok, "nothing is requested in end game")
+	assert.Equal(t, []int{3, 0}, []int{pieceIndex, blockIndex}, "unexpected block")
+
+	pieceIndex, blockIndex, ok = manager.requestPiece(second)
+	assert.True(t, ok, "nothing is requested in end game")
+	assert.Equal(t, []int{3, 1}, []int{pieceIndex, blockIndex}, "unexpected block")
+
+	// received block is cancelled at another peer
+	payload := MakePiecePayload(3, 0, make([]byte, blockLength))
+	manager.handlePieceMessage(first, payload)
+
+	message := <-second.outcoming
+	assert.EqualValues(t, Cancel, message.Id, "cancel is not sent")
+	assert.Equal(t, MakeCancelPayload(3, 0, uint32(blockLength)), message.Payload, "unexpected cancel")
+	assert.Len(t, second.requests, 1, "cancelled request is not removed")
+	assert.Len(t, first.requests, 1, "received request is not removed")
+}
+
+func TestManager_Rechoke(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	tempDir, err := ioutil.TempDir("", "TestManager_Rechoke")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := NewStorage(metadata.Info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+	manager.SetUploadSlots(1)
+
+	makeSeeder := func(rate float64) (seeder *Seeder) {
+		seeder, _ = makeTestSeeder(metadata.Info.HashSHA1, peerId)
+		seeder.PeerId = make([]byte, 20)
+		rand.Read(seeder.PeerId)
+		seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+		seeder.downloadRate = rate
+		manager.addSeeder(seeder)
+		return seeder
+	}
+
+	unchoked := func(seeders ...*Seeder) (count int) {
+		for _, seeder := range seeders {
+			if !seeder.AmChoking {
+				count += 1
+			}
+		}
+		return count
+	}
+
+	first := makeSeeder(3)
+	second := makeSeeder(2)
+	third := makeSeeder(1)
+
+	// free slot is taken by interested peer immediately
+	manager.handleInterestedMessage(third)
+	assert.False(t, third.AmChoking, "peer is not unchoked")
+	assert.EqualValues(t, Unchoke, (<-third.outcoming).Id, "unexpected message")
+
+	manager.handleInterestedMessage(second)
+	assert.True(t, second.AmChoking, "peer is unchoked without free slot")
+
+	manager.handleInterestedMessage(first)
+
+	// the fastest peer and optimistic one are unchoked
+	manager.rechoke(false)
+	assert.False(t, first.AmChoking, "the fastest peer is choked")
+	assert.Equal(t, 2, unchoked(first, second, third), "unexpected number of unchoked peers")
+
+	optimistic := manager.optimisticSeeder
+	assert.True(t, optimistic == second || optimistic == third, "unexpected optimistic peer")
+
+	manager.rechoke(false)
+	assert.Equal(t, optimistic, manager.optimisticSeeder, "optimistic peer is changed before rotation")
+
+	// not interested peers are not unchoked
+	manager.handleNotInterestedMessage(optimistic)
+	manager.rechoke(false)
+	assert.True(t, optimistic.AmChoking, "not interested peer is unchoked")
+	assert.Equal(t, 2, unchoked(first, second, third), "unexpected number of unchoked peers")
+
+	second.downloadRate = 10
+	manager.handleInterestedMessage(optimistic)
+	manager.rechoke(true)
+	assert.False(t, second.AmChoking, "the fastest peer is choked")
+	assert.Equal(t, 2, unchoked(first, second, third), "unexpected number of unchoked peers")
+}
+
+func TestManager_Snub(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	tempDir, err := ioutil.TempDir("", "TestManager_Snub")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := NewStorage(metadata.Info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+	manager.SetUploadSlots(1)
+
+	makeSeeder := func() (seeder *Seeder) {
+		seeder, _ = makeTestSeeder(metadata.Info.HashSHA1, peerId)
+		seeder.PeerId = make([]byte, 20)
+		rand.Read(seeder.PeerId)
+		seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+		seeder.PeerBitfield.Set(3)
+		seeder.PeerChoking = false
+		seeder.AmInterested = true
+		manager.addSeeder(seeder)
+		return seeder
+	}
+
+	slow := makeSeeder()
+	fast := makeSeeder()
+
+	assert.True(t, manager.fillRequests(slow), "nothing is requested")
+	assert.Len(t, slow.requests, 2, "unexpected number of requests")
+	for len(slow.outcoming) > 0 {
+		<-slow.outcoming
+	}
+
+	manager.handleSnubTimer()
+	assert.False(t, slow.snubbed, "peer is snubbed before interval")
+
+	// requests of snubbed peer are cancelled and passed to another peer
+	slow.lastBlock = time.Now().Add(-2 * DefaultSnubInterval)
+	manager.handleSnubTimer()
+	assert.True(t, slow.snubbed, "peer is not snubbed")
+	assert.Len(t, slow.requests, 0, "requests of snubbed peer are not released")
+	assert.Len(t, slow.outcoming, 2, "requests of snubbed peer are not cancelled")
+	assert.EqualValues(t, Cancel, (<-slow.outcoming).Id, "unexpected message")
+	assert.EqualValues(t, Cancel, (<-slow.outcoming).Id, "unexpected message")
+	assert.Len(t, fast.requests, 2, "requests are not passed to another peer")
+
+	manager.releaseRequests(fast)
+	assert.False(t, manager.fillRequests(slow), "snubbed peer is requested")
+
+	// snubbed peer is not unchoked for its rate
+	slow.PeerInterested = true
+	slow.downloadRate = 100
+	fast.PeerInterested = true
+	fast.downloadRate = 10
+	manager.rechoke(false)
+	assert.False(t, fast.AmChoking, "peer is not unchoked")
+	assert.Equal(t, slow, manager.optimisticSeeder, "snubbed peer takes upload slot")
+
+	manager.handleUnchokeMessage(slow)
+	assert.False(t, slow.snubbed, "peer is snubbed after unchoke")
+}
+
+func TestManager_SmartBan(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	tempDir, err := ioutil.TempDir("", "TestManager_SmartBan")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := NewStorage(metadata.Info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	exteriorStorage, err := NewStorage(metadata.Info, "../../test/test_download/")
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+
+	makeSeeder := func(address string) (seeder *Seeder) {
+		seeder, _ = makeTestSeeder(metadata.Info.HashSHA1, peerId)
+		seeder.PeerId = make([]byte, 20)
+		rand.Read(seeder.PeerId)
+		seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+		seeder.Address = address
+		seeder.connection, _ = net.Pipe()
+		manager.addSeeder(seeder)
+		return seeder
+	}
+
+	sendBlock := func(seeder *Seeder, pieceIndex, blockIndex int, corrupt bool) {
+
+		index, offset, length := manager.convertPieceIndexToOffset(pieceIndex, blockIndex)
+
+		data := make([]byte, length)
+		_, err := exteriorStorage.ReadAt(data, int64(index)*metadata.Info.PieceLength+int64(offset))
+		assert.NoError(t, err, "can not read from storage")
+
+		if corrupt {
+			data[0] ^= 0xFF
+		}
+
+		seeder.requests[manager.convertPieceToGlobalBlockIndex(pieceIndex, blockIndex)] = true
+		manager.handlePieceMessage(seeder, MakePiecePayload(index, offset, data))
+	}
+
+	honest := makeSeeder("10.0.0.1:6881")
+	poisoned := makeSeeder("10.0.0.2:6881")
+
+	// the peer is not known when several peers sent the piece
+	sendBlock(honest, 3, 0, false)
+	sendBlock(poisoned, 3, 1, true)
+	assert.False(t, manager.Banned(poisoned.Address), "peer is banned without proof")
+	assert.EqualValues(t, 0, manager.downloadedPieceBitfield.Get(3), "corrupt piece is accepted")
+
+	// the peer is found when the piece is downloaded
+	sendBlock(honest, 3, 0, false)
+	sendBlock(honest, 3, 1, false)
+	assert.EqualValues(t, 1, manager.downloadedPieceBitfield.Get(3), "piece is not accepted")
+	assert.True(t, manager.Banned("10.0.0.2:6882"), "peer is not banned")
+	assert.False(t, manager.Banned(honest.Address), "honest peer is banned")
+
+	_, ok := manager.getSeeder(poisoned.PeerId)
+	assert.False(t, ok, "banned peer is not disconnected")
+	assert.Len(t, manager.failedBlocks, 0, "blocks of verified piece are kept")
+
+	// every peer sent a corrupt block in one of the failed attempts is banned
+	first := makeSeeder("10.0.0.3:6881")
+	second := makeSeeder("10.0.0.4:6881")
+
+	sendBlock(honest, 4, 0, false)
+	sendBlock(first, 4, 1, true)
+	sendBlock(honest, 4, 0, false)
+	sendBlock(second, 4, 1, true)
+	assert.Len(t, manager.failedBlocks[manager.convertPieceToGlobalBlockIndex(4, 1)], 2,
+		"failed attempts are not kept")
+
+	sendBlock(honest, 4, 0, false)
+	sendBlock(honest, 4, 1, false)
+	assert.EqualValues(t, 1, manager.downloadedPieceBitfield.Get(4), "piece is not accepted")
+	assert.True(t, manager.Banned(first.Address), "peer of the first attempt is not banned")
+	assert.True(t, manager.Banned(second.Address), "peer of the second attempt is not banned")
+	assert.False(t, manager.Banned(honest.Address), "honest peer is banned")
+}
+
+func TestManager_AcceptPiece_WriteError(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	storage, err := NewMemoryStorageProvider().OpenTorrent(&metadata.Info, metadata.Info.HashSHA1)
+	assert.NoError(t, err, "can not open storage")
+
+	exteriorStorage, err := NewStorage(metadata.Info, "../../test/test_download/")
+	assert.NoError(t, err, "can not create storage")
+
+	manager := NewManager(make([]byte, 20), metadata.Info.HashSHA1, &metadata.Info, state, storage)
+	manager.cache = newBlockCache(metadata.Info.PieceLength)
+
+	data := make([]byte, metadata.Info.PieceLength)
+	_, err = exteriorStorage.ReadAt(data, 0)
+	assert.NoError(t, err, "can not read from storage")
+
+	// the piece which can not be written stops the torrent instead of panic
+	assert.NoError(t, storage.Close(), "can not close storage")
+
+	for blockIndex := 0; blockIndex < int(manager.blocksPerPiece); blockIndex++ {
+		offset := blockIndex * blockLength
+		manager.acceptPiece(0, blockIndex, data[offset:offset+blockLength])
+	}
+
+	assert.Len(t, manager.Errors, 1, "storage error is not reported")
+	assert.EqualValues(t, 0, manager.downloadedPieceBitfield.Get(0), "not written piece is accepted")
+	assert.True(t, manager.cache.pieces[cacheKey{manager, 0}].isDirty(), "not written piece is not kept")
+}
+
+func TestManager_Idle(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	tempDir, err := ioutil.TempDir("", "TestManager_Idle")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := NewStorage(metadata.Info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+	manager.SetMaxConnections(2)
+
+	makeSeeder := func() (seeder *Seeder) {
+		seeder, _ = makeTestSeeder(metadata.Info.HashSHA1, peerId)
+		seeder.PeerId = make([]byte, 20)
+		rand.Read(seeder.PeerId)
+		seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+		seeder.connection, _ = net.Pipe()
+		manager.addSeeder(seeder)
+		return seeder
+	}
+
+	idle := makeSeeder()
+
+	manager.handleIdleTimer()
+	assert.False(t, idle.uninterestedSince.IsZero(), "uninterested time is not set")
+
+	// idle peer is kept below the connection limit
+	idle.uninterestedSince = time.Now().Add(-2 * uninterestedTimeout)
+	manager.handleIdleTimer()
+	_, ok := manager.getSeeder(idle.PeerId)
+	assert.True(t, ok, "idle peer is disconnected below the limit")
+
+	interested := makeSeeder()
+	interested.PeerInterested = true
+	interested.uninterestedSince = time.Now().Add(-2 * uninterestedTimeout)
+
+	// new connections are refused at the limit
+	interiorConn, _ := net.Pipe()
+	err = manager.AddSeeder(interiorConn, false)
+	assert.Error(t, err, "connection limit is exceeded")
+
+	manager.handleIdleTimer()
+
+	_, ok = manager.getSeeder(idle.PeerId)
+	assert.False(t, ok, "idle peer is not disconnected at the limit")
+
+	_, ok = manager.getSeeder(interested.PeerId)
+	assert.True(t, ok, "interested peer is disconnected")
+	assert.True(t, interested.uninterestedSince.IsZero(), "uninterested time is not reset")
+
+	// only the peer idle for the longest time is disconnected to free one slot
+	manager.SetMaxConnections(3)
+
+	older := makeSeeder()
+	older.uninterestedSince = time.Now().Add(-3 * uninterestedTimeout)
+	newer := makeSeeder()
+	newer.uninterestedSince = time.Now().Add(-2 * uninterestedTimeout)
+
+	manager.handleIdleTimer()
+
+	_, ok = manager.getSeeder(older.PeerId)
+	assert.False(t, ok, "oldest idle peer is not disconnected")
+
+	_, ok = manager.getSeeder(newer.PeerId)
+	assert.True(t, ok, "idle peer is disconnected below the limit")
+}
+
+func TestManager_Recheck(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	storage, err := NewStorage(metadata.Info, "../../test/test_download/")
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+
+	err = manager.Recheck()
+	assert.NoError(t, err, "recheck finished with error")
+
+	assert.EqualValues(t, metadata.Info.PieceCount, manager.downloadedPieceBitfield.Count(1), "pieces are not verified")
+	assert.EqualValues(t, manager.blockCount, manager.downloadedBlockBitfield.Count(1), "blocks are not restored")
+	assert.EqualValues(t, 0, state.Left(), "left is not restored")
+	assert.EqualValues(t, manager.downloadedPieceBitfield.Bytes(), state.BitfieldBytes(), "state bitfield differs")
+
+	// restored pieces are advertised to peers without fast extension
+	seeder, _ := makeTestSeeder(metadata.Info.HashSHA1, peerId)
+	seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+
+	interiorConn, exteriorConn := net.Pipe()
+	seeder.connection = interiorConn
+
+	manager.handleAdding(seeder)
+
+	_ = exteriorConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buffer := make([]byte, 5+len(state.BitfieldBytes()))
+	n, err := io.ReadFull(exteriorConn, buffer)
+	assert.NoError(t, err, fmt.Sprintf("can not read bitfield: n = %d", n))
+	assert.EqualValues(t, Bitfield, buffer[4], "wrong message id")
+	assert.EqualValues(t, state.BitfieldBytes(), buffer[5:], "wrong bitfield")
+
+	seeder.Close()
+}
+
+func TestManager_Resume(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	tempDir, err := ioutil.TempDir("", "TestManager_Resume")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := NewStorage(metadata.Info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	exteriorStorage, err := NewStorage(metadata.Info, "../../test/test_download/")
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+
+	seeder, _ := makeTestSeeder(metadata.Info.HashSHA1, peerId)
+	seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+	seeder.connection, _ = net.Pipe()
+	manager.addSeeder(seeder)
+
+	sendBlock := func(pieceIndex, blockIndex int) {
+
+		index, offset, length := manager.convertPieceIndexToOffset(pieceIndex, blockIndex)
+
+		data := make([]byte, length)
+		_, err := exteriorStorage.ReadAt(data, int64(index)*metadata.Info.PieceLength+int64(offset))
+		assert.NoError(t, err, "can not read from storage")
+
+		seeder.requests[manager.convertPieceToGlobalBlockIndex(pieceIndex, blockIndex)] = true
+		manager.handlePieceMessage(seeder, MakePiecePayload(index, offset, data))
+	}
+
+	for blockIndex := 0; blockIndex < int(manager.blocksPerPiece); blockIndex++ {
+		sendBlock(3, blockIndex)
+	}
+	sendBlock(5, 0)
+
+	state.IncrementUploaded(1000)
+
+	resumePath := path.Join(tempDir, "resume")
+	manager.SetResumePath(resumePath)
+	assert.NoError(t, manager.saveResume(), "can not save resume data")
+
+	restoredState := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+	restored := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, restoredState, storage)
+
+	err = restored.LoadResume(resumePath)
+	assert.NoError(t, err, "can not load resume data")
+
+	assert.EqualValues(t, 1, restored.downloadedPieceBitfield.Get(3), "piece is not restored")
+	assert.EqualValues(t, 1, restored.downloadedPieceBitfield.Count(1), "unexpected pieces are restored")
+	assert.EqualValues(t, 1, restored.downloadedBlockBitfield.Get(uint(restored.convertPieceToGlobalBlockIndex(5, 0))),
+		"block of incomplete piece is not restored")
+	assert.EqualValues(t, restored.blocksPerPiece-1, restored.pieceDownloadProgress[5], "piece progress is not restored")
+	assert.EqualValues(t, state.Left(), restoredState.Left(), "left is not restored")
+	assert.EqualValues(t, state.Downloaded(), restoredState.Downloaded(), "downloaded is not restored")
+	assert.EqualValues(t, 1000, restoredState.Uploaded(), "uploaded is not restored")
+
+	// modified files make the resume data stale
+	modTime := time.Now().Add(time.Hour)
+	err = os.Chtimes(storage.files[0].Name(), modTime, modTime)
+	assert.NoError(t, err, "can not change modification time")
+
+	stale := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info,
+		NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount)), storage)
+
+	err = stale.LoadResume(resumePath)
+	assert.Error(t, err, "stale resume data is loaded")
+	assert.EqualValues(t, 0, stale.downloadedPieceBitfield.Count(1), "stale resume data is applied")
+}
+
+func TestManager_Priorities(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	tempDir, err := ioutil.TempDir("", "TestManager_Priorities")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := newStorage(metadata.Info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+
+	assert.NoError(t, manager.SetFilePriority(1, PrioritySkip), "can not set priority")
+	assert.NoError(t, manager.SetFilePriority(2, PriorityHigh), "can not set priority")
+	assert.Error(t, manager.SetFilePriority(3, PriorityHigh), "priority of absent file is set")
+
+	assert.NoError(t, manager.openFiles(), "can not open files")
+	_, err = os.Stat(storage.paths[1])
+	assert.True(t, os.IsNotExist(err), "skipped file is created")
+
+	manager.handlePriorityChange()
+
+	seeder, _ := makeTestSeeder(metadata.Info.HashSHA1, peerId)
+	seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+	seeder.connection, _ = net.Pipe()
+	seeder.PeerChoking = false
+	manager.addSeeder(seeder)
+
+	piecesPerFile := int(metadata.Info.Files[0].Length / metadata.Info.PieceLength)
+
+	for index := uint(0); index < uint(metadata.Info.PieceCount); index++ {
+		manager.setPeerPiece(seeder, index)
+	}
+
+	// pieces of the high priority file are requested first, skipped file is not requested
+	for i := 0; i < int(manager.blockCount); i++ {
+
+		pieceIndex, _, ok := manager.requestPiece(seeder)
+		if !ok {
+			break
+		}
+
+		assert.False(t, pieceIndex >= piecesPerFile && pieceIndex < 2*piecesPerFile,
+			"piece of skipped file is requested")
+
+		if i < piecesPerFile*int(manager.blocksPerPiece) {
+			assert.True(t, pieceIndex >= 2*piecesPerFile, "piece of high priority file is not requested first")
+		}
+	}
+
+	assert.EqualValues(t, 2*piecesPerFile*int(manager.blocksPerPiece), len(seeder.requests),
+		"unexpected number of requests")
+
+	for pieceIndex := 0; pieceIndex < int(metadata.Info.PieceCount); pieceIndex++ {
+		if pieceIndex < piecesPerFile || pieceIndex >= 2*piecesPerFile {
+			manager.restorePiece(pieceIndex)
+		}
+	}
+
+	manager.checkCompleted()
+	assert.True(t, manager.completed(), "wanted pieces are not completed")
+	assert.Len(t, manager.Done, 1, "completion is not signalled")
+
+	// the download is continued when skipped file becomes wanted
+	assert.NoError(t, manager.SetFilePriority(1, PriorityLow), "can not set priority")
+	manager.handlePriorityChange()
+	assert.False(t, manager.completed(), "download is completed with wanted file")
+
+	_, err = os.Stat(storage.paths[1])
+	assert.NoError(t, err, "wanted file is not created")
+}
+
+func TestManager_Priorities_Boundaries(t *testing.T) {
+
+	pieceLength := int64(2 * blockLength)
+
+	info := Info{
+		PieceLength: pieceLength,
+		PieceCount:  3,
+		TotalLength: 3 * pieceLength,
+		Files: []FileInfo{
+			{Length: pieceLength + pieceLength/4, Path: []string{"first"}},
+			{Length: pieceLength / 2, Path: []string{"second"}},
+			{Length: pieceLength + pieceLength/4, Path: []string{"third"}},
+		},
+	}
+
+	tempDir, err := ioutil.TempDir("", "TestManager_Priorities_Boundaries")
+	assert.NoError(t, err, "can not temp dir")
+
+	storage, err := newStorage(info, tempDir)
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, make([]byte, 20), &info, NewState(uint64(info.TotalLength), 3), storage)
+
+	// piece shared with wanted files is wanted
+	assert.NoError(t, manager.SetFilePriority(1, PrioritySkip), "can not set priority")
+	manager.updatePriorities()
+	assert.EqualValues(t, []Priority{PriorityNormal, PriorityNormal, PriorityNormal}, manager.piecePriorities,
+		"wrong piece priorities")
+
+	// the highest priority of the files is used
+	assert.NoError(t, manager.SetFilePriority(0, PrioritySkip), "can not set priority")
+	assert.NoError(t, manager.SetFilePriority(1, PriorityHigh), "can not set priority")
+	assert.NoError(t, manager.SetFilePriority(2, PriorityLow), "can not set priority")
+	manager.updatePriorities()
+	assert.EqualValues(t, []Priority{PrioritySkip, PriorityHigh, PriorityLow}, manager.piecePriorities,
+		"wrong piece priorities")
+}
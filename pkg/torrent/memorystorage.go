@@ -0,0 +1,135 @@
+package torrent
+
+import (
+	"github.com/juju/errors"
+	"sync"
+)
+
+type memoryStorageProvider struct{}
+
+// NewMemoryStorageProvider returns the provider of the storages keeping the data in memory,
+// the data is lost when the storage is closed
+func NewMemoryStorageProvider() StorageProvider {
+	return memoryStorageProvider{}
+}
+
+func (p memoryStorageProvider) OpenTorrent(info *Info, infoHash []byte) (TorrentStorage, error) {
+	return newMemoryStorage(info), nil
+}
+
+// memoryStorage allocates the pieces when they are written,
+// not written data is zero
+type memoryStorage struct {
+	pieceLength     int64
+	lastPieceLength int64
+	pieceCount      int
+
+	pieces map[int][]byte
+	mutex  sync.RWMutex
+}
+
+func newMemoryStorage(info *Info) (s *memoryStorage) {
+
+	s = new(memoryStorage)
+
+	s.pieceLength = info.PieceLength
+	s.pieceCount = int(info.PieceCount)
+
+	s.lastPieceLength = info.TotalLength % info.PieceLength
+	if s.lastPieceLength == 0 {
+		s.lastPieceLength = info.PieceLength
+	}
+
+	s.pieces = make(map[int][]byte)
+
+	return s
+}
+
+func (s *memoryStorage) Piece(index int) PieceStorage {
+	return memoryPiece{s, index}
+}
+
+func (s *memoryStorage) Flush() error {
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pieces = nil
+
+	return nil
+}
+
+func (s *memoryStorage) checkPiece(index int, off int64, length int) (err error) {
+
+	if s.pieces == nil {
+		return errors.Errorf("check piece: storage is closed")
+	}
+
+	if index < 0 || index >= s.pieceCount {
+		return errors.Errorf("check piece: piece %d is out of range", index)
+	}
+
+	pieceLength := s.pieceLength
+	if index == s.pieceCount-1 {
+		pieceLength = s.lastPieceLength
+	}
+
+	if off < 0 || off+int64(length) > pieceLength {
+		return errors.Errorf("check piece: data %d+%d is out of piece", off, length)
+	}
+
+	return nil
+}
+
+type memoryPiece struct {
+	storage *memoryStorage
+	index   int
+}
+
+func (p memoryPiece) ReadAt(b []byte, off int64) (n int, err error) {
+
+	p.storage.mutex.RLock()
+	defer p.storage.mutex.RUnlock()
+
+	err = p.storage.checkPiece(p.index, off, len(b))
+	if err != nil {
+		return 0, errors.Annotate(err, "memory storage read at")
+	}
+
+	data, ok := p.storage.pieces[p.index]
+	if !ok {
+		for i := range b {
+			b[i] = 0
+		}
+		return len(b), nil
+	}
+
+	return copy(b, data[off:]), nil
+}
+
+func (p memoryPiece) WriteAt(b []byte, off int64) (n int, err error) {
+
+	p.storage.mutex.Lock()
+	defer p.storage.mutex.Unlock()
+
+	err = p.storage.checkPiece(p.index, off, len(b))
+	if err != nil {
+		return 0, errors.Annotate(err, "memory storage write at")
+	}
+
+	data, ok := p.storage.pieces[p.index]
+	if !ok {
+		data = make([]byte, p.storage.pieceLength)
+		p.storage.pieces[p.index] = data
+	}
+
+	return copy(data[off:], b), nil
+}
+
+func (p memoryPiece) MarkComplete() error {
+	return nil
+}
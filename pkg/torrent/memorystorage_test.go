@@ -0,0 +1,89 @@
+package torrent
+
+import (
+	"github.com/lezhenin/gotorrentclient/pkg/bitfield"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+
+	info := Info{PieceLength: 2 * blockSize, PieceCount: 3, TotalLength: 5 * blockSize}
+
+	storage, err := NewMemoryStorageProvider().OpenTorrent(&info, make([]byte, 20))
+	assert.NoError(t, err, "can not open storage")
+
+	data := make([]byte, blockSize)
+	rand.Read(data)
+
+	// not written data is zero
+	readData := make([]byte, blockSize)
+	n, err := storage.Piece(1).ReadAt(readData, blockSize)
+	assert.NoError(t, err, "can not read from storage")
+	assert.EqualValues(t, blockSize, n, "read bytes != block size")
+	assert.EqualValues(t, make([]byte, blockSize), readData, "not written data is not zero")
+
+	n, err = storage.Piece(1).WriteAt(data, blockSize)
+	assert.NoError(t, err, "can not write to storage")
+	assert.EqualValues(t, blockSize, n, "write bytes != block size")
+
+	_, err = storage.Piece(1).ReadAt(readData, blockSize)
+	assert.NoError(t, err, "can not read from storage")
+	assert.EqualValues(t, data, readData, "bytes doesnt match")
+
+	// the last piece is shorter
+	_, err = storage.Piece(2).WriteAt(data, blockSize)
+	assert.Error(t, err, "write out of boundaries")
+
+	_, err = storage.Piece(3).ReadAt(readData, 0)
+	assert.Error(t, err, "read out of boundaries")
+
+	assert.NoError(t, storage.Close(), "can not close storage")
+
+	_, err = storage.Piece(1).ReadAt(readData, 0)
+	assert.Error(t, err, "read from closed storage")
+}
+
+func TestManager_MemoryStorage(t *testing.T) {
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	storage, err := NewMemoryStorageProvider().OpenTorrent(&metadata.Info, metadata.Info.HashSHA1)
+	assert.NoError(t, err, "can not open storage")
+
+	exteriorStorage, err := NewStorage(metadata.Info, "../../test/test_download/")
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+	assert.NoError(t, manager.openFiles(), "can not open files")
+
+	seeder, _ := makeTestSeeder(metadata.Info.HashSHA1, peerId)
+	seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+	seeder.connection, _ = net.Pipe()
+	manager.addSeeder(seeder)
+
+	pieceData := make([]byte, metadata.Info.PieceLength)
+	_, err = exteriorStorage.Piece(3).ReadAt(pieceData, 0)
+	assert.NoError(t, err, "can not read from storage")
+
+	for blockIndex := 0; blockIndex < int(manager.blocksPerPiece); blockIndex++ {
+		index, offset, length := manager.convertPieceIndexToOffset(3, blockIndex)
+		seeder.requests[manager.convertPieceToGlobalBlockIndex(3, blockIndex)] = true
+		manager.handlePieceMessage(seeder, MakePiecePayload(index, offset, pieceData[offset:offset+length]))
+	}
+
+	assert.EqualValues(t, 1, manager.downloadedPieceBitfield.Get(3), "piece is not accepted")
+
+	readData := make([]byte, metadata.Info.PieceLength)
+	_, err = storage.Piece(3).ReadAt(readData, 0)
+	assert.NoError(t, err, "can not read from storage")
+	assert.EqualValues(t, pieceData, readData, "bytes doesnt match")
+}
@@ -26,6 +26,7 @@ type Info struct {
 	Files       []FileInfo
 	HashSHA1    []byte
 	TotalLength int64
+	Bytes       []byte
 }
 
 type Metadata struct {
@@ -37,6 +38,7 @@ type Metadata struct {
 	CreatedBy    string
 	Encoding     string
 	FileName     string
+	Peers        []string
 }
 
 type DecodeError struct {
@@ -157,6 +159,7 @@ func infoDictToStruct(infoDict map[string]interface{}) (info Info, err error) {
 	hash := sha1.New()
 	hash.Write(data)
 	info.HashSHA1 = hash.Sum(nil)
+	info.Bytes = data
 
 	info.PieceLength, err = getInt(infoDict, "piece length")
 	if err != nil {
@@ -0,0 +1,340 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/bencode"
+	"net"
+	"time"
+)
+
+const metadataPieceLength = 16 * 1024
+const maxMetadataSize = 16 * 1024 * 1024
+
+const metadataExchangeTimeout = 30
+const maxMetadataPeers = 32
+
+// left announced while the torrent size is unknown, other clients announce the same placeholder
+const unknownLeft = 16 * 1024
+
+const utMetadataName = "ut_metadata"
+
+const extendedHandshakeId byte = 0
+
+const (
+	metadataRequest int64 = 0
+	metadataData    int64 = 1
+	metadataReject  int64 = 2
+)
+
+// metadataExtension serves info dictionary to peers (BEP 9), fetcher
+// is created for a single connection and requests info dictionary from the peer
+type metadataExtension struct {
+	infoHash  []byte
+	infoBytes []byte
+
+	received []byte
+	piece    int64
+
+	done chan error
+}
+
+func newMetadataExtension(infoHash, infoBytes []byte) *metadataExtension {
+	return &metadataExtension{infoHash: infoHash, infoBytes: infoBytes}
+}
+
+func newMetadataFetcher(infoHash []byte) *metadataExtension {
+	return &metadataExtension{infoHash: infoHash, done: make(chan error, 1)}
+}
+
+func (e *metadataExtension) Name() string {
+	return utMetadataName
+}
+
+func (e *metadataExtension) ExtendHandshake(handshake map[string]interface{}) {
+	if e.infoBytes != nil {
+		handshake["metadata_size"] = int64(len(e.infoBytes))
+	}
+}
+
+func (e *metadataExtension) HandleHandshake(seeder *Seeder, handshake dictionary) (err error) {
+
+	if e.done == nil || e.received != nil {
+		return nil
+	}
+
+	if !seeder.PeerSupports(utMetadataName) {
+		e.finish(errors.Errorf("peer doesn't support %s", utMetadataName))
+		return nil
+	}
+
+	metadataSize, err := getInt(handshake, "metadata_size")
+	if err != nil {
+		e.finish(err)
+		return errors.Annotate(err, "metadata handshake")
+	}
+
+	if metadataSize <= 0 || metadataSize > maxMetadataSize {
+		err = errors.Errorf("metadata handshake: unexpected metadata size %d", metadataSize)
+		e.finish(err)
+		return err
+	}
+
+	e.received = make([]byte, 0, metadataSize)
+	e.piece = 0
+
+	return e.request(seeder)
+}
+
+func (e *metadataExtension) HandleMessage(seeder *Seeder, payload []byte) (err error) {
+
+	messageType, piece, totalSize, data, err := parseMetadataPayload(payload)
+	if err != nil {
+		return errors.Annotate(err, "metadata message")
+	}
+
+	switch messageType {
+
+	case metadataRequest:
+
+		begin := piece * metadataPieceLength
+		if e.infoBytes == nil || piece < 0 || begin >= int64(len(e.infoBytes)) {
+			return seeder.SendExtended(utMetadataName,
+				makeMetadataPayload(metadataReject, piece, 0, nil))
+		}
+
+		end := begin + metadataPieceLength
+		if end > int64(len(e.infoBytes)) {
+			end = int64(len(e.infoBytes))
+		}
+
+		return seeder.SendExtended(utMetadataName,
+			makeMetadataPayload(metadataData, piece, int64(len(e.infoBytes)), e.infoBytes[begin:end]))
+
+	case metadataReject:
+
+		if e.done != nil {
+			e.finish(errors.Errorf("peer rejected piece %d", piece))
+		}
+
+	case metadataData:
+
+		if e.done == nil || e.received == nil || piece != e.piece {
+			return nil
+		}
+
+		expectedLength := int64(cap(e.received)) - piece*metadataPieceLength
+		if expectedLength > metadataPieceLength {
+			expectedLength = metadataPieceLength
+		}
+
+		if totalSize != int64(cap(e.received)) || int64(len(data)) != expectedLength {
+			err = errors.Errorf("metadata message: piece %d has unexpected length", piece)
+			e.finish(err)
+			return err
+		}
+
+		e.received = append(e.received, data...)
+
+		if len(e.received) < cap(e.received) {
+			e.piece += 1
+			return e.request(seeder)
+		}
+
+		hash := sha1.Sum(e.received)
+		if bytes.Compare(hash[:], e.infoHash) != 0 {
+			e.finish(errors.Errorf("info hash doesn't match"))
+			return nil
+		}
+
+		e.infoBytes = e.received
+		e.finish(nil)
+	}
+
+	return nil
+}
+
+func (e *metadataExtension) request(seeder *Seeder) (err error) {
+
+	err = seeder.SendExtended(utMetadataName, makeMetadataPayload(metadataRequest, e.piece, 0, nil))
+	if err != nil {
+		e.finish(err)
+		return errors.Annotate(err, "metadata request")
+	}
+
+	return nil
+}
+
+func (e *metadataExtension) finish(err error) {
+	select {
+	case e.done <- err:
+	default:
+	}
+}
+
+func makeMetadataPayload(messageType, piece, totalSize int64, data []byte) (payload []byte) {
+
+	message := map[string]interface{}{
+		"msg_type": messageType,
+		"piece":    piece,
+	}
+
+	if messageType == metadataData {
+		message["total_size"] = totalSize
+	}
+
+	payload, err := bencode.EncodeBytes(message)
+	if err != nil {
+		panic(err)
+	}
+
+	return append(payload, data...)
+}
+
+// parseMetadataPayload decodes ut_metadata message (BEP 9),
+// the data of a piece follows the bencoded dictionary
+func parseMetadataPayload(payload []byte) (messageType, piece, totalSize int64, data []byte, err error) {
+
+	decoder := bencode.NewDecoder(bytes.NewReader(payload))
+
+	var message interface{}
+
+	err = decoder.Decode(&message)
+	if err != nil {
+		return 0, 0, 0, nil, errors.Annotate(err, "parse metadata message")
+	}
+
+	messageDict, ok := message.(map[string]interface{})
+	if !ok {
+		return 0, 0, 0, nil, errors.Annotate(DecodeError{message, "message"},
+			"parse metadata message")
+	}
+
+	messageType, err = getInt(messageDict, "msg_type")
+	if err != nil {
+		return 0, 0, 0, nil, errors.Annotate(err, "parse metadata message")
+	}
+
+	piece, err = getInt(messageDict, "piece")
+	if err != nil {
+		return 0, 0, 0, nil, errors.Annotate(err, "parse metadata message")
+	}
+
+	if messageType == metadataData {
+		totalSize, err = getInt(messageDict, "total_size")
+		if err != nil {
+			return 0, 0, 0, nil, errors.Annotate(err, "parse metadata message")
+		}
+		data = payload[decoder.BytesParsed():]
+	}
+
+	return messageType, piece, totalSize, data, nil
+}
+
+// fetchMetadata downloads info dictionary from the peer and checks it against info hash
+func fetchMetadata(connection net.Conn, infoHash, peerId []byte) (infoBytes []byte, err error) {
+
+	incoming := make(chan Message, messageBufferLength)
+
+	seeder, err := NewSeeder(infoHash, peerId, incoming)
+	if err != nil {
+		return nil, errors.Annotate(err, "fetch metadata")
+	}
+
+	fetcher := newMetadataFetcher(infoHash)
+	seeder.EnableExtensions(NewExtensionRegistry(fetcher))
+
+	err = seeder.Dial(connection)
+	if err != nil {
+		_ = connection.Close()
+		return nil, errors.Annotate(err, "fetch metadata")
+	}
+
+	if !seeder.SupportsExtensions() {
+		seeder.Close()
+		return nil, errors.Errorf("fetch metadata: peer doesn't support extension protocol")
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		seeder.Start()
+		close(done)
+	}()
+
+	defer seeder.Close()
+
+	timer := time.NewTimer(metadataExchangeTimeout * time.Second)
+	defer timer.Stop()
+
+	for {
+
+		select {
+
+		// other messages of the peer are not needed
+		case <-incoming:
+
+		case err = <-fetcher.done:
+
+			if err != nil {
+				return nil, errors.Annotate(err, "fetch metadata")
+			}
+
+			seederLogger.WithFields(logrus.Fields{
+				"peer":     seeder.PeerId,
+				"infoHash": infoHash,
+				"size":     len(fetcher.infoBytes),
+			}).Info("metadata received")
+
+			return fetcher.infoBytes, nil
+
+		case <-done:
+			return nil, errors.Errorf("fetch metadata: connection closed")
+
+		case <-timer.C:
+			return nil, errors.Errorf("fetch metadata: timeout")
+		}
+	}
+}
+
+// fetchMetadataFromPeers tries the peers concurrently and returns the first verified metadata
+func fetchMetadataFromPeers(peers []string, infoHash, peerId []byte) (infoBytes []byte, err error) {
+
+	if len(peers) > maxMetadataPeers {
+		peers = peers[:maxMetadataPeers]
+	}
+
+	results := make(chan []byte, len(peers))
+
+	for _, peer := range peers {
+		go func(peer string) {
+
+			conn, err := net.DialTimeout("tcp", peer, time.Second)
+			if err != nil {
+				results <- nil
+				return
+			}
+
+			infoBytes, err := fetchMetadata(conn, infoHash, peerId)
+			if err != nil {
+				seederLogger.WithFields(logrus.Fields{
+					"address":  peer,
+					"infoHash": infoHash,
+				}).Debug(err.Error())
+			}
+
+			results <- infoBytes
+		}(peer)
+	}
+
+	for range peers {
+		infoBytes = <-results
+		if infoBytes != nil {
+			return infoBytes, nil
+		}
+	}
+
+	return nil, errors.Errorf("fetch metadata from peers: no peer sent metadata")
+}
@@ -0,0 +1,228 @@
+package torrent
+
+import (
+	"github.com/juju/errors"
+	"os"
+	"sync"
+)
+
+// the files are mapped in chunks, so the files larger than the address space
+// can be mapped, the chunk size is a multiple of the page size
+const (
+	mmapChunkSize   = 64 << 20
+	maxMappedChunks = 16
+)
+
+type mmapStorageProvider struct {
+	basePath string
+}
+
+// NewMmapStorageProvider returns the provider of the storages keeping the data
+// in the files of the torrent in the directory, the opened files are accessed
+// through memory mappings and the pieces are synced to the disk when they are verified
+func NewMmapStorageProvider(basePath string) StorageProvider {
+	return mmapStorageProvider{basePath}
+}
+
+func (p mmapStorageProvider) OpenTorrent(info *Info, infoHash []byte) (TorrentStorage, error) {
+
+	if !mmapSupported {
+		return nil, errors.Errorf("mmap storage: memory mappings are not supported")
+	}
+
+	s, err := newStorage(*info, p.basePath)
+	if err != nil {
+		return nil, errors.Annotate(err, "mmap storage")
+	}
+
+	s.mapper = newFileMapper(mmapChunkSize, maxMappedChunks)
+
+	return s, nil
+}
+
+type chunkKey struct {
+	file  *os.File
+	index int64
+}
+
+type mappedChunk struct {
+	data     []byte
+	lastUsed uint64
+}
+
+// fileMapper maps the chunks of the files when they are accessed,
+// the least recently used chunk is unmapped when too many chunks are mapped
+type fileMapper struct {
+	chunkSize int64
+	maxChunks int
+
+	chunks map[chunkKey]*mappedChunk
+	uses   uint64
+
+	mutex sync.Mutex
+}
+
+func newFileMapper(chunkSize int64, maxChunks int) *fileMapper {
+	return &fileMapper{
+		chunkSize: chunkSize,
+		maxChunks: maxChunks,
+		chunks:    make(map[chunkKey]*mappedChunk),
+	}
+}
+
+// chunk returns the mapping of the chunk, the length of the last chunk
+// of the file is the rest of the file
+func (fm *fileMapper) chunk(file *os.File, fileLength, index int64) (data []byte, err error) {
+
+	key := chunkKey{file, index}
+
+	fm.uses += 1
+
+	chunk, ok := fm.chunks[key]
+	if ok {
+		chunk.lastUsed = fm.uses
+		return chunk.data, nil
+	}
+
+	if len(fm.chunks) >= fm.maxChunks {
+		err = fm.evict()
+		if err != nil {
+			return nil, errors.Annotate(err, "file mapper chunk")
+		}
+	}
+
+	length := fileLength - index*fm.chunkSize
+	if length > fm.chunkSize {
+		length = fm.chunkSize
+	}
+
+	data, err = mmapFile(file, index*fm.chunkSize, int(length))
+	if err != nil {
+		return nil, errors.Annotate(err, "file mapper chunk")
+	}
+
+	fm.chunks[key] = &mappedChunk{data, fm.uses}
+
+	return data, nil
+}
+
+// evict unmaps the least recently used chunk, the pages written
+// through the mapping stay in the page cache
+func (fm *fileMapper) evict() (err error) {
+
+	var oldestKey chunkKey
+	var oldest *mappedChunk
+
+	for key, chunk := range fm.chunks {
+		if oldest == nil || chunk.lastUsed < oldest.lastUsed {
+			oldestKey, oldest = key, chunk
+		}
+	}
+
+	delete(fm.chunks, oldestKey)
+
+	return munmapFile(oldest.data)
+}
+
+// copy copies the data between the buffer and the file at the offset in the file,
+// the data is written to the file if write is set
+func (fm *fileMapper) copy(file *os.File, fileLength int64, b []byte, off int64, write bool) (err error) {
+
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	for len(b) > 0 {
+
+		index := off / fm.chunkSize
+
+		data, err := fm.chunk(file, fileLength, index)
+		if err != nil {
+			return errors.Annotate(err, "file mapper copy")
+		}
+
+		data = data[off-index*fm.chunkSize:]
+
+		n := 0
+		if write {
+			n = copy(data, b)
+		} else {
+			n = copy(b, data)
+		}
+
+		b = b[n:]
+		off += int64(n)
+	}
+
+	return nil
+}
+
+// sync writes the mapped pages of the file range to the disk,
+// not mapped chunks have nothing to sync
+func (fm *fileMapper) sync(file *os.File, off, length int64) (err error) {
+
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	pageSize := int64(os.Getpagesize())
+	end := off + length
+
+	for index := off / fm.chunkSize; index*fm.chunkSize < end; index++ {
+
+		chunk, ok := fm.chunks[chunkKey{file, index}]
+		if !ok {
+			continue
+		}
+
+		chunkOffset := index * fm.chunkSize
+
+		start := int64(0)
+		if off > chunkOffset {
+			start = (off - chunkOffset) / pageSize * pageSize
+		}
+
+		stop := int64(len(chunk.data))
+		if end-chunkOffset < stop {
+			stop = end - chunkOffset
+		}
+
+		err = msyncData(chunk.data[start:stop])
+		if err != nil {
+			return errors.Annotate(err, "file mapper sync")
+		}
+	}
+
+	return nil
+}
+
+// syncAll writes all mapped pages to the disk
+func (fm *fileMapper) syncAll() (err error) {
+
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	for _, chunk := range fm.chunks {
+		err = msyncData(chunk.data)
+		if err != nil {
+			return errors.Annotate(err, "file mapper sync all")
+		}
+	}
+
+	return nil
+}
+
+// close unmaps all chunks, the files are closed by the storage
+func (fm *fileMapper) close() (err error) {
+
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	for key, chunk := range fm.chunks {
+		unmapErr := munmapFile(chunk.data)
+		if unmapErr != nil && err == nil {
+			err = errors.Annotate(unmapErr, "file mapper close")
+		}
+		delete(fm.chunks, key)
+	}
+
+	return err
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package torrent
+
+import (
+	"github.com/juju/errors"
+	"os"
+)
+
+const mmapSupported = false
+
+func mmapFile(file *os.File, offset int64, length int) ([]byte, error) {
+	return nil, errors.Errorf("mmap file: not supported")
+}
+
+func munmapFile(data []byte) error {
+	return errors.Errorf("munmap file: not supported")
+}
+
+func msyncData(data []byte) error {
+	return errors.Errorf("msync data: not supported")
+}
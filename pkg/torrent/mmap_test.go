@@ -0,0 +1,125 @@
+package torrent
+
+import (
+	"github.com/lezhenin/gotorrentclient/pkg/bitfield"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStorage_Mmap(t *testing.T) {
+
+	if !mmapSupported {
+		t.Skip("memory mappings are not supported")
+	}
+
+	dir, err := ioutil.TempDir("", "TestStorage_Mmap")
+	assert.NoError(t, err, "can not create directory")
+	defer os.RemoveAll(dir)
+
+	info, filenames := makeTestInfo()
+	info.PieceLength = 2 * blockSize
+
+	storage, err := newStorage(info, dir)
+	assert.NoError(t, err, "can not create storage")
+
+	// several chunks per file and less mapped chunks than the files
+	storage.mapper = newFileMapper(int64(os.Getpagesize()), 2)
+
+	for index := range info.Files {
+		assert.NoError(t, storage.openFile(index, true), "can not open file")
+	}
+
+	data := make([]byte, 3*fileSize)
+	rand.Read(data)
+
+	// the writes cross the chunks and the files
+	for offset := 0; offset < len(data); offset += 3 * blockSize / 2 {
+		end := offset + 3*blockSize/2
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := storage.WriteAt(data[offset:end], int64(offset))
+		assert.NoError(t, err, "can not write to storage")
+		assert.EqualValues(t, end-offset, n, "write bytes != length")
+	}
+
+	assert.True(t, len(storage.mapper.chunks) <= 2, "too many chunks are mapped")
+
+	readData := make([]byte, fileSize+blockSize)
+	n, err := storage.ReadAt(readData, fileSize-blockSize/2)
+	assert.NoError(t, err, "can not read from storage")
+	assert.EqualValues(t, len(readData), n, "read bytes != length")
+	assert.EqualValues(t, data[fileSize-blockSize/2:2*fileSize+blockSize/2], readData, "bytes doesnt match")
+
+	assert.NoError(t, storage.Piece(1).MarkComplete(), "can not sync piece")
+	assert.NoError(t, storage.Flush(), "can not flush storage")
+
+	// the files read without mappings contain the written data
+	for index, filename := range filenames {
+		fileData, err := ioutil.ReadFile(path.Join(dir, info.Name, filename))
+		assert.NoError(t, err, "can not read file")
+		assert.EqualValues(t, data[index*fileSize:(index+1)*fileSize], fileData, "bytes doesnt match")
+	}
+
+	assert.NoError(t, storage.Close(), "can not close storage")
+	assert.Empty(t, storage.mapper.chunks, "chunks are not unmapped")
+
+	_, err = storage.ReadAt(readData, 0)
+	assert.Error(t, err, "read from closed storage")
+}
+
+func TestManager_MmapStorage(t *testing.T) {
+
+	if !mmapSupported {
+		t.Skip("memory mappings are not supported")
+	}
+
+	metadata, err := NewMetadata("../../test/test_download/test_data_localhost.torrent")
+	assert.NoError(t, err, "can not decode metadata")
+
+	dir, err := ioutil.TempDir("", "TestManager_MmapStorage")
+	assert.NoError(t, err, "can not create directory")
+	defer os.RemoveAll(dir)
+
+	state := NewState(uint64(metadata.Info.TotalLength), uint(metadata.Info.PieceCount))
+
+	storage, err := NewMmapStorageProvider(dir).OpenTorrent(&metadata.Info, metadata.Info.HashSHA1)
+	assert.NoError(t, err, "can not open storage")
+	defer storage.Close()
+
+	exteriorStorage, err := NewStorage(metadata.Info, "../../test/test_download/")
+	assert.NoError(t, err, "can not create storage")
+
+	peerId := make([]byte, 20)
+	rand.Read(peerId)
+
+	manager := NewManager(peerId, metadata.Info.HashSHA1, &metadata.Info, state, storage)
+	assert.NoError(t, manager.openFiles(), "can not open files")
+
+	seeder, _ := makeTestSeeder(metadata.Info.HashSHA1, peerId)
+	seeder.PeerBitfield = bitfield.NewBitfield(uint(metadata.Info.PieceCount))
+	seeder.connection, _ = net.Pipe()
+	manager.addSeeder(seeder)
+
+	pieceData := make([]byte, metadata.Info.PieceLength)
+	_, err = exteriorStorage.Piece(5).ReadAt(pieceData, 0)
+	assert.NoError(t, err, "can not read from storage")
+
+	for blockIndex := 0; blockIndex < int(manager.blocksPerPiece); blockIndex++ {
+		index, offset, length := manager.convertPieceIndexToOffset(5, blockIndex)
+		seeder.requests[manager.convertPieceToGlobalBlockIndex(5, blockIndex)] = true
+		manager.handlePieceMessage(seeder, MakePiecePayload(index, offset, pieceData[offset:offset+length]))
+	}
+
+	assert.EqualValues(t, 1, manager.downloadedPieceBitfield.Get(5), "piece is not accepted")
+
+	readData := make([]byte, metadata.Info.PieceLength)
+	_, err = storage.Piece(5).ReadAt(readData, 0)
+	assert.NoError(t, err, "can not read from storage")
+	assert.EqualValues(t, pieceData, readData, "bytes doesnt match")
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package torrent
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+const mmapSupported = true
+
+func mmapFile(file *os.File, offset int64, length int) ([]byte, error) {
+	return unix.Mmap(int(file.Fd()), offset, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return unix.Munmap(data)
+}
+
+func msyncData(data []byte) error {
+	return unix.Msync(data, unix.MS_SYNC)
+}
@@ -0,0 +1,382 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"github.com/juju/errors"
+	"github.com/zeebo/bencode"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const utPexName = "ut_pex"
+
+const pexInterval = 60 * time.Second
+
+// peer exchange message contains at most 50 added and 50 dropped peers
+const maxPexPeers = 50
+
+// flags of added peers (BEP 11)
+const (
+	pexPreferEncryption  byte = 0x01
+	pexSeedOnly          byte = 0x02
+	pexSupportsUtp       byte = 0x04
+	pexSupportsHolePunch byte = 0x08
+	pexReachable         byte = 0x10
+)
+
+// pexExtension exchanges addresses of connected peers (BEP 11),
+// received addresses are passed to the peers channel
+type pexExtension struct {
+	peers chan []string
+
+	listenPort uint16
+
+	// listen addresses of connected peers and addresses sent to them
+	addresses map[*Seeder]string
+	flags     map[*Seeder]byte
+	sent      map[*Seeder]map[string]byte
+
+	mutex sync.Mutex
+}
+
+func newPexExtension() *pexExtension {
+	return &pexExtension{
+		peers:     make(chan []string, 16),
+		addresses: make(map[*Seeder]string),
+		flags:     make(map[*Seeder]byte),
+		sent:      make(map[*Seeder]map[string]byte),
+	}
+}
+
+func (e *pexExtension) Name() string {
+	return utPexName
+}
+
+// ExtendHandshake adds the listen port, so peers connected to us
+// can advertise our address to others
+func (e *pexExtension) ExtendHandshake(handshake map[string]interface{}) {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.listenPort != 0 {
+		handshake["p"] = int64(e.listenPort)
+	}
+}
+
+func (e *pexExtension) HandleHandshake(seeder *Seeder, handshake dictionary) (err error) {
+
+	port, err := getInt(handshake, "p")
+	if err != nil || port <= 0 || port > 65535 {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(seeder.Address)
+	if err != nil {
+		return nil
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, ok := e.flags[seeder]; ok {
+		e.addresses[seeder] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	return nil
+}
+
+func (e *pexExtension) HandleMessage(seeder *Seeder, payload []byte) (err error) {
+
+	added, _, _, err := parsePexPayload(payload)
+	if err != nil {
+		return errors.Annotate(err, "pex message")
+	}
+
+	if len(added) > maxPexPeers {
+		added = added[:maxPexPeers]
+	}
+
+	e.mutex.Lock()
+
+	known := make(map[string]bool)
+	for _, address := range e.addresses {
+		known[address] = true
+	}
+
+	var peers []string
+	for _, address := range added {
+		if !known[address] {
+			peers = append(peers, address)
+		}
+	}
+
+	e.mutex.Unlock()
+
+	if len(peers) == 0 {
+		return nil
+	}
+
+	// addresses are dropped if the download doesn't keep up with them
+	select {
+	case e.peers <- peers:
+	default:
+	}
+
+	return nil
+}
+
+func (e *pexExtension) setListenPort(port uint16) {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.listenPort = port
+}
+
+// addSeeder remembers the peer, address of the peer is known
+// only for outgoing connections until its extended handshake
+func (e *pexExtension) addSeeder(seeder *Seeder, outgoing bool) {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if outgoing {
+		e.addresses[seeder] = seeder.Address
+		e.flags[seeder] = pexReachable
+	} else {
+		e.flags[seeder] = 0
+	}
+}
+
+func (e *pexExtension) removeSeeder(seeder *Seeder) {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	delete(e.addresses, seeder)
+	delete(e.flags, seeder)
+	delete(e.sent, seeder)
+}
+
+// makeMessages builds added and dropped lists for every seeder supporting
+// peer exchange since the previous call, seeds are the seeders which
+// have all pieces
+func (e *pexExtension) makeMessages(seeders []*Seeder, seeds map[*Seeder]bool) (messages map[*Seeder][]byte) {
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	connected := make(map[string]byte)
+
+	for _, seeder := range seeders {
+
+		address, ok := e.addresses[seeder]
+		if !ok {
+			continue
+		}
+
+		flags := e.flags[seeder]
+		if seeds[seeder] {
+			flags |= pexSeedOnly
+		}
+
+		connected[address] = flags
+	}
+
+	messages = make(map[*Seeder][]byte)
+
+	for _, seeder := range seeders {
+
+		if !seeder.PeerSupports(utPexName) {
+			continue
+		}
+
+		sent, ok := e.sent[seeder]
+		if !ok {
+			sent = make(map[string]byte)
+			e.sent[seeder] = sent
+		}
+
+		var added []pexPeer
+		var dropped []string
+
+		for address, flags := range connected {
+
+			if len(added) == maxPexPeers {
+				break
+			}
+
+			if _, ok := sent[address]; ok || address == e.addresses[seeder] {
+				continue
+			}
+
+			added = append(added, pexPeer{address, flags})
+			sent[address] = flags
+		}
+
+		for address := range sent {
+
+			if len(dropped) == maxPexPeers {
+				break
+			}
+
+			if _, ok := connected[address]; ok {
+				continue
+			}
+
+			dropped = append(dropped, address)
+			delete(sent, address)
+		}
+
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+
+		messages[seeder] = makePexPayload(added, dropped)
+	}
+
+	return messages
+}
+
+type pexPeer struct {
+	Address string
+	Flags   byte
+}
+
+// makeCompactPeer encodes the address as ip and port,
+// ipLength is 0 if the address is not ip address
+func makeCompactPeer(address string) (data []byte, ipLength int) {
+
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, 0
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0
+	}
+
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+
+	data = make([]byte, len(ip)+2)
+	copy(data, ip)
+	binary.BigEndian.PutUint16(data[len(ip):], uint16(port))
+
+	return data, len(ip)
+}
+
+func makePexPayload(added []pexPeer, dropped []string) (payload []byte) {
+
+	var added4, added6, addedFlags4, addedFlags6, dropped4, dropped6 []byte
+
+	for _, peer := range added {
+		data, ipLength := makeCompactPeer(peer.Address)
+		switch ipLength {
+		case net.IPv4len:
+			added4 = append(added4, data...)
+			addedFlags4 = append(addedFlags4, peer.Flags)
+		case net.IPv6len:
+			added6 = append(added6, data...)
+			addedFlags6 = append(addedFlags6, peer.Flags)
+		}
+	}
+
+	for _, address := range dropped {
+		data, ipLength := makeCompactPeer(address)
+		switch ipLength {
+		case net.IPv4len:
+			dropped4 = append(dropped4, data...)
+		case net.IPv6len:
+			dropped6 = append(dropped6, data...)
+		}
+	}
+
+	message := map[string]interface{}{
+		"added":    string(added4),
+		"added.f":  string(addedFlags4),
+		"added6":   string(added6),
+		"added6.f": string(addedFlags6),
+		"dropped":  string(dropped4),
+		"dropped6": string(dropped6),
+	}
+
+	payload, err := bencode.EncodeBytes(message)
+	if err != nil {
+		panic(err)
+	}
+
+	return payload
+}
+
+// parsePexPayload decodes ut_pex message, all fields are optional
+func parsePexPayload(payload []byte) (added []string, addedFlags []byte, dropped []string, err error) {
+
+	var message interface{}
+
+	err = bencode.DecodeBytes(payload, &message)
+	if err != nil {
+		return nil, nil, nil, errors.Annotate(err, "parse pex message")
+	}
+
+	messageDict, ok := message.(map[string]interface{})
+	if !ok {
+		return nil, nil, nil, errors.Annotate(DecodeError{message, "message"},
+			"parse pex message")
+	}
+
+	fields := []struct {
+		peers     string
+		flags     string
+		ipLength  int
+		isDropped bool
+	}{
+		{"added", "added.f", net.IPv4len, false},
+		{"added6", "added6.f", net.IPv6len, false},
+		{"dropped", "", net.IPv4len, true},
+		{"dropped6", "", net.IPv6len, true},
+	}
+
+	for _, field := range fields {
+
+		if _, ok := messageDict[field.peers]; !ok {
+			continue
+		}
+
+		data, err := getString(messageDict, field.peers)
+		if err != nil {
+			return nil, nil, nil, errors.Annotate(err, "parse pex message")
+		}
+
+		peers := parseCompactPeers([]byte(data), field.ipLength)
+
+		if field.isDropped {
+			dropped = append(dropped, peers...)
+			continue
+		}
+
+		// flags are absent or have one byte per peer
+		flags, _ := getString(messageDict, field.flags)
+		for i := range peers {
+			if i < len(flags) {
+				addedFlags = append(addedFlags, flags[i])
+			} else {
+				addedFlags = append(addedFlags, 0)
+			}
+		}
+
+		added = append(added, peers...)
+	}
+
+	return added, addedFlags, dropped, nil
+}
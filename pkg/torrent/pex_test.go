@@ -0,0 +1,161 @@
+package torrent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func makeTestPexSeeder(address string, supportsPex bool) (seeder *Seeder) {
+
+	seeder, _ = makeTestSeeder(make([]byte, 20), make([]byte, 20))
+	seeder.Address = address
+
+	if supportsPex {
+		seeder.setPeerExtensionIds(dictionary{utPexName: int64(1)})
+	}
+
+	return seeder
+}
+
+func TestPex_Payload(t *testing.T) {
+
+	added := []pexPeer{
+		{"10.0.0.1:6881", pexReachable},
+		{"[2001:db8::1]:6882", pexSeedOnly},
+		{"10.0.0.2:6883", 0},
+	}
+
+	dropped := []string{"10.0.0.3:6884", "[2001:db8::2]:6885"}
+
+	addedAddresses, addedFlags, droppedAddresses, err := parsePexPayload(makePexPayload(added, dropped))
+	assert.NoError(t, err, "parse finished with error")
+
+	assert.Equal(t, []string{"10.0.0.1:6881", "10.0.0.2:6883", "[2001:db8::1]:6882"},
+		addedAddresses, "wrong added peers")
+	assert.Equal(t, []byte{pexReachable, 0, pexSeedOnly}, addedFlags, "wrong flags")
+	assert.Equal(t, dropped, droppedAddresses, "wrong dropped peers")
+
+	addedAddresses, addedFlags, _, err = parsePexPayload([]byte("d5:added6:\x0a\x00\x00\x01\x1a\xe1e"))
+	assert.NoError(t, err, "message without flags is not parsed")
+	assert.Equal(t, []string{"10.0.0.1:6881"}, addedAddresses, "wrong added peers")
+	assert.Equal(t, []byte{0}, addedFlags, "absent flags are not zero")
+
+	_, _, _, err = parsePexPayload([]byte("d5:addedi1ee"))
+	assert.Error(t, err, "wrong message is parsed")
+
+	_, _, _, err = parsePexPayload([]byte("le"))
+	assert.Error(t, err, "wrong message is parsed")
+}
+
+func TestPex_MakeMessages(t *testing.T) {
+
+	pex := newPexExtension()
+
+	first := makeTestPexSeeder("10.0.0.1:6881", true)
+	second := makeTestPexSeeder("10.0.0.2:6881", false)
+	third := makeTestPexSeeder("10.0.0.3:50000", true)
+
+	pex.addSeeder(first, true)
+	pex.addSeeder(second, true)
+	pex.addSeeder(third, false)
+
+	// incoming peer becomes known with its listen port
+	err := pex.HandleHandshake(third, dictionary{"p": int64(6883)})
+	assert.NoError(t, err, "handshake finished with error")
+
+	seeders := []*Seeder{first, second, third}
+	seeds := map[*Seeder]bool{second: true}
+
+	messages := pex.makeMessages(seeders, seeds)
+	assert.Len(t, messages, 2, "messages are not sent to every peer supporting pex")
+
+	added, flags, dropped, err := parsePexPayload(messages[first])
+	assert.NoError(t, err, "parse finished with error")
+	assert.ElementsMatch(t, []string{"10.0.0.2:6881", "10.0.0.3:6883"}, added, "wrong added peers")
+	assert.Empty(t, dropped, "wrong dropped peers")
+
+	for i, address := range added {
+		if address == "10.0.0.2:6881" {
+			assert.Equal(t, pexReachable|pexSeedOnly, flags[i], "wrong flags")
+		} else {
+			assert.Equal(t, byte(0), flags[i], "wrong flags")
+		}
+	}
+
+	added, _, _, err = parsePexPayload(messages[third])
+	assert.NoError(t, err, "parse finished with error")
+	assert.ElementsMatch(t, []string{"10.0.0.1:6881", "10.0.0.2:6881"}, added, "wrong added peers")
+
+	// nothing changed since the previous messages
+	messages = pex.makeMessages(seeders, seeds)
+	assert.Empty(t, messages, "messages without changes are sent")
+
+	pex.removeSeeder(second)
+
+	messages = pex.makeMessages([]*Seeder{first, third}, seeds)
+	assert.Len(t, messages, 2, "dropped peer is not sent")
+
+	added, _, dropped, err = parsePexPayload(messages[first])
+	assert.NoError(t, err, "parse finished with error")
+	assert.Empty(t, added, "wrong added peers")
+	assert.Equal(t, []string{"10.0.0.2:6881"}, dropped, "wrong dropped peers")
+}
+
+func TestPex_HandleMessage(t *testing.T) {
+
+	pex := newPexExtension()
+
+	seeder := makeTestPexSeeder("10.0.0.1:6881", true)
+	pex.addSeeder(seeder, true)
+
+	payload := makePexPayload([]pexPeer{
+		{"10.0.0.1:6881", 0},
+		{"10.0.0.2:6881", 0},
+		{"[2001:db8::1]:6881", 0},
+	}, nil)
+
+	err := pex.HandleMessage(seeder, payload)
+	assert.NoError(t, err, "message handling finished with error")
+
+	select {
+	case peers := <-pex.peers:
+		assert.Equal(t, []string{"10.0.0.2:6881", "[2001:db8::1]:6881"}, peers,
+			"connected peers are not filtered")
+	case <-time.After(time.Second):
+		t.Fatal("peers are not received")
+	}
+
+	err = pex.HandleMessage(seeder, []byte("i1e"))
+	assert.Error(t, err, "wrong message is handled")
+}
+
+func TestPex_Private(t *testing.T) {
+
+	info := Info{PieceLength: 2 * blockSize, PieceCount: 4, TotalLength: 8 * blockSize, Private: true}
+
+	storage, err := NewMemoryStorageProvider().OpenTorrent(&info, make([]byte, 20))
+	assert.NoError(t, err, "can not open storage")
+
+	manager := NewManager(make([]byte, 20), make([]byte, 20), &info, NewState(8*blockSize, 4), storage)
+
+	handshake, err := parseExtendedHandshakePayload(manager.extensions.makeHandshakePayload())
+	assert.NoError(t, err, "can not parse handshake")
+
+	ids, err := getDict(handshake, "m")
+	assert.NoError(t, err, "there are no extension ids")
+	assert.NotContains(t, ids, utPexName, "ut_pex is advertised for private torrent")
+
+	seeder := makeTestPexSeeder("10.0.0.1:6881", true)
+
+	// ut_pex message is not handled
+	payload := makePexPayload([]pexPeer{{"10.0.0.2:6881", 0}}, nil)
+	err = manager.extensions.handleMessage(seeder, append([]byte{1}, payload...))
+	assert.Error(t, err, "ut_pex message is handled for private torrent")
+
+	select {
+	case <-manager.Peers:
+		t.Fatal("peers are received from private torrent")
+	default:
+	}
+}
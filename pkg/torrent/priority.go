@@ -0,0 +1,184 @@
+package torrent
+
+import (
+	"github.com/juju/errors"
+	"github.com/lezhenin/gotorrentclient/pkg/bitfield"
+	"github.com/sirupsen/logrus"
+)
+
+// Priority is the download priority of a file, pieces of skipped files are not downloaded
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+// SetFilePriority sets the priority of the file, it can be called before start and while downloading,
+// the file is created when it becomes wanted
+func (m *Manager) SetFilePriority(index int, priority Priority) (err error) {
+
+	if index < 0 || index >= len(m.info.Files) {
+		return errors.Errorf("set file priority: file %d is out of range", index)
+	}
+
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return errors.Errorf("set file priority: priority %d is unknown", priority)
+	}
+
+	storage, ok := m.storage.(fileStorage)
+	if ok && priority != PrioritySkip {
+		err = storage.openFile(index, true)
+		if err != nil {
+			return errors.Annotate(err, "set file priority")
+		}
+	}
+
+	m.priorityMutex.Lock()
+	m.filePriorities[index] = priority
+	m.priorityMutex.Unlock()
+
+	select {
+	case m.prioritySignals <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// FilePriorities returns the priorities of the files
+func (m *Manager) FilePriorities() (priorities []Priority) {
+
+	m.priorityMutex.RLock()
+	defer m.priorityMutex.RUnlock()
+
+	return append(priorities, m.filePriorities...)
+}
+
+// openFiles opens the files of the storage, skipped files are opened only if they exist
+func (m *Manager) openFiles() (err error) {
+
+	storage, ok := m.storage.(fileStorage)
+	if !ok {
+		return nil
+	}
+
+	for index, priority := range m.FilePriorities() {
+		err = storage.openFile(index, priority != PrioritySkip)
+		if err != nil {
+			return errors.Annotate(err, "manager open files")
+		}
+	}
+
+	return nil
+}
+
+// updatePriorities sets the priority of each piece to the highest priority
+// of the files it belongs to, it is called from the manager routine
+func (m *Manager) updatePriorities() {
+
+	filePriorities := m.FilePriorities()
+
+	for index := range m.piecePriorities {
+		m.piecePriorities[index] = PrioritySkip
+	}
+
+	offset := int64(0)
+
+	for index, file := range m.info.Files {
+
+		if file.Length > 0 {
+			firstPiece := offset / m.info.PieceLength
+			lastPiece := (offset + file.Length - 1) / m.info.PieceLength
+
+			for pieceIndex := firstPiece; pieceIndex <= lastPiece; pieceIndex++ {
+				if m.piecePriorities[pieceIndex] < filePriorities[index] {
+					m.piecePriorities[pieceIndex] = filePriorities[index]
+				}
+			}
+		}
+
+		offset += file.Length
+	}
+
+	m.wantedPieceBitfield = bitfield.NewBitfield(uint(m.pieceCount))
+	for index, priority := range m.piecePriorities {
+		if priority != PrioritySkip {
+			m.wantedPieceBitfield.Set(uint(index))
+		}
+	}
+}
+
+// handlePriorityChange updates interest in the peers and completion
+// after the priorities of the files are changed
+func (m *Manager) handlePriorityChange() {
+
+	m.updatePriorities()
+
+	managerLogger.WithFields(logrus.Fields{
+		"wanted":   m.wantedPieceBitfield.Count(1),
+		"infoHash": m.infoHash,
+	}).Debug("priorities changed")
+
+	if !m.completed() {
+		m.done = false
+		m.state.SetFinished(false)
+	}
+
+	for _, seeder := range m.getSeederSlice() {
+
+		m.updateInterest(seeder)
+
+		if !seeder.AmInterested {
+			continue
+		}
+
+		interested := false
+		if !seeder.PeerChoking || len(seeder.PeerAllowedFast) > 0 {
+			interested = m.fillRequests(seeder)
+		}
+
+		if !interested && len(seeder.requests) == 0 && !m.interesting(seeder) {
+			seeder.AmInterested = false
+			seeder.outcoming <- Message{NotInterested, nil, m.peerId}
+			m.interestingPeerCount -= 1
+		}
+	}
+
+	m.checkCompleted()
+}
+
+// interesting reports whether the peer has wanted pieces which are not downloaded
+func (m *Manager) interesting(seeder *Seeder) bool {
+	wanted := bitfield.AndNot(seeder.PeerBitfield, m.downloadedPieceBitfield)
+	return bitfield.And(wanted, m.wantedPieceBitfield).Count(1) > 0
+}
+
+// completed reports whether all wanted pieces are downloaded
+func (m *Manager) completed() bool {
+	return bitfield.AndNot(m.wantedPieceBitfield, m.downloadedPieceBitfield).Count(1) == 0
+}
+
+// checkCompleted signals the completion once after the last wanted piece is downloaded
+func (m *Manager) checkCompleted() {
+
+	if m.done || !m.completed() {
+		return
+	}
+
+	m.done = true
+
+	select {
+	case m.Done <- struct{}{}:
+	default:
+	}
+
+	managerLogger.WithFields(logrus.Fields{
+		"downloaded": m.state.Downloaded(),
+		"uploaded":   m.state.Uploaded(),
+		"left":       m.state.Left(),
+		"infoHash":   m.infoHash,
+	}).Info("Download completed")
+}
@@ -0,0 +1,31 @@
+package torrent
+
+import (
+	"github.com/lezhenin/gotorrentclient/pkg/ratelimit"
+)
+
+// limiters shared by all downloads
+var globalUploadLimiter = ratelimit.NewLimiter(0)
+var globalDownloadLimiter = ratelimit.NewLimiter(0)
+
+// SetGlobalUploadLimit sets the upload rate of all downloads in bytes per second,
+// zero rate means no limit, it can be changed at runtime
+func SetGlobalUploadLimit(rate int64) {
+	globalUploadLimiter.SetRate(rate)
+}
+
+// SetGlobalDownloadLimit sets the download rate of all downloads in bytes per second,
+// zero rate means no limit, it can be changed at runtime
+func SetGlobalDownloadLimit(rate int64) {
+	globalDownloadLimiter.SetRate(rate)
+}
+
+// SetUploadLimit sets the upload rate of the torrent in addition to the global limit
+func (m *Manager) SetUploadLimit(rate int64) {
+	m.uploadLimiter.SetRate(rate)
+}
+
+// SetDownloadLimit sets the download rate of the torrent in addition to the global limit
+func (m *Manager) SetDownloadLimit(rate int64) {
+	m.downloadLimiter.SetRate(rate)
+}
@@ -0,0 +1,124 @@
+package torrent
+
+import (
+	"time"
+)
+
+// DefaultRequestQueueDepth is the maximal number of outstanding requests to a peer
+const DefaultRequestQueueDepth = 64
+
+const minRequestQueueDepth = 2
+
+// outstanding requests are enough to download for this time at the peer rate
+const requestQueueTime = 3 * time.Second
+
+const rateInterval = time.Second
+
+// SetRequestQueueDepth sets the maximal number of outstanding requests to a peer,
+// it has to be called before start
+func (m *Manager) SetRequestQueueDepth(depth int) {
+	if depth < minRequestQueueDepth {
+		depth = minRequestQueueDepth
+	}
+	m.maxRequestQueueDepth = depth
+}
+
+// requestQueueDepth returns the number of outstanding requests
+// needed to keep the peer busy at the measured rate
+func (m *Manager) requestQueueDepth(seeder *Seeder) int {
+
+	depth := int(seeder.downloadRate * requestQueueTime.Seconds() / float64(blockLength))
+
+	if depth < minRequestQueueDepth {
+		return minRequestQueueDepth
+	}
+
+	if depth > m.maxRequestQueueDepth {
+		return m.maxRequestQueueDepth
+	}
+
+	return depth
+}
+
+// fillRequests requests blocks from the peer until the queue is full,
+// it returns false if there is nothing to request from the peer
+func (m *Manager) fillRequests(seeder *Seeder) (interested bool) {
+
+	// snubbed peer is not requested until it unchokes again
+	if seeder.snubbed {
+		return false
+	}
+
+	// waiting for blocks starts with the first request
+	if len(seeder.requests) == 0 {
+		seeder.lastBlock = time.Now()
+	}
+
+	depth := m.requestQueueDepth(seeder)
+
+	for len(seeder.requests) < depth {
+
+		pieceIndex, blockIndex, ok := m.requestPiece(seeder)
+		if !ok {
+			return false
+		}
+
+		index, offset, length := m.convertPieceIndexToOffset(pieceIndex, blockIndex)
+		seeder.outcoming <- Message{Request, MakeRequestPayload(index, offset, length), m.peerId}
+	}
+
+	return true
+}
+
+// releaseRequest returns the block requested from the peer to not requested blocks
+func (m *Manager) releaseRequest(seeder *Seeder, globalBlockIndex int64) (ok bool) {
+
+	if !seeder.requests[globalBlockIndex] {
+		return false
+	}
+
+	delete(seeder.requests, globalBlockIndex)
+
+	if m.downloadedBlockBitfield.Get(uint(globalBlockIndex)) == 0 {
+		m.downloadingBlockBitfield.Clear(uint(globalBlockIndex))
+	}
+
+	return true
+}
+
+func (m *Manager) releaseRequests(seeder *Seeder) {
+	for globalBlockIndex := range seeder.requests {
+		m.releaseRequest(seeder, globalBlockIndex)
+	}
+}
+
+// redistributeRequests passes released blocks to the other peers
+func (m *Manager) redistributeRequests(released *Seeder) {
+
+	for _, seeder := range m.getSeederSlice() {
+
+		if seeder == released {
+			continue
+		}
+
+		m.updateInterest(seeder)
+
+		if seeder.AmInterested && !seeder.PeerChoking {
+			m.fillRequests(seeder)
+		}
+	}
+}
+
+// handleRateTimer updates download and upload rates of the peers
+func (m *Manager) handleRateTimer() {
+
+	for _, seeder := range m.getSeederSlice() {
+		rate := float64(seeder.downloadedBytes) / rateInterval.Seconds()
+		seeder.downloadRate = (seeder.downloadRate + rate) / 2
+		seeder.downloadedBytes = 0
+
+		rate = float64(seeder.uploadedBytes) / rateInterval.Seconds()
+		seeder.uploadRate = (seeder.uploadRate + rate) / 2
+		seeder.uploadedBytes = 0
+	}
+}
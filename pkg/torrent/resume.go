@@ -0,0 +1,277 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/juju/errors"
+	"github.com/lezhenin/gotorrentclient/pkg/bitfield"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/bencode"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const resumeInterval = time.Minute
+
+// SetResumePath sets the file the resume data is saved to periodically and on stop,
+// empty path disables saving
+func (m *Manager) SetResumePath(path string) {
+	m.resumePath = path
+}
+
+// Recheck hashes the pieces of the files and restores the verified ones,
+// it has to be called before start
+func (m *Manager) Recheck() (err error) {
+
+	data := make([]byte, m.info.PieceLength)
+	verified := 0
+
+	for pieceIndex := 0; pieceIndex < int(m.pieceCount); pieceIndex++ {
+
+		pieceLength := m.info.PieceLength
+		if int64(pieceIndex) == m.pieceCount-1 {
+			pieceLength = m.lastPieceLength
+		}
+
+		_, err = m.storage.Piece(pieceIndex).ReadAt(data[:pieceLength], 0)
+		if err != nil {
+			return errors.Annotate(err, "manager recheck")
+		}
+
+		hashSum := sha1.Sum(data[:pieceLength])
+		if bytes.Equal(hashSum[:], m.info.Pieces[20*pieceIndex:20*pieceIndex+20]) {
+			m.restorePiece(pieceIndex)
+			verified += 1
+		}
+	}
+
+	managerLogger.WithFields(logrus.Fields{
+		"verified": verified,
+		"infoHash": m.infoHash,
+	}).Info("recheck finished")
+
+	return nil
+}
+
+// LoadResume restores the state saved to the resume file, it fails if the file
+// belongs to another torrent or the files are modified after it is saved,
+// it has to be called before start
+func (m *Manager) LoadResume(path string) (err error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	var decoded interface{}
+
+	err = bencode.DecodeBytes(data, &decoded)
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	resumeDict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return errors.Errorf("manager load resume: root element is not dictionary")
+	}
+
+	infoHash, err := getString(resumeDict, "info-hash")
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	if !bytes.Equal([]byte(infoHash), m.infoHash) {
+		return errors.Errorf("manager load resume: info hash differs")
+	}
+
+	modTimes, err := getList(resumeDict, "mtimes")
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	// the data of other storages can not be checked
+	storage, ok := m.storage.(fileStorage)
+	if !ok {
+		return errors.Errorf("manager load resume: storage does not keep files")
+	}
+
+	currentModTimes, err := storage.modTimes()
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	if len(modTimes) != len(currentModTimes) {
+		return errors.Errorf("manager load resume: file count differs")
+	}
+
+	for i, modTime := range modTimes {
+		if modTime, ok := modTime.(int64); !ok || modTime != currentModTimes[i] {
+			return errors.Errorf("manager load resume: file %d is modified", i)
+		}
+	}
+
+	pieces, err := getString(resumeDict, "pieces")
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	pieceBitfield, err := bitfield.NewBitfieldFromBytes([]byte(pieces), uint(m.pieceCount))
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	blocks, err := getString(resumeDict, "blocks")
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	blockBitfield, err := bitfield.NewBitfieldFromBytes([]byte(blocks), uint(m.blockCount))
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	uploaded, err := getInt(resumeDict, "uploaded")
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	downloaded, err := getInt(resumeDict, "downloaded")
+	if err != nil {
+		return errors.Annotate(err, "manager load resume")
+	}
+
+	for pieceIndex := 0; pieceIndex < int(m.pieceCount); pieceIndex++ {
+
+		if pieceBitfield.Get(uint(pieceIndex)) == 1 {
+			m.restorePiece(pieceIndex)
+			continue
+		}
+
+		startIndex := m.convertPieceToGlobalBlockIndex(pieceIndex, 0)
+		endIndex := m.convertPieceToGlobalBlockIndex(pieceIndex+1, 0)
+		if int64(pieceIndex) == m.pieceCount-1 {
+			endIndex = m.blockCount
+		}
+
+		var restored []int64
+		for i := startIndex; i < endIndex; i++ {
+			if blockBitfield.Get(uint(i)) == 1 {
+				restored = append(restored, i)
+			}
+		}
+
+		// not verified piece is downloaded again
+		if int64(len(restored)) == endIndex-startIndex {
+			continue
+		}
+
+		for _, globalBlockIndex := range restored {
+			m.restoreBlock(globalBlockIndex)
+		}
+	}
+
+	m.state.IncrementUploaded(uint64(uploaded))
+	m.state.IncrementDownloaded(uint64(downloaded))
+
+	managerLogger.WithFields(logrus.Fields{
+		"pieces":   m.downloadedPieceBitfield.Count(1),
+		"infoHash": m.infoHash,
+	}).Info("resume data loaded")
+
+	return nil
+}
+
+// saveResume writes the resume data to the temporary file and replaces the resume file,
+// it is called from the manager routine
+func (m *Manager) saveResume() (err error) {
+
+	storage, ok := m.storage.(fileStorage)
+	if m.resumePath == "" || !ok {
+		return nil
+	}
+
+	// resume data describes the data on the disk
+	err = m.flushStorage()
+	if err != nil {
+		return errors.Annotate(err, "manager save resume")
+	}
+
+	modTimes, err := storage.modTimes()
+	if err != nil {
+		return errors.Annotate(err, "manager save resume")
+	}
+
+	data, err := bencode.EncodeBytes(map[string]interface{}{
+		"info-hash":  string(m.infoHash),
+		"pieces":     string(m.downloadedPieceBitfield.Bytes()),
+		"blocks":     string(m.downloadedBlockBitfield.Bytes()),
+		"uploaded":   m.state.Uploaded(),
+		"downloaded": m.state.Downloaded(),
+		"mtimes":     modTimes,
+	})
+	if err != nil {
+		return errors.Annotate(err, "manager save resume")
+	}
+
+	err = ioutil.WriteFile(m.resumePath+".tmp", data, 0644)
+	if err != nil {
+		return errors.Annotate(err, "manager save resume")
+	}
+
+	err = os.Rename(m.resumePath+".tmp", m.resumePath)
+	if err != nil {
+		return errors.Annotate(err, "manager save resume")
+	}
+
+	return nil
+}
+
+func (m *Manager) handleResumeTimer() {
+	err := m.saveResume()
+	if err != nil {
+		managerLogger.WithFields(logrus.Fields{
+			"infoHash": m.infoHash,
+		}).Error(err)
+	}
+}
+
+// restorePiece marks the piece found in the files as downloaded
+func (m *Manager) restorePiece(pieceIndex int) {
+
+	if m.downloadedPieceBitfield.Get(uint(pieceIndex)) == 1 {
+		return
+	}
+
+	startIndex := m.convertPieceToGlobalBlockIndex(pieceIndex, 0)
+	endIndex := m.convertPieceToGlobalBlockIndex(pieceIndex+1, 0)
+	if int64(pieceIndex) == m.pieceCount-1 {
+		endIndex = m.blockCount
+	}
+
+	for i := startIndex; i < endIndex; i++ {
+		m.restoreBlock(i)
+	}
+
+	pieceLength := m.info.PieceLength
+	if int64(pieceIndex) == m.pieceCount-1 {
+		pieceLength = m.lastPieceLength
+	}
+
+	m.downloadedPieceBitfield.Set(uint(pieceIndex))
+	m.state.SetBitfieldBit(uint(pieceIndex))
+	m.state.DecrementLeft(uint64(pieceLength))
+}
+
+func (m *Manager) restoreBlock(globalBlockIndex int64) {
+
+	if m.downloadedBlockBitfield.Get(uint(globalBlockIndex)) == 1 {
+		return
+	}
+
+	pieceIndex, _ := m.convertGlobalBlockToPieceIndex(globalBlockIndex)
+
+	m.downloadedBlockBitfield.Set(uint(globalBlockIndex))
+	m.downloadingBlockBitfield.Set(uint(globalBlockIndex))
+	m.pieceDownloadProgress[pieceIndex] -= 1
+}
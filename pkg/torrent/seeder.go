@@ -2,9 +2,11 @@ package torrent
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/binary"
 	"github.com/juju/errors"
 	"github.com/lezhenin/gotorrentclient/pkg/bitfield"
+	"github.com/lezhenin/gotorrentclient/pkg/ratelimit"
 	"github.com/sirupsen/logrus"
 	"io"
 	"net"
@@ -15,7 +17,17 @@ import (
 const protocolId string = "BitTorrent protocol"
 
 const handshakeTimeout = 15
-const requestTimeout = 15
+
+// keep-alive is sent if nothing is written for the interval,
+// connection is closed if nothing is read for the timeout
+const defaultKeepAliveInterval = 2 * time.Minute
+const defaultReadTimeout = 3 * time.Minute
+
+// reserved bit of the handshake for extension protocol (BEP 10)
+const extensionProtocolBit = 0x10
+
+// reserved bit of the handshake for fast extension (BEP 6)
+const fastExtensionBit = 0x04
 
 const bufferSize = blockLength + 512
 const messageBufferLength = 16
@@ -32,6 +44,12 @@ const (
 	Request       MessageId = 6
 	Piece         MessageId = 7
 	Cancel        MessageId = 8
+	SuggestPiece  MessageId = 13
+	HaveAll       MessageId = 14
+	HaveNone      MessageId = 15
+	RejectRequest MessageId = 16
+	AllowedFast   MessageId = 17
+	Extended      MessageId = 20
 	KeepAlive     MessageId = 255 // has no id
 	Error         MessageId = 254 // special code
 )
@@ -50,14 +68,53 @@ type Seeder struct {
 
 	PeerBitfield *bitfield.Bitfield
 
+	// pieces which can be requested while choked (BEP 6)
+	AllowedFast     map[uint32]bool
+	PeerAllowedFast map[uint32]bool
+
+	// upload requests of the peer, handled by the manager
+	uploadQueue     []blockRequest
+	uploadCurrent   blockRequest
+	uploadInFlight  bool
+	uploadCancelled bool
+
+	// blocks requested from the peer and download rate, handled by the manager
+	requests        map[int64]bool
+	downloadedBytes int64
+	downloadRate    float64
+	uploadedBytes   int64
+	uploadRate      float64
+	connected       time.Time
+
+	// peers are mutually not interested since the time, zero if interested
+	uninterestedSince time.Time
+
+	// peer is snubbed if no block is received since lastBlock for snub interval
+	lastBlock time.Time
+	snubbed   bool
+
 	PeerId   []byte
 	MyPeerId []byte
+	Address  string
+
+	Reserved     []byte
+	PeerReserved []byte
+
+	extensions       *ExtensionRegistry
+	peerExtensionIds map[string]byte
+	extensionMutex   sync.Mutex
 
 	InfoHash []byte
 
 	connection net.Conn
 	buffer     []byte
 
+	keepAliveInterval time.Duration
+	readTimeout       time.Duration
+
+	downloadLimiters []*ratelimit.Limiter
+	uploadLimiters   []*ratelimit.Limiter
+
 	incoming  chan Message
 	outcoming chan Message
 
@@ -69,7 +126,8 @@ type Seeder struct {
 
 func (s *Seeder) Accept(connection net.Conn) (err error) {
 
-	s.connection = connection
+	s.connection = s.limitConnection(connection)
+	s.Address = connection.RemoteAddr().String()
 
 	// set deadline 15 second for handshake
 	err = s.connection.SetDeadline(time.Now().Add(handshakeTimeout * time.Second))
@@ -109,7 +167,8 @@ func (s *Seeder) Accept(connection net.Conn) (err error) {
 
 func (s *Seeder) Dial(connection net.Conn) (err error) {
 
-	s.connection = connection
+	s.connection = s.limitConnection(connection)
+	s.Address = connection.RemoteAddr().String()
 
 	// set deadline 15 second for handshake
 	err = s.connection.SetDeadline(time.Now().Add(handshakeTimeout * time.Second))
@@ -147,8 +206,101 @@ func (s *Seeder) Dial(connection net.Conn) (err error) {
 
 }
 
+func (s *Seeder) SupportsExtensions() bool {
+	return len(s.PeerReserved) == 8 && s.PeerReserved[5]&extensionProtocolBit != 0
+}
+
+// SupportsFast reports whether both sides advertised fast extension
+func (s *Seeder) SupportsFast() bool {
+	return s.Reserved[7]&fastExtensionBit != 0 &&
+		len(s.PeerReserved) == 8 && s.PeerReserved[7]&fastExtensionBit != 0
+}
+
+// EnableFast advertises fast extension in the handshake,
+// it has to be called before Accept or Dial
+func (s *Seeder) EnableFast() {
+	s.Reserved[7] |= fastExtensionBit
+}
+
+// SetRateLimiters limits reads of the connection and uploaded blocks,
+// it has to be called before Accept or Dial
+func (s *Seeder) SetRateLimiters(download, upload []*ratelimit.Limiter) {
+	s.downloadLimiters = download
+	s.uploadLimiters = upload
+}
+
+// limitConnection limits only reads, writes are not limited so control messages
+// are not queued behind pieces, pieces are limited before they are queued
+func (s *Seeder) limitConnection(connection net.Conn) net.Conn {
+	if len(s.downloadLimiters) == 0 {
+		return connection
+	}
+	return ratelimit.NewConn(connection, s.downloadLimiters, nil)
+}
+
+// EnableExtensions advertises extension protocol in the handshake,
+// it has to be called before Accept or Dial
+func (s *Seeder) EnableExtensions(registry *ExtensionRegistry) {
+	s.extensions = registry
+	s.Reserved[5] |= extensionProtocolBit
+}
+
+func (s *Seeder) PeerSupports(name string) bool {
+
+	s.extensionMutex.Lock()
+	defer s.extensionMutex.Unlock()
+
+	_, ok := s.peerExtensionIds[name]
+	return ok
+}
+
+// SendExtended sends extension message with the id the peer assigned to the extension
+func (s *Seeder) SendExtended(name string, payload []byte) (err error) {
+
+	s.extensionMutex.Lock()
+	id, ok := s.peerExtensionIds[name]
+	s.extensionMutex.Unlock()
+
+	if !ok {
+		return errors.Errorf("send extended: peer doesn't support %s", name)
+	}
+
+	message := Message{Extended, append([]byte{id}, payload...), s.MyPeerId}
+
+	select {
+	case s.outcoming <- message:
+		return nil
+	default:
+		return errors.Errorf("send extended: outcoming queue is full")
+	}
+}
+
+func (s *Seeder) setPeerExtensionIds(ids dictionary) {
+
+	s.extensionMutex.Lock()
+	defer s.extensionMutex.Unlock()
+
+	if s.peerExtensionIds == nil {
+		s.peerExtensionIds = make(map[string]byte)
+	}
+
+	// handshake can be sent again, zero id disables extension
+	for name, value := range ids {
+		id, ok := value.(int64)
+		if !ok || id <= 0 || id > 255 {
+			delete(s.peerExtensionIds, name)
+			continue
+		}
+		s.peerExtensionIds[name] = byte(id)
+	}
+}
+
 func (s *Seeder) Start() {
 
+	if s.extensions != nil && s.SupportsExtensions() {
+		s.outcoming <- Message{Extended, s.extensions.makeHandshakePayload(), s.MyPeerId}
+	}
+
 	s.closeGroup.Add(2)
 
 	go func() {
@@ -206,16 +358,14 @@ func (s *Seeder) read() {
 
 	for {
 
-		id, payload, err := s.readMessage()
+		err := s.connection.SetReadDeadline(time.Now().Add(s.readTimeout))
 		if err != nil {
 			return
 		}
 
-		if id == Piece {
-			err = s.connection.SetReadDeadline(time.Time{})
-			if err != nil {
-				return
-			}
+		id, payload, err := s.readMessage()
+		if err != nil {
+			return
 		}
 
 		seederLogger.WithFields(logrus.Fields{
@@ -225,6 +375,17 @@ func (s *Seeder) read() {
 			"infoHash": s.InfoHash,
 		}).Trace("Message received")
 
+		if id == Extended && s.extensions != nil {
+			err = s.extensions.handleMessage(s, payload)
+			if err != nil {
+				seederLogger.WithFields(logrus.Fields{
+					"peerId":   s.PeerId,
+					"infoHash": s.InfoHash,
+				}).Warn(err.Error())
+			}
+			continue
+		}
+
 		select {
 		case s.incoming <- Message{id, payload, s.PeerId}:
 			continue
@@ -236,21 +397,26 @@ func (s *Seeder) read() {
 
 func (s *Seeder) write() {
 
+	keepAliveTimer := time.NewTimer(s.keepAliveInterval)
+	defer keepAliveTimer.Stop()
+
 	for {
 		select {
-		case message := <-s.outcoming:
+		case <-keepAliveTimer.C:
 
-			if message.Id == Request {
-				err := s.connection.SetReadDeadline(time.Now().Add(requestTimeout * time.Second))
-				if err != nil {
-					seederLogger.WithFields(logrus.Fields{
-						"infoHash": s.InfoHash,
-						"peerId":   s.PeerId,
-					}).Error(errors.Annotate(err, "seeder write"))
-					return
-				}
+			err := s.writeMessage(KeepAlive, nil)
+			if err != nil {
+				seederLogger.WithFields(logrus.Fields{
+					"infoHash": s.InfoHash,
+					"peerId":   s.PeerId,
+				}).Error(errors.Annotate(err, "seeder write"))
+				return
 			}
 
+			keepAliveTimer.Reset(s.keepAliveInterval)
+
+		case message := <-s.outcoming:
+
 			err := s.writeMessage(message.Id, message.Payload)
 			if err != nil {
 				seederLogger.WithFields(logrus.Fields{
@@ -267,6 +433,8 @@ func (s *Seeder) write() {
 				"infoHash": s.InfoHash,
 			}).Trace("Message sent")
 
+			keepAliveTimer.Reset(s.keepAliveInterval)
+
 		case <-s.closeChan:
 			return
 		}
@@ -324,7 +492,10 @@ func (s *Seeder) readMessage() (id MessageId, payload []byte, err error) {
 
 	id = MessageId(idBuffer[0])
 
-	if id > Cancel && id != KeepAlive {
+	// fast extension messages are not allowed if it was not negotiated
+	isFast := id >= SuggestPiece && id <= AllowedFast && s.SupportsFast()
+
+	if id > Cancel && id != KeepAlive && id != Extended && !isFast {
 		return Error, nil,
 			errors.Errorf("read message: message has unknown id %d", id)
 	}
@@ -354,7 +525,7 @@ func (s *Seeder) writeHandshakeMessage() (err error) {
 	copy(message[28:48], s.InfoHash)
 	copy(message[48:68], s.MyPeerId)
 
-	binary.BigEndian.PutUint64(message[20:28], 0)
+	copy(message[20:28], s.Reserved)
 
 	_, err = s.connection.Write(message)
 	if err != nil {
@@ -388,6 +559,8 @@ func (s *Seeder) readHandshakeMessage() (peerId []byte, err error) {
 		return nil, errors.Annotate(err, "read handshake message")
 	}
 
+	s.PeerReserved = extensionBuffer
+
 	infoHash := make([]byte, 20)
 	_, err = io.ReadFull(s.connection, infoHash)
 	if err != nil {
@@ -422,8 +595,18 @@ func NewSeeder(infoHash []byte, peerId []byte, incoming chan Message) (seeder *S
 	seeder.MyPeerId = peerId
 	seeder.InfoHash = infoHash
 
+	seeder.Reserved = make([]byte, 8)
+
+	seeder.AllowedFast = make(map[uint32]bool)
+	seeder.PeerAllowedFast = make(map[uint32]bool)
+
+	seeder.requests = make(map[int64]bool)
+
 	seeder.buffer = make([]byte, bufferSize)
 
+	seeder.keepAliveInterval = defaultKeepAliveInterval
+	seeder.readTimeout = defaultReadTimeout
+
 	seeder.incoming = incoming
 	seeder.outcoming = make(chan Message, messageBufferLength)
 
@@ -521,3 +704,41 @@ func ParseCancelPayload(payload []byte) (pieceIndex uint32, begin uint32, length
 
 	return pieceIndex, begin, length, nil
 }
+
+// makeAllowedFastSet generates canonical allowed fast set of the peer with
+// IPv4 address (BEP 6), the set is the same for every client
+func makeAllowedFastSet(ip net.IP, infoHash []byte, pieceCount uint32, count int) (pieces []uint32) {
+
+	ip = ip.To4()
+	if ip == nil || pieceCount == 0 {
+		return nil
+	}
+
+	if uint32(count) > pieceCount {
+		count = int(pieceCount)
+	}
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip[0], ip[1], ip[2], 0)
+	x = append(x, infoHash...)
+
+	selected := make(map[uint32]bool)
+
+	for len(pieces) < count {
+
+		hash := sha1.Sum(x)
+		x = hash[:]
+
+		for i := 0; i < 5 && len(pieces) < count; i++ {
+
+			index := binary.BigEndian.Uint32(x[i*4:i*4+4]) % pieceCount
+
+			if !selected[index] {
+				selected[index] = true
+				pieces = append(pieces, index)
+			}
+		}
+	}
+
+	return pieces
+}
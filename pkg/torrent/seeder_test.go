@@ -3,7 +3,10 @@ package torrent
 import (
 	"bytes"
 	"encoding/binary"
+	"github.com/lezhenin/gotorrentclient/pkg/ratelimit"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"sync"
@@ -328,6 +331,10 @@ func TestSeeder_Start_PieceTimout(t *testing.T) {
 	firstSeeder, _ := makeTestSeeder(infoHash, firstPeerId)
 	secondSeeder, _ := makeTestSeeder(infoHash, secondPeerId)
 
+	// unanswered request is not timed out, the connection is closed if nothing is read
+	firstSeeder.readTimeout = 15 * time.Second
+	secondSeeder.readTimeout = 15 * time.Second
+
 	firstConn, secondConn := net.Pipe()
 
 	var wait sync.WaitGroup
@@ -458,6 +465,74 @@ func TestSeeder_Start(t *testing.T) {
 
 }
 
+func TestSeeder_Start_UploadLimit(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	firstPeerId := make([]byte, 20)
+	secondPeerId := make([]byte, 20)
+
+	rand.Read(infoHash)
+	rand.Read(firstPeerId)
+	rand.Read(secondPeerId)
+
+	firstSeeder, _ := makeTestSeeder(infoHash, firstPeerId)
+	secondSeeder, _ := makeTestSeeder(infoHash, secondPeerId)
+
+	// limiter allows less than a block per second
+	firstSeeder.SetRateLimiters(nil, []*ratelimit.Limiter{ratelimit.NewLimiter(1024)})
+
+	firstConn, secondConn := net.Pipe()
+
+	var wait sync.WaitGroup
+
+	wait.Add(2)
+
+	go func() {
+		defer wait.Done()
+		err := firstSeeder.Dial(firstConn)
+		assert.NoError(t, err, "seeder dial finished with error")
+	}()
+
+	go func() {
+		defer wait.Done()
+		err := secondSeeder.Accept(secondConn)
+		assert.NoError(t, err, "seeder accept finished with error")
+	}()
+
+	wait.Wait()
+
+	wait.Add(2)
+
+	go func() {
+		defer wait.Done()
+		firstSeeder.Start()
+	}()
+
+	go func() {
+		defer wait.Done()
+		secondSeeder.Start()
+	}()
+
+	before := time.Now()
+
+	// pieces are limited before they are queued, queued messages are written without waits
+	firstSeeder.outcoming <- Message{Piece, make([]byte, 8+blockLength), nil}
+	firstSeeder.outcoming <- Message{Have, MakeHavePayload(1), nil}
+
+	message := <-secondSeeder.incoming
+	assert.EqualValues(t, Piece, message.Id, "wrong message id")
+
+	message = <-secondSeeder.incoming
+	assert.EqualValues(t, Have, message.Id, "wrong message id")
+
+	assert.True(t, time.Since(before) < time.Second, "queued messages are limited")
+
+	firstSeeder.Close()
+	secondSeeder.Close()
+
+	wait.Wait()
+}
+
 func TestSeeder_Start_Disconnect(t *testing.T) {
 
 	infoHash := make([]byte, 20)
@@ -606,3 +681,93 @@ func TestSeeder_MakeAndParsePayload(t *testing.T) {
 	assert.Error(t, err, "parse piece payload with wrong length")
 
 }
+
+func TestSeeder_AllowedFastSet(t *testing.T) {
+
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+	ip := net.ParseIP("80.4.4.200")
+
+	// example of BEP 6
+	pieces := makeAllowedFastSet(ip, infoHash, 1313, 7)
+	assert.Equal(t, []uint32{1059, 431, 808, 1217, 287, 376, 1188}, pieces, "wrong allowed fast set")
+
+	pieces = makeAllowedFastSet(ip, infoHash, 1313, 9)
+	assert.Equal(t, []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}, pieces,
+		"wrong allowed fast set")
+
+	pieces = makeAllowedFastSet(ip, infoHash, 3, 10)
+	assert.Len(t, pieces, 3, "set is larger than piece count")
+
+	pieces = makeAllowedFastSet(net.ParseIP("2001:db8::1"), infoHash, 1313, 10)
+	assert.Empty(t, pieces, "set is generated for ipv6 address")
+}
+
+func TestSeeder_ReadMessage_Fast(t *testing.T) {
+
+	seeder, _ := makeTestSeeder(make([]byte, 20), make([]byte, 20))
+
+	interiorConn, exteriorConn := net.Pipe()
+	seeder.connection = interiorConn
+
+	defer interiorConn.Close()
+	defer exteriorConn.Close()
+
+	haveAll := []byte{0, 0, 0, 1, byte(HaveAll)}
+
+	go exteriorConn.Write(haveAll)
+
+	_, _, err := seeder.readMessage()
+	assert.Error(t, err, "fast message is accepted without negotiation")
+
+	seeder.EnableFast()
+	seeder.PeerReserved = []byte{0, 0, 0, 0, 0, 0, 0, fastExtensionBit}
+
+	go exteriorConn.Write(haveAll)
+
+	id, _, err := seeder.readMessage()
+	assert.NoError(t, err, "fast message is not accepted")
+	assert.EqualValues(t, HaveAll, id, "wrong message id")
+}
+
+func TestSeeder_KeepAlive(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	myPeerId := make([]byte, 20)
+
+	rand.Read(infoHash)
+	rand.Read(myPeerId)
+
+	seeder, _ := makeTestSeeder(infoHash, myPeerId)
+	seeder.keepAliveInterval = 50 * time.Millisecond
+	seeder.readTimeout = 300 * time.Millisecond
+
+	interiorConn, exteriorConn := net.Pipe()
+	seeder.connection = interiorConn
+
+	done := make(chan struct{})
+	go func() {
+		seeder.Start()
+		close(done)
+	}()
+
+	message := make([]byte, 4)
+	_ = exteriorConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadFull(exteriorConn, message)
+	assert.NoError(t, err, "keep-alive is not sent")
+	assert.Equal(t, []byte{0, 0, 0, 0}, message, "unexpected keep-alive")
+
+	_ = exteriorConn.SetReadDeadline(time.Time{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, exteriorConn)
+	}()
+
+	// peer sending nothing is disconnected
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection is not closed")
+	}
+
+	seeder.Close()
+	_ = exteriorConn.Close()
+}
@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"net"
+)
+
+// blockRecord is the hash of the block of failed piece and the peer sent it
+type blockRecord struct {
+	hash [20]byte
+	peer string
+}
+
+func peerHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// Banned reports whether the peer with the address is banned for sending corrupt data
+func (m *Manager) Banned(address string) bool {
+
+	m.bannedMutex.Lock()
+	defer m.bannedMutex.Unlock()
+
+	return m.banned[peerHost(address)]
+}
+
+// ban disconnects the peer host and rejects its connections until the download exists
+func (m *Manager) ban(host string) {
+
+	if host == "" {
+		return
+	}
+
+	managerLogger.WithFields(logrus.Fields{
+		"host":     host,
+		"infoHash": m.infoHash,
+	}).Warn("peer banned for corrupt data")
+
+	m.bannedMutex.Lock()
+	m.banned[host] = true
+	m.bannedMutex.Unlock()
+
+	for _, seeder := range m.getSeederSlice() {
+		if peerHost(seeder.Address) == host {
+			m.handleClosing(seeder)
+		}
+	}
+}
+
+func (m *Manager) checkBanned(conn net.Conn) (err error) {
+	if m.Banned(conn.RemoteAddr().String()) {
+		return errors.Errorf("check banned: peer %s is banned", conn.RemoteAddr())
+	}
+	return nil
+}
+
+// forEachBlock calls the function with global index and data of every block of the piece
+func (m *Manager) forEachBlock(pieceIndex int, data []byte, f func(globalBlockIndex int64, block []byte)) {
+
+	startIndex := m.convertPieceToGlobalBlockIndex(pieceIndex, 0)
+
+	for offset := 0; offset < len(data); offset += blockLength {
+		end := offset + blockLength
+		if end > len(data) {
+			end = len(data)
+		}
+		f(startIndex+int64(offset/blockLength), data[offset:end])
+	}
+}
+
+// handleHashFailure keeps block hashes of every failed attempt of the piece,
+// they are compared with the blocks when the piece is downloaded again
+func (m *Manager) handleHashFailure(pieceIndex int, data []byte) {
+
+	m.forEachBlock(pieceIndex, data, func(globalBlockIndex int64, block []byte) {
+
+		peer := m.blockPeers[globalBlockIndex]
+		delete(m.blockPeers, globalBlockIndex)
+
+		m.failedBlocks[globalBlockIndex] = append(m.failedBlocks[globalBlockIndex],
+			blockRecord{sha1.Sum(block), peer})
+	})
+}
+
+// handleHashSuccess bans the peers sent blocks which differ from the blocks of verified piece
+func (m *Manager) handleHashSuccess(pieceIndex int, data []byte) {
+
+	m.forEachBlock(pieceIndex, data, func(globalBlockIndex int64, block []byte) {
+
+		delete(m.blockPeers, globalBlockIndex)
+
+		records := m.failedBlocks[globalBlockIndex]
+		delete(m.failedBlocks, globalBlockIndex)
+
+		hash := sha1.Sum(block)
+		for _, record := range records {
+			if hash != record.hash {
+				m.ban(record.peer)
+			}
+		}
+	})
+}
@@ -0,0 +1,44 @@
+package torrent
+
+import (
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// DefaultSnubInterval is the time without received blocks after which a peer is snubbed
+const DefaultSnubInterval = time.Minute
+
+// SetSnubInterval sets the time without received blocks after which a peer is snubbed,
+// it has to be called before start
+func (m *Manager) SetSnubInterval(interval time.Duration) {
+	m.snubInterval = interval
+}
+
+// handleSnubTimer snubs the peers which do not send requested blocks,
+// their requests are cancelled and passed to other peers
+func (m *Manager) handleSnubTimer() {
+
+	for _, seeder := range m.getSeederSlice() {
+
+		if seeder.snubbed || len(seeder.requests) == 0 || time.Since(seeder.lastBlock) < m.snubInterval {
+			continue
+		}
+
+		managerLogger.WithFields(logrus.Fields{
+			"peerId":   seeder.PeerId,
+			"requests": len(seeder.requests),
+			"infoHash": m.infoHash,
+		}).Debug("peer snubbed")
+
+		seeder.snubbed = true
+
+		for globalBlockIndex := range seeder.requests {
+			pieceIndex, blockIndex := m.convertGlobalBlockToPieceIndex(globalBlockIndex)
+			index, offset, length := m.convertPieceIndexToOffset(pieceIndex, blockIndex)
+			seeder.outcoming <- Message{Cancel, MakeCancelPayload(index, offset, length), m.peerId}
+		}
+
+		m.releaseRequests(seeder)
+		m.redistributeRequests(seeder)
+	}
+}
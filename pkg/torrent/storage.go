@@ -2,19 +2,105 @@ package torrent
 
 import (
 	"github.com/juju/errors"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
 )
 
+// StorageProvider opens the storage of the torrent,
+// embedding applications implement it to keep the data out of the files
+type StorageProvider interface {
+	OpenTorrent(info *Info, infoHash []byte) (TorrentStorage, error)
+}
+
+// TorrentStorage keeps the data of the torrent
+type TorrentStorage interface {
+	Piece(index int) PieceStorage
+	// Flush makes the written data persistent
+	Flush() error
+	Close() error
+}
+
+// PieceStorage reads and writes the data of the piece at the offsets in the piece
+type PieceStorage interface {
+	io.ReaderAt
+	io.WriterAt
+	// MarkComplete is called when the hash of the piece is verified
+	MarkComplete() error
+}
+
+// fileStorage is the storage keeping the data in the files of the torrent,
+// the files are opened according to the priorities and checked with resume data
+type fileStorage interface {
+	openFile(index int, create bool) error
+	modTimes() ([]int64, error)
+	hasData() bool
+}
+
+type fileStorageProvider struct {
+	basePath string
+}
+
+// NewFileStorageProvider returns the provider of the storages keeping the data
+// in the files of the torrent in the directory, the files are created on start
+func NewFileStorageProvider(basePath string) StorageProvider {
+	return fileStorageProvider{basePath}
+}
+
+func (p fileStorageProvider) OpenTorrent(info *Info, infoHash []byte) (TorrentStorage, error) {
+	return newStorage(*info, p.basePath)
+}
+
+// Storage is the file storage, the offsets of ReadAt and WriteAt are the offsets in the torrent
 type Storage struct {
-	files     []*os.File
-	fileInfos []os.FileInfo
-	totalSize int64
+	// files are nil until they are opened, data of not opened files
+	// is kept in the part file at the same offsets as in the torrent
+	files   []*os.File
+	paths   []string
+	lengths []int64
+	offsets []int64
+
+	parts     *os.File
+	partsPath string
+
+	pieceLength int64
+	totalSize   int64
+
+	// opened files are accessed through the mapper if it is set
+	mapper *fileMapper
+
+	// some of the files had data before the storage is opened
+	existing bool
+	closed   bool
+
+	mutex sync.RWMutex
 }
 
+// NewStorage creates the files of the torrent and opens them
 func NewStorage(info Info, basePath string) (s *Storage, err error) {
 
+	s, err = newStorage(info, basePath)
+	if err != nil {
+		return nil, errors.Annotate(err, "new storage")
+	}
+
+	for index := range s.files {
+		err = s.openFile(index, true)
+		if err != nil {
+			return nil, errors.Annotate(err, "new storage")
+		}
+	}
+
+	return s, nil
+
+}
+
+// newStorage returns the storage without opened files,
+// the part file left from the previous run is opened
+func newStorage(info Info, basePath string) (s *Storage, err error) {
+
 	s = new(Storage)
 
 	for _, infoFile := range info.Files {
@@ -24,44 +110,165 @@ func NewStorage(info Info, basePath string) (s *Storage, err error) {
 			filePath = path.Join(filePath, pathPart)
 		}
 
-		err = os.MkdirAll(filepath.Dir(filePath), 0775)
+		s.paths = append(s.paths, filePath)
+		s.lengths = append(s.lengths, infoFile.Length)
+		s.offsets = append(s.offsets, s.totalSize)
+
+		s.totalSize += infoFile.Length
+	}
+
+	s.files = make([]*os.File, len(s.paths))
+	s.partsPath = path.Join(basePath, "."+info.Name+".parts")
+	s.pieceLength = info.PieceLength
+
+	s.parts, err = os.OpenFile(s.partsPath, os.O_RDWR, 0664)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.Annotate(err, "new storage")
+	}
+
+	s.existing = true
+
+	return s, nil
+}
+
+// openFile opens the file if it exists or creates it if create is set,
+// the data of the file kept in the part file is moved to the created file
+func (s *Storage) openFile(index int, create bool) (err error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return errors.Errorf("storage open file: storage is closed")
+	}
+
+	if s.files[index] != nil {
+		return nil
+	}
+
+	filePath := s.paths[index]
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Annotate(err, "storage open file")
+	}
+
+	created := os.IsNotExist(err)
+	if created && !create {
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(filePath), 0775)
+	if err != nil {
+		return errors.Annotate(err, "storage open file")
+	}
+
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0775)
+	if err != nil {
+		return errors.Annotate(err, "storage open file")
+	}
+
+	if !created && fileInfo.Size() > 0 {
+		s.existing = true
+	}
+
+	if created || fileInfo.Size() != s.lengths[index] {
+		err = file.Truncate(s.lengths[index])
+		if err != nil {
+			_ = file.Close()
+			return errors.Annotate(err, "storage open file")
+		}
+	}
+
+	if created {
+		err = s.moveParts(index, file)
 		if err != nil {
-			return nil, errors.Annotate(err, "new storage")
+			_ = file.Close()
+			return errors.Annotate(err, "storage open file")
 		}
+	}
+
+	s.files[index] = file
+
+	return nil
+}
+
+// moveParts copies the data of the file from the part file,
+// only the pieces at the file boundaries may be downloaded to the part file
+func (s *Storage) moveParts(index int, file *os.File) (err error) {
+
+	if s.parts == nil || s.lengths[index] == 0 {
+		return nil
+	}
+
+	start := s.offsets[index]
+	end := start + s.lengths[index]
+
+	firstPieceEnd := (start/s.pieceLength + 1) * s.pieceLength
+	if firstPieceEnd > end {
+		firstPieceEnd = end
+	}
 
-		file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0775)
+	lastPieceStart := (end - 1) / s.pieceLength * s.pieceLength
+	if lastPieceStart < firstPieceEnd {
+		lastPieceStart = firstPieceEnd
+	}
+
+	for _, r := range [][2]int64{{start, firstPieceEnd}, {lastPieceStart, end}} {
+
+		data := make([]byte, r[1]-r[0])
+
+		err = s.readParts(data, r[0])
 		if err != nil {
-			return nil, errors.Annotate(err, "new storage")
+			return errors.Annotate(err, "storage move parts")
 		}
 
-		fileInfo, err := file.Stat()
+		_, err = file.WriteAt(data, r[0]-start)
 		if err != nil {
-			return nil, errors.Annotate(err, "new storage")
+			return errors.Annotate(err, "storage move parts")
 		}
+	}
 
-		if fileInfo.Size() != infoFile.Length {
+	return nil
+}
 
-			err = file.Truncate(infoFile.Length)
-			if err != nil {
-				return nil, errors.Annotate(err, "new storage")
-			}
+// readParts reads the data of not opened files, data never written is zero
+func (s *Storage) readParts(b []byte, off int64) (err error) {
 
-			fileInfo, err = file.Stat()
-			if err != nil {
-				return nil, errors.Annotate(err, "new storage")
-			}
+	n := 0
 
+	if s.parts != nil {
+		n, err = s.parts.ReadAt(b, off)
+		if err != nil && err != io.EOF {
+			return errors.Annotate(err, "storage read parts")
 		}
+	}
 
-		s.files = append(s.files, file)
-		s.fileInfos = append(s.fileInfos, fileInfo)
+	for i := n; i < len(b); i++ {
+		b[i] = 0
+	}
 
-		s.totalSize += infoFile.Length
+	return nil
+}
 
+func (s *Storage) writeParts(b []byte, off int64) (err error) {
+
+	if s.parts == nil {
+		s.parts, err = os.OpenFile(s.partsPath, os.O_RDWR|os.O_CREATE, 0664)
+		if err != nil {
+			return errors.Annotate(err, "storage write parts")
+		}
 	}
 
-	return s, nil
+	_, err = s.parts.WriteAt(b, off)
+	if err != nil {
+		return errors.Annotate(err, "storage write parts")
+	}
 
+	return nil
 }
 
 func (s *Storage) ReadAt(b []byte, off int64) (n int, err error) {
@@ -70,6 +277,13 @@ func (s *Storage) ReadAt(b []byte, off int64) (n int, err error) {
 		return 0, errors.Annotate(err, "storage read at")
 	}
 
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.closed {
+		return 0, errors.Errorf("storage read at: storage is closed")
+	}
+
 	fileOffset, firstFileIndex, fileCount := s.convertToFileOffset(off, int64(len(b)))
 
 	leftBytes := int64(len(b))
@@ -82,23 +296,40 @@ func (s *Storage) ReadAt(b []byte, off int64) (n int, err error) {
 
 	for i := firstFileIndex; i < firstFileIndex+fileCount; i++ {
 
-		fileInfo := s.fileInfos[i]
-
-		if currentOffset+leftBytes < fileInfo.Size() {
+		if currentOffset+leftBytes < s.lengths[i] {
 			blockSize = leftBytes
 		} else {
-			blockSize = fileInfo.Size() - currentOffset
+			blockSize = s.lengths[i] - currentOffset
 			nextOffset = 0
 		}
 
-		n, err := s.files[i].ReadAt(b[readBytes:readBytes+blockSize], currentOffset)
+		block := b[readBytes : readBytes+blockSize]
 
-		if err != nil {
-			return 0, errors.Annotate(err, "storage read at")
-		}
+		if s.files[i] == nil {
+
+			err := s.readParts(block, s.offsets[i]+currentOffset)
+			if err != nil {
+				return 0, errors.Annotate(err, "storage read at")
+			}
+
+		} else if s.mapper != nil {
 
-		if int64(n) != blockSize {
-			panic("read: block length != n")
+			err := s.mapper.copy(s.files[i], s.lengths[i], block, currentOffset, false)
+			if err != nil {
+				return 0, errors.Annotate(err, "storage read at")
+			}
+
+		} else {
+
+			n, err := s.files[i].ReadAt(block, currentOffset)
+
+			if err != nil {
+				return 0, errors.Annotate(err, "storage read at")
+			}
+
+			if int64(n) != blockSize {
+				panic("read: block length != n")
+			}
 		}
 
 		readBytes += blockSize
@@ -122,6 +353,14 @@ func (s *Storage) WriteAt(b []byte, off int64) (n int, err error) {
 		return 0, errors.Annotate(err, "storage write at")
 	}
 
+	// the part file may be created
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return 0, errors.Errorf("storage write at: storage is closed")
+	}
+
 	fileOffset, firstFileIndex, fileCount := s.convertToFileOffset(off, int64(len(b)))
 
 	leftBytes := int64(len(b))
@@ -132,23 +371,40 @@ func (s *Storage) WriteAt(b []byte, off int64) (n int, err error) {
 
 	for i := firstFileIndex; i < firstFileIndex+fileCount; i++ {
 
-		fileInfo := s.fileInfos[i]
-
-		if currentOffset+leftBytes < fileInfo.Size() {
+		if currentOffset+leftBytes < s.lengths[i] {
 			blockSize = leftBytes
 		} else {
-			blockSize = fileInfo.Size() - currentOffset
+			blockSize = s.lengths[i] - currentOffset
 			nextOffset = 0
 		}
 
-		n, err := s.files[i].WriteAt(b[wroteBytes:wroteBytes+blockSize], currentOffset)
+		block := b[wroteBytes : wroteBytes+blockSize]
 
-		if err != nil {
-			return 0, errors.Annotate(err, "storage write at")
-		}
+		if s.files[i] == nil {
+
+			err := s.writeParts(block, s.offsets[i]+currentOffset)
+			if err != nil {
+				return 0, errors.Annotate(err, "storage write at")
+			}
+
+		} else if s.mapper != nil {
+
+			err := s.mapper.copy(s.files[i], s.lengths[i], block, currentOffset, true)
+			if err != nil {
+				return 0, errors.Annotate(err, "storage write at")
+			}
+
+		} else {
 
-		if int64(n) != blockSize {
-			panic("write: block length != n")
+			n, err := s.files[i].WriteAt(block, currentOffset)
+
+			if err != nil {
+				return 0, errors.Annotate(err, "storage write at")
+			}
+
+			if int64(n) != blockSize {
+				panic("write: block length != n")
+			}
 		}
 
 		wroteBytes += blockSize
@@ -165,24 +421,185 @@ func (s *Storage) WriteAt(b []byte, off int64) (n int, err error) {
 	return int(wroteBytes), nil
 }
 
+// modTimes returns modification times of the files and the part file in nanoseconds,
+// zero for not opened files
+func (s *Storage) modTimes() (times []int64, err error) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, file := range s.files {
+		times = append(times, 0)
+		if file != nil {
+			fileInfo, err := file.Stat()
+			if err != nil {
+				return nil, errors.Annotate(err, "storage mod times")
+			}
+			times[len(times)-1] = fileInfo.ModTime().UnixNano()
+		}
+	}
+
+	partsModTime := int64(0)
+	if s.parts != nil {
+		fileInfo, err := s.parts.Stat()
+		if err != nil {
+			return nil, errors.Annotate(err, "storage mod times")
+		}
+		partsModTime = fileInfo.ModTime().UnixNano()
+	}
+
+	return append(times, partsModTime), nil
+}
+
+func (s *Storage) hasData() bool {
+	return s.existing
+}
+
+func (s *Storage) Piece(index int) PieceStorage {
+	return filePiece{s, int64(index) * s.pieceLength}
+}
+
+// Flush syncs the opened files to the disk
+func (s *Storage) Flush() (err error) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.mapper != nil {
+		err = s.mapper.syncAll()
+		if err != nil {
+			return errors.Annotate(err, "storage flush")
+		}
+	}
+
+	for _, file := range append([]*os.File{s.parts}, s.files...) {
+		if file == nil {
+			continue
+		}
+		err = file.Sync()
+		if err != nil {
+			return errors.Annotate(err, "storage flush")
+		}
+	}
+
+	return nil
+}
+
+func (s *Storage) Close() (err error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	// the files are closed after they are unmapped
+	if s.mapper != nil {
+		err = s.mapper.close()
+	}
+
+	for _, file := range append([]*os.File{s.parts}, s.files...) {
+		if file == nil {
+			continue
+		}
+		closeErr := file.Close()
+		if closeErr != nil && err == nil {
+			err = errors.Annotate(closeErr, "storage close")
+		}
+	}
+
+	return err
+}
+
+type filePiece struct {
+	storage *Storage
+	offset  int64
+}
+
+func (p filePiece) ReadAt(b []byte, off int64) (n int, err error) {
+	return p.storage.ReadAt(b, p.offset+off)
+}
+
+func (p filePiece) WriteAt(b []byte, off int64) (n int, err error) {
+	return p.storage.WriteAt(b, p.offset+off)
+}
+
+// MarkComplete syncs the mapped data of the piece to the disk
+func (p filePiece) MarkComplete() error {
+
+	if p.storage.mapper == nil {
+		return nil
+	}
+
+	err := p.storage.syncMapped(p.offset, p.storage.pieceLength)
+	if err != nil {
+		return errors.Annotate(err, "file piece mark complete")
+	}
+
+	return nil
+}
+
+// syncMapped syncs the mapped data of the opened files in the range of the torrent
+func (s *Storage) syncMapped(off, length int64) (err error) {
+
+	if off+length > s.totalSize {
+		length = s.totalSize - off
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.closed {
+		return errors.Errorf("storage sync mapped: storage is closed")
+	}
+
+	for i, file := range s.files {
+
+		start := off - s.offsets[i]
+		end := start + length
+
+		if file == nil || end <= 0 || start >= s.lengths[i] {
+			continue
+		}
+
+		if start < 0 {
+			start = 0
+		}
+
+		if end > s.lengths[i] {
+			end = s.lengths[i]
+		}
+
+		err = s.mapper.sync(file, start, end-start)
+		if err != nil {
+			return errors.Annotate(err, "storage sync mapped")
+		}
+	}
+
+	return nil
+}
+
 func (s *Storage) convertToFileOffset(offset, length int64) (fileOffset int64, firstFileIndex, fileCount int) {
 
 	fileOffset = offset
 	fileCount = 1
 
-	for index, fileInfo := range s.fileInfos {
-		if fileOffset < fileInfo.Size() {
+	for index, fileLength := range s.lengths {
+		if fileOffset < fileLength {
 			firstFileIndex = index
 			break
 		}
-		fileOffset -= fileInfo.Size()
+		fileOffset -= fileLength
 	}
 
-	fileSize := s.fileInfos[firstFileIndex].Size()
+	fileSize := s.lengths[firstFileIndex]
 
 	for fileOffset+length > fileSize {
 		fileCount += 1
-		fileSize += s.fileInfos[firstFileIndex+fileCount-1].Size()
+		fileSize += s.lengths[firstFileIndex+fileCount-1]
 	}
 
 	return fileOffset, firstFileIndex, fileCount
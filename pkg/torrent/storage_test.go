@@ -262,3 +262,46 @@ func TestStorage_ReadAt_BreakBoundaries(t *testing.T) {
 	_, err = storage.ReadAt(data, -blockSize)
 	assert.Error(t, err, "write out of boundaries")
 }
+
+func TestStorage_Parts(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "TestStorage_Parts")
+	assert.NoError(t, err, "can not create temp dir")
+
+	info, filenames := makeTestInfo()
+	info.PieceLength = blockSize
+
+	storage, err := newStorage(info, dir)
+	assert.NoError(t, err, "can not create storage")
+
+	assert.NoError(t, storage.openFile(0, true), "can not open file")
+	assert.NoError(t, storage.openFile(1, false), "can not open file")
+
+	_, err = os.Stat(path.Join(dir, filenames[1]))
+	assert.True(t, os.IsNotExist(err), "skipped file is created")
+
+	// block of the piece at the boundary of the skipped file
+	testData := make([]byte, blockSize)
+	rand.Read(testData)
+
+	_, err = storage.WriteAt(testData, fileSize-blockSize/2)
+	assert.NoError(t, err, "can not write to storage")
+
+	_, err = os.Stat(path.Join(dir, filenames[1]))
+	assert.True(t, os.IsNotExist(err), "skipped file is created")
+
+	data := make([]byte, blockSize)
+	_, err = storage.ReadAt(data, fileSize-blockSize/2)
+	assert.NoError(t, err, "can not read from storage")
+	assert.EqualValues(t, testData, data, "data of skipped file is not kept")
+
+	// data is moved to the file when it is created
+	assert.NoError(t, storage.openFile(1, true), "can not open file")
+
+	file, err := os.Open(path.Join(dir, filenames[1]))
+	assert.NoError(t, err, "file is not created")
+
+	_, err = file.ReadAt(data[:blockSize/2], 0)
+	assert.NoError(t, err, "can not read from file")
+	assert.EqualValues(t, testData[blockSize/2:], data[:blockSize/2], "data is not moved to the file")
+}
@@ -7,12 +7,24 @@ import (
 	"github.com/sirupsen/logrus"
 	"math/rand"
 	"net"
+	"net/url"
+	"strconv"
 	"sync"
 	"time"
 )
 
 const connectionLifetime = time.Minute
 
+const maxScrapeInfoHashes = 74
+
+// request is retransmitted after 15 * 2 ^ n seconds, n = 0..8 (BEP 15)
+const retransmissionTimeout = 15 * time.Second
+const maxRetransmissions = 8
+
+// tracker of the tracker list is retransmitted fewer times, so the next tracker
+// is tried after 15 + 30 + 60 seconds instead of hours
+const listMaxRetransmissions = 2
+
 type Event uint32
 
 const (
@@ -38,6 +50,76 @@ type AnnounceResponse struct {
 	Peers            []string
 }
 
+type ScrapeResponse struct {
+	SeedersCount   uint32
+	CompletedCount uint32
+	LechersCount   uint32
+}
+
+type TrackerError struct {
+	Message string
+}
+
+func (e TrackerError) Error() string {
+	return fmt.Sprintf("tracker responded with error: %s", e.Message)
+}
+
+type trackerClient interface {
+	Close()
+	announce(request AnnounceRequest) (response AnnounceResponse, err error)
+	scrape(infoHashes [][]byte) (responses []ScrapeResponse, err error)
+}
+
+func newTrackerClient(peerId, infoHash []byte, announceUrl string) (tracker trackerClient, err error) {
+
+	parsedUrl, err := url.Parse(announceUrl)
+	if err != nil {
+		return nil, errors.Annotate(err, "new tracker client")
+	}
+
+	switch parsedUrl.Scheme {
+
+	case "udp":
+		conn, err := net.Dial("udp", parsedUrl.Host)
+		if err != nil {
+			return nil, errors.Annotate(err, "new tracker client")
+		}
+		udpTracker, err := NewTracker(peerId, infoHash, conn)
+		if err != nil {
+			return nil, errors.Annotate(err, "new tracker client")
+		}
+		udpTracker.maxRetransmissions = listMaxRetransmissions
+		return udpTracker, nil
+
+	case "http", "https":
+		httpTracker, err := NewHttpTracker(peerId, infoHash, announceUrl)
+		if err != nil {
+			return nil, errors.Annotate(err, "new tracker client")
+		}
+		return httpTracker, nil
+
+	}
+
+	return nil, errors.Errorf("new tracker client: unsupported scheme %s", parsedUrl.Scheme)
+}
+
+func ScrapeTracker(announceUrl string, infoHashes [][]byte) (responses []ScrapeResponse, err error) {
+
+	tracker, err := newTrackerClient(nil, nil, announceUrl)
+	if err != nil {
+		return nil, errors.Annotate(err, "scrape tracker")
+	}
+
+	defer tracker.Close()
+
+	responses, err = tracker.scrape(infoHashes)
+	if err != nil {
+		return nil, errors.Annotate(err, "scrape tracker")
+	}
+
+	return responses, nil
+}
+
 type Tracker struct {
 	connection net.Conn
 
@@ -47,17 +129,13 @@ type Tracker struct {
 
 	expirationTimer *time.Timer
 
-	announceRequestChannel  chan AnnounceRequest
-	announceResponseChannel chan AnnounceResponse
+	retransmissionTimeout time.Duration
+	maxRetransmissions    int
 
 	peerId   []byte
 	infoHash []byte
 
-	closed bool
-
-	closeMutex sync.Mutex
-	closeWait  sync.WaitGroup
-	closeOnce  sync.Once
+	closeOnce sync.Once
 }
 
 func NewTracker(peerId, infoHash []byte, connection net.Conn) (tracker *Tracker, err error) {
@@ -71,8 +149,8 @@ func NewTracker(peerId, infoHash []byte, connection net.Conn) (tracker *Tracker,
 
 	tracker.expire = true
 
-	tracker.announceRequestChannel = make(chan AnnounceRequest, 1)
-	tracker.announceResponseChannel = make(chan AnnounceResponse, 1)
+	tracker.retransmissionTimeout = retransmissionTimeout
+	tracker.maxRetransmissions = maxRetransmissions
 
 	tracker.infoHash = infoHash
 	tracker.peerId = peerId
@@ -81,81 +159,9 @@ func NewTracker(peerId, infoHash []byte, connection net.Conn) (tracker *Tracker,
 
 }
 
-func (t *Tracker) Run() (err error) {
-
-	if t.closed == true {
-		return errors.Annotate(
-			errors.New("connection was already closed"),
-			"tracker run")
-	}
-
-	trackerLogger.WithFields(logrus.Fields{
-		"address": t.connection.RemoteAddr(),
-	}).Info("tracker connection is serviced")
-
-	t.closeWait.Add(1)
-	defer t.closeWait.Done()
-
-	for {
-
-		select {
-
-		case _, ok := <-t.expirationTimer.C:
-
-			if !ok {
-				return nil
-			}
-
-			trackerLogger.WithFields(logrus.Fields{
-				"address":       t.connection.RemoteAddr(),
-				"connection id": t.connectionId,
-			}).Trace("connection id expired")
-
-			t.expire = true
-
-		case request, ok := <-t.announceRequestChannel:
-
-			if !ok {
-				return nil
-			}
-
-			response, err := t.announce(request)
-			if err != nil {
-				t.closeMutex.Lock()
-				if t.closed {
-					t.closeMutex.Unlock()
-					return nil
-				} else {
-					trackerLogger.WithFields(logrus.Fields{
-						"address": t.connection.RemoteAddr(),
-					}).Error(err.Error())
-
-					t.close()
-					t.closeMutex.Unlock()
-					return err
-				}
-			}
-
-			t.announceResponseChannel <- response
-		}
-	}
-}
-
 func (t *Tracker) Close() {
-
-	t.closeMutex.Lock()
-	t.close()
-	t.closeMutex.Unlock()
-	t.closeWait.Wait()
-
-}
-
-func (t *Tracker) close() {
 	t.closeOnce.Do(func() {
-		t.closed = true
 		_ = t.connection.Close()
-		close(t.announceResponseChannel)
-		close(t.announceRequestChannel)
 
 		trackerLogger.WithFields(logrus.Fields{
 			"address": t.connection.RemoteAddr(),
@@ -166,6 +172,12 @@ func (t *Tracker) close() {
 
 func (t *Tracker) establishConnection() (connectionId uint64, err error) {
 
+	select {
+	case <-t.expirationTimer.C:
+		t.expire = true
+	default:
+	}
+
 	if !t.expire {
 		return t.connectionId, nil
 	}
@@ -173,15 +185,14 @@ func (t *Tracker) establishConnection() (connectionId uint64, err error) {
 	transactionId := rand.Uint32()
 
 	request := makeConnectionRequest(transactionId)
-	_, err = t.connection.Write(request)
+	response := make([]byte, 1024)
 
+	n, err := t.roundTrip(request, response, transactionId)
 	if err != nil {
 		return 0,
 			errors.Annotate(err, "establish connection")
 	}
 
-	response := make([]byte, 16)
-	n, err := t.connection.Read(response)
 	t.connectionId, err = parseConnectionResponse(response[:n], transactionId)
 
 	if err != nil {
@@ -203,6 +214,8 @@ func (t *Tracker) establishConnection() (connectionId uint64, err error) {
 
 func (t *Tracker) announce(request AnnounceRequest) (response AnnounceResponse, err error) {
 
+	defer t.expireOnError(&err)
+
 	connectionId, err := t.establishConnection()
 	if err != nil {
 		return AnnounceResponse{},
@@ -212,28 +225,26 @@ func (t *Tracker) announce(request AnnounceRequest) (response AnnounceResponse,
 	transactionId := rand.Uint32()
 	data := makeAnnounceRequest(t.peerId, t.infoHash, connectionId, transactionId, request)
 
-	_, err = t.connection.Write(data)
-
-	if err != nil {
-		return AnnounceResponse{},
-			errors.Annotate(err, "tracker announce")
-	}
-
 	trackerLogger.WithFields(logrus.Fields{
 		"address": t.connection.RemoteAddr(),
 		"event":   request.Event,
 		"port":    request.Port,
 	}).Trace("announce request sent")
 
-	data = make([]byte, 1024)
-	n, err := t.connection.Read(data)
+	buffer := make([]byte, 1024)
+	n, err := t.roundTrip(data, buffer, transactionId)
 
 	if err != nil {
 		return AnnounceResponse{},
 			errors.Annotate(err, "tracker announce")
 	}
 
-	response, err = parseAnnounceResponse(data[:n], transactionId)
+	ipLength := net.IPv4len
+	if isIPv6Address(t.connection.RemoteAddr()) {
+		ipLength = net.IPv6len
+	}
+
+	response, err = parseAnnounceResponse(buffer[:n], transactionId, ipLength)
 
 	if err != nil {
 		return AnnounceResponse{},
@@ -251,6 +262,136 @@ func (t *Tracker) announce(request AnnounceRequest) (response AnnounceResponse,
 
 }
 
+func (t *Tracker) scrape(infoHashes [][]byte) (responses []ScrapeResponse, err error) {
+
+	defer t.expireOnError(&err)
+
+	for start := 0; start < len(infoHashes); start += maxScrapeInfoHashes {
+
+		end := start + maxScrapeInfoHashes
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		connectionId, err := t.establishConnection()
+		if err != nil {
+			return nil,
+				errors.Annotate(err, "tracker scrape")
+		}
+
+		transactionId := rand.Uint32()
+		data := makeScrapeRequest(connectionId, transactionId, infoHashes[start:end])
+
+		trackerLogger.WithFields(logrus.Fields{
+			"address": t.connection.RemoteAddr(),
+			"count":   end - start,
+		}).Trace("scrape request sent")
+
+		buffer := make([]byte, 8+12*maxScrapeInfoHashes)
+		n, err := t.roundTrip(data, buffer, transactionId)
+		if err != nil {
+			return nil,
+				errors.Annotate(err, "tracker scrape")
+		}
+
+		batch, err := parseScrapeResponse(buffer[:n], transactionId, end-start)
+		if err != nil {
+			return nil,
+				errors.NewNotValid(err, "tracker scrape")
+		}
+
+		responses = append(responses, batch...)
+	}
+
+	trackerLogger.WithFields(logrus.Fields{
+		"address": t.connection.RemoteAddr(),
+		"count":   len(responses),
+	}).Trace("scrape response received")
+
+	return responses, nil
+}
+
+// expireOnError makes the next request get new connection id after failed request
+func (t *Tracker) expireOnError(err *error) {
+	if *err != nil {
+		t.expire = true
+	}
+}
+
+// roundTrip sends request and waits for a response with the same transaction id,
+// the request is retransmitted if there is no response in time
+func (t *Tracker) roundTrip(request, response []byte, transactionId uint32) (n int, err error) {
+
+	defer func() {
+		_ = t.connection.SetReadDeadline(time.Time{})
+	}()
+
+	for attempt := 0; attempt <= t.maxRetransmissions; attempt++ {
+
+		if attempt > 0 {
+			trackerLogger.WithFields(logrus.Fields{
+				"address": t.connection.RemoteAddr(),
+				"attempt": attempt,
+			}).Trace("request is retransmitted")
+		}
+
+		_, err = t.connection.Write(request)
+		if err != nil {
+			return 0, errors.Annotate(err, "round trip")
+		}
+
+		err = t.connection.SetReadDeadline(time.Now().Add(t.retransmissionTimeout << uint(attempt)))
+		if err != nil {
+			return 0, errors.Annotate(err, "round trip")
+		}
+
+		for {
+
+			n, err = t.connection.Read(response)
+
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			}
+
+			if err != nil {
+				return 0, errors.Annotate(err, "round trip")
+			}
+
+			if n < 8 || binary.BigEndian.Uint32(response[4:8]) != transactionId {
+				trackerLogger.WithFields(logrus.Fields{
+					"address": t.connection.RemoteAddr(),
+					"length":  n,
+				}).Trace("unexpected datagram is ignored")
+				continue
+			}
+
+			if binary.BigEndian.Uint32(response[0:4]) == 3 {
+				return 0, errors.Annotate(parseErrorResponse(response[:n]), "round trip")
+			}
+
+			return n, nil
+		}
+	}
+
+	return 0, errors.Timeoutf("round trip: tracker doesn't respond after %d retransmissions", t.maxRetransmissions)
+}
+
+func isIPv6Address(addr net.Addr) bool {
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+
+	return ok && udpAddr.IP.To4() == nil
+}
+
+func isTransientTrackerError(err error) bool {
+
+	if _, ok := errors.Cause(err).(TrackerError); ok {
+		return true
+	}
+
+	return errors.IsNotValid(err) || errors.IsTimeout(err)
+}
+
 func makeConnectionRequest(transactionId uint32) []byte {
 
 	request := make([]byte, 16)
@@ -359,8 +500,9 @@ func makeAnnounceRequest(peerId, infoHash []byte, connectionId uint64, transacti
 //20 + 6 * n  32-bit integer  IP address
 //24 + 6 * n  16-bit integer  TCP port
 //20 + 6 * N
+// IPv6 trackers respond with 16-byte IP addresses, 18 bytes per peer
 
-func parseAnnounceResponse(data []byte, expectedTransactionId uint32) (response AnnounceResponse, err error) {
+func parseAnnounceResponse(data []byte, expectedTransactionId uint32, ipLength int) (response AnnounceResponse, err error) {
 
 	if len(data) < 20 {
 		return AnnounceResponse{},
@@ -394,19 +536,102 @@ func parseAnnounceResponse(data []byte, expectedTransactionId uint32) (response
 	response.LechersCount = binary.BigEndian.Uint32(lechersNumberBytes)
 	response.SeedersCount = binary.BigEndian.Uint32(seedersNumberBytes)
 
-	receivedPeersCount := (len(data) - 20) / 6
-	response.Peers = make([]string, receivedPeersCount)
+	response.Peers = parseCompactPeers(data[20:], ipLength)
+
+	return response, nil
+}
+
+//Offset  Size            Name            Value
+//0       32-bit integer  action          3 // error
+//4       32-bit integer  transaction_id
+//8       string          message
+
+func parseErrorResponse(data []byte) TrackerError {
+	return TrackerError{string(data[8:])}
+}
+
+// parseCompactPeers decodes compact peer list, ipLength is net.IPv4len
+// for IPv4 peers and net.IPv6len for IPv6 peers (BEP 7)
+func parseCompactPeers(data []byte, ipLength int) (peers []string) {
+
+	peerLength := ipLength + 2
+	peersCount := len(data) / peerLength
+	peers = make([]string, peersCount)
 
-	for i := 0; i < int(receivedPeersCount); i++ {
+	for i := 0; i < peersCount; i++ {
 
-		addrBytes := data[20+6*i : 20+6*(i+1)]
-		addrString := fmt.Sprintf("%d.%d.%d.%d:%d",
-			addrBytes[0], addrBytes[1], addrBytes[2], addrBytes[3],
-			binary.BigEndian.Uint16(addrBytes[4:6]))
+		addrBytes := data[peerLength*i : peerLength*(i+1)]
 
-		response.Peers[i] = addrString
+		ip := net.IP(addrBytes[:ipLength])
+		port := binary.BigEndian.Uint16(addrBytes[ipLength:])
 
+		peers[i] = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
 	}
 
-	return response, nil
+	return peers
+}
+
+//Offset          Size            Name            Value
+//0               64-bit integer  connection_id
+//8               32-bit integer  action          2 // scrape
+//12              32-bit integer  transaction_id
+//16 + 20 * n     20-byte string  info_hash
+//16 + 20 * N
+
+func makeScrapeRequest(connectionId uint64, transactionId uint32, infoHashes [][]byte) (data []byte) {
+
+	data = make([]byte, 16+20*len(infoHashes))
+
+	binary.BigEndian.PutUint64(data[0:8], connectionId)
+	binary.BigEndian.PutUint32(data[8:12], 2) // scrape
+	binary.BigEndian.PutUint32(data[12:16], transactionId)
+
+	for i, infoHash := range infoHashes {
+		copy(data[16+20*i:16+20*(i+1)], infoHash)
+	}
+
+	return data
+}
+
+//Offset      Size            Name            Value
+//0           32-bit integer  action          2 // scrape
+//4           32-bit integer  transaction_id
+//8 + 12 * n  32-bit integer  seeders
+//12 + 12 * n 32-bit integer  completed
+//16 + 12 * n 32-bit integer  leechers
+//8 + 12 * N
+
+func parseScrapeResponse(data []byte, expectedTransactionId uint32, count int) (responses []ScrapeResponse, err error) {
+
+	if len(data) < 8+12*count {
+		return nil,
+			errors.Annotate(
+				errors.Errorf("message length %d < %d", len(data), 8+12*count),
+				"parse scrape response")
+	}
+
+	if binary.BigEndian.Uint32(data[4:8]) != expectedTransactionId {
+		return nil,
+			errors.Annotate(
+				errors.Errorf("transaction id doesn't match expected value"),
+				"parse scrape response")
+	}
+
+	if binary.BigEndian.Uint32(data[0:4]) != 2 {
+		return nil,
+			errors.Annotate(
+				errors.Errorf("action is not scrape"),
+				"parse scrape response")
+	}
+
+	responses = make([]ScrapeResponse, count)
+
+	for i := range responses {
+		offset := 8 + 12*i
+		responses[i].SeedersCount = binary.BigEndian.Uint32(data[offset : offset+4])
+		responses[i].CompletedCount = binary.BigEndian.Uint32(data[offset+4 : offset+8])
+		responses[i].LechersCount = binary.BigEndian.Uint32(data[offset+8 : offset+12])
+	}
+
+	return responses, nil
 }
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"github.com/juju/errors"
 	"github.com/stretchr/testify/assert"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"sync"
@@ -13,7 +15,46 @@ import (
 	"time"
 )
 
-func TestTracker_Run(t *testing.T) {
+type testAnnounceResult struct {
+	response AnnounceResponse
+	err      error
+}
+
+// announceTestTracker announces in separate routine, the result is sent to the channel
+func announceTestTracker(tracker *Tracker, request AnnounceRequest) <-chan testAnnounceResult {
+
+	results := make(chan testAnnounceResult, 1)
+
+	go func() {
+		response, err := tracker.announce(request)
+		results <- testAnnounceResult{response, err}
+	}()
+
+	return results
+}
+
+func requestTestTrackerConnection(t *testing.T, tracker *Tracker, exteriorConn net.Conn) ([]byte, <-chan testAnnounceResult) {
+
+	results := announceTestTracker(tracker, AnnounceRequest{
+		None,
+		rand.Uint64(),
+		rand.Uint64(),
+		rand.Uint64(),
+		uint16(rand.Int()),
+		rand.Uint32(),
+	})
+
+	buffer := make([]byte, 16)
+	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
+	assert.NoError(t, err, fmt.Sprintf("can not read 16 bytes: n = %d", n))
+
+	assert.EqualValues(t, 0x41727101980, binary.BigEndian.Uint64(buffer[0:8]), "wrong protocol ID")
+	assert.EqualValues(t, 0, binary.BigEndian.Uint32(buffer[8:12]), "wrong action ID")
+
+	return buffer, results
+}
+
+func TestTracker_Announce(t *testing.T) {
 
 	infoHash := make([]byte, 20)
 	myPeerId := make([]byte, 20)
@@ -28,28 +69,19 @@ func TestTracker_Run(t *testing.T) {
 		panic(err)
 	}
 
-	var wait sync.WaitGroup
-	wait.Add(1)
-
-	go func() {
-		defer wait.Done()
-		err := tracker.Run()
-		assert.NoError(t, err, "tracker finished with error")
-	}()
-
 	downloaded := rand.Uint64()
 	uploaded := rand.Uint64()
 	left := rand.Uint64()
 	port := uint16(rand.Int())
 	peersCount := rand.Uint32()
 
-	tracker.announceRequestChannel <- AnnounceRequest{
+	results := announceTestTracker(tracker, AnnounceRequest{
 		Started,
 		downloaded,
 		uploaded,
 		left,
 		port,
-		peersCount}
+		peersCount})
 
 	buffer := make([]byte, 16)
 	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
@@ -134,7 +166,10 @@ func TestTracker_Run(t *testing.T) {
 	n, err = exteriorConn.Write(buffer)
 	assert.NoError(t, err, fmt.Sprintf("can not write 32 bytes: n = %d", n))
 
-	response := <-tracker.announceResponseChannel
+	result := <-results
+	assert.NoError(t, result.err, "announce failed")
+
+	response := result.response
 
 	assert.EqualValues(t, interval, response.AnnounceInterval, "wrong announce interval")
 	assert.EqualValues(t, seeders, response.SeedersCount, "wrong seeder count")
@@ -150,11 +185,10 @@ func TestTracker_Run(t *testing.T) {
 	}
 
 	tracker.Close()
-	wait.Wait()
 
 }
 
-func TestTracker_Run_Disconnect(t *testing.T) {
+func TestTracker_Announce_Disconnect(t *testing.T) {
 
 	infoHash := make([]byte, 20)
 	myPeerId := make([]byte, 20)
@@ -169,32 +203,21 @@ func TestTracker_Run_Disconnect(t *testing.T) {
 		panic(err)
 	}
 
-	var wait sync.WaitGroup
-	wait.Add(1)
-
-	go func() {
-		defer wait.Done()
-		err := tracker.Run()
-		assert.Error(t, err, "tracker finished without error")
-	}()
-
-	time.Sleep(time.Millisecond)
-
 	_ = interiorConn.Close()
 
-	tracker.announceRequestChannel <- AnnounceRequest{
+	_, err = tracker.announce(AnnounceRequest{
 		Started,
 		rand.Uint64(),
 		rand.Uint64(),
 		rand.Uint64(),
 		uint16(rand.Int()),
 		rand.Uint32(),
-	}
-
-	wait.Wait()
+	})
+	assert.Error(t, err, "announce finished without error")
+	assert.False(t, isTransientTrackerError(err), "closed connection is transient error")
 }
 
-func TestTracker_Run_AfterClose(t *testing.T) {
+func TestTracker_Announce_AfterClose(t *testing.T) {
 
 	infoHash := make([]byte, 20)
 	myPeerId := make([]byte, 20)
@@ -209,26 +232,14 @@ func TestTracker_Run_AfterClose(t *testing.T) {
 		panic(err)
 	}
 
-	var wait sync.WaitGroup
-	wait.Add(1)
-
-	go func() {
-		defer wait.Done()
-		err := tracker.Run()
-		assert.NoError(t, err, "tracker finished with error")
-	}()
-
-	time.Sleep(time.Millisecond)
-
 	tracker.Close()
-	wait.Wait()
 
-	err = tracker.Run()
-	assert.Error(t, err, "tracker run after close")
+	_, err = tracker.announce(AnnounceRequest{})
+	assert.Error(t, err, "announce after close")
 
 }
 
-func TestTracker_Run_WrongConnectionResponseAction(t *testing.T) {
+func TestTracker_Announce_WrongConnectionResponseAction(t *testing.T) {
 
 	infoHash := make([]byte, 20)
 	myPeerId := make([]byte, 20)
@@ -243,23 +254,14 @@ func TestTracker_Run_WrongConnectionResponseAction(t *testing.T) {
 		panic(err)
 	}
 
-	var wait sync.WaitGroup
-	wait.Add(1)
-
-	go func() {
-		defer wait.Done()
-		err := tracker.Run()
-		assert.Error(t, err, "tracker finished without error")
-	}()
-
-	tracker.announceRequestChannel <- AnnounceRequest{
+	results := announceTestTracker(tracker, AnnounceRequest{
 		Started,
 		rand.Uint64(),
 		rand.Uint64(),
 		rand.Uint64(),
 		uint16(rand.Int()),
 		rand.Uint32(),
-	}
+	})
 
 	buffer := make([]byte, 16)
 	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
@@ -272,10 +274,16 @@ func TestTracker_Run_WrongConnectionResponseAction(t *testing.T) {
 	n, err = exteriorConn.Write(buffer)
 	assert.NoError(t, err, fmt.Sprintf("can not write 16 bytes: n = %d", n))
 
-	wait.Wait()
+	result := <-results
+	assert.True(t, isTransientTrackerError(result.err), "wrong response is not transient error")
+
+	// tracker survives wrong response and requests new connection id
+	requestTestTrackerConnection(t, tracker, exteriorConn)
+
+	tracker.Close()
 }
 
-func TestTracker_Run_WrongConnectionResponseTransactionId(t *testing.T) {
+func TestTracker_Announce_WrongConnectionResponseTransactionId(t *testing.T) {
 
 	infoHash := make([]byte, 20)
 	myPeerId := make([]byte, 20)
@@ -290,39 +298,48 @@ func TestTracker_Run_WrongConnectionResponseTransactionId(t *testing.T) {
 		panic(err)
 	}
 
-	var wait sync.WaitGroup
-	wait.Add(1)
-
-	go func() {
-		defer wait.Done()
-		err := tracker.Run()
-		assert.Error(t, err, "tracker finished without error")
-	}()
-
-	tracker.announceRequestChannel <- AnnounceRequest{
+	results := announceTestTracker(tracker, AnnounceRequest{
 		Started,
 		rand.Uint64(),
 		rand.Uint64(),
 		rand.Uint64(),
 		uint16(rand.Int()),
 		rand.Uint32(),
-	}
+	})
 
 	buffer := make([]byte, 16)
 	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
 	assert.NoError(t, err, fmt.Sprintf("can not read 16 bytes: n = %d", n))
 
 	copy(buffer[0:8], buffer[8:16])
-	buffer[5] += 23
 	rand.Read(buffer[8:16])
+	connectionId := binary.BigEndian.Uint64(buffer[8:16])
+
+	wrongBuffer := make([]byte, 16)
+	copy(wrongBuffer, buffer)
+	wrongBuffer[5] += 23
+
+	n, err = exteriorConn.Write(wrongBuffer[0:16])
+	assert.NoError(t, err, fmt.Sprintf("can not write 16 bytes: n = %d", n))
 
+	// response with wrong transaction id is ignored
 	n, err = exteriorConn.Write(buffer[0:16])
 	assert.NoError(t, err, fmt.Sprintf("can not write 16 bytes: n = %d", n))
 
-	wait.Wait()
+	buffer = make([]byte, 98)
+	n, err = io.ReadAtLeast(exteriorConn, buffer, 98)
+	assert.NoError(t, err, fmt.Sprintf("can not read 98 bytes: n = %d", n))
+
+	assert.EqualValues(t, connectionId, binary.BigEndian.Uint64(buffer[0:8]), "wrong connection id")
+	assert.EqualValues(t, 1, binary.BigEndian.Uint32(buffer[8:12]), "wrong action id")
+
+	tracker.Close()
+
+	result := <-results
+	assert.Error(t, result.err, "announce to closed tracker")
 }
 
-func TestTracker_Run_WrongConnectionResponseLength(t *testing.T) {
+func TestTracker_Announce_WrongConnectionResponseLength(t *testing.T) {
 
 	infoHash := make([]byte, 20)
 	myPeerId := make([]byte, 20)
@@ -337,35 +354,34 @@ func TestTracker_Run_WrongConnectionResponseLength(t *testing.T) {
 		panic(err)
 	}
 
-	var wait sync.WaitGroup
-	wait.Add(1)
-
-	go func() {
-		defer wait.Done()
-		err := tracker.Run()
-		assert.Error(t, err, "tracker finished without error")
-	}()
-
-	tracker.announceRequestChannel <- AnnounceRequest{
+	results := announceTestTracker(tracker, AnnounceRequest{
 		Started,
 		rand.Uint64(),
 		rand.Uint64(),
 		rand.Uint64(),
 		uint16(rand.Int()),
 		rand.Uint32(),
-	}
+	})
 
 	buffer := make([]byte, 16)
 	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
 	assert.NoError(t, err, fmt.Sprintf("can not read 16 bytes: n = %d", n))
 
+	copy(buffer[0:8], buffer[8:16])
+
 	n, err = exteriorConn.Write(buffer[:10])
 	assert.NoError(t, err, fmt.Sprintf("can not write 16 bytes: n = %d", n))
 
-	wait.Wait()
+	result := <-results
+	assert.True(t, isTransientTrackerError(result.err), "wrong response is not transient error")
+
+	// tracker survives wrong response and requests new connection id
+	requestTestTrackerConnection(t, tracker, exteriorConn)
+
+	tracker.Close()
 }
 
-func TestTracker_Run_WrongAnnounceResponseAction(t *testing.T) {
+func TestTracker_Announce_WrongAnnounceResponseAction(t *testing.T) {
 
 	infoHash := make([]byte, 20)
 	myPeerId := make([]byte, 20)
@@ -380,23 +396,14 @@ func TestTracker_Run_WrongAnnounceResponseAction(t *testing.T) {
 		panic(err)
 	}
 
-	var wait sync.WaitGroup
-	wait.Add(1)
-
-	go func() {
-		defer wait.Done()
-		err := tracker.Run()
-		assert.Error(t, err, "tracker finished without error")
-	}()
-
-	tracker.announceRequestChannel <- AnnounceRequest{
+	results := announceTestTracker(tracker, AnnounceRequest{
 		None,
 		rand.Uint64(),
 		rand.Uint64(),
 		rand.Uint64(),
 		uint16(rand.Int()),
 		rand.Uint32(),
-	}
+	})
 
 	buffer := make([]byte, 16)
 	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
@@ -429,11 +436,16 @@ func TestTracker_Run_WrongAnnounceResponseAction(t *testing.T) {
 	n, err = exteriorConn.Write(buffer)
 	assert.NoError(t, err, fmt.Sprintf("can not write 32 bytes: n = %d", n))
 
-	wait.Wait()
+	result := <-results
+	assert.True(t, isTransientTrackerError(result.err), "wrong response is not transient error")
+
+	// tracker survives wrong response and requests new connection id
+	requestTestTrackerConnection(t, tracker, exteriorConn)
 
+	tracker.Close()
 }
 
-func TestTracker_Run_WrongAnnounceResponseTransactionId(t *testing.T) {
+func TestTracker_Announce_WrongAnnounceResponseTransactionId(t *testing.T) {
 
 	infoHash := make([]byte, 20)
 	myPeerId := make([]byte, 20)
@@ -448,23 +460,14 @@ func TestTracker_Run_WrongAnnounceResponseTransactionId(t *testing.T) {
 		panic(err)
 	}
 
-	var wait sync.WaitGroup
-	wait.Add(1)
-
-	go func() {
-		defer wait.Done()
-		err := tracker.Run()
-		assert.Error(t, err, "tracker finished without error")
-	}()
-
-	tracker.announceRequestChannel <- AnnounceRequest{
+	results := announceTestTracker(tracker, AnnounceRequest{
 		None,
 		rand.Uint64(),
 		rand.Uint64(),
 		rand.Uint64(),
 		uint16(rand.Int()),
 		rand.Uint32(),
-	}
+	})
 
 	buffer := make([]byte, 16)
 	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
@@ -497,11 +500,25 @@ func TestTracker_Run_WrongAnnounceResponseTransactionId(t *testing.T) {
 	n, err = exteriorConn.Write(buffer)
 	assert.NoError(t, err, fmt.Sprintf("can not write 32 bytes: n = %d", n))
 
-	wait.Wait()
+	// response with wrong transaction id is ignored
+	binary.BigEndian.PutUint32(buffer[4:8], transactionId)
+	binary.BigEndian.PutUint32(buffer[8:12], 1800)
+
+	n, err = exteriorConn.Write(buffer)
+	assert.NoError(t, err, fmt.Sprintf("can not write 32 bytes: n = %d", n))
+
+	result := <-results
+	assert.NoError(t, result.err, "announce failed")
+
+	response := result.response
+	assert.EqualValues(t, 1800, response.AnnounceInterval, "wrong announce interval")
+	assert.EqualValues(t, 2, len(response.Peers), "wrong peer count")
+
+	tracker.Close()
 
 }
 
-func TestTracker_Run_WrongAnnounceResponseLength(t *testing.T) {
+func TestTracker_Announce_WrongAnnounceResponseLength(t *testing.T) {
 
 	infoHash := make([]byte, 20)
 	myPeerId := make([]byte, 20)
@@ -516,23 +533,14 @@ func TestTracker_Run_WrongAnnounceResponseLength(t *testing.T) {
 		panic(err)
 	}
 
-	var wait sync.WaitGroup
-	wait.Add(1)
-
-	go func() {
-		defer wait.Done()
-		err := tracker.Run()
-		assert.Error(t, err, "tracker finished without error")
-	}()
-
-	tracker.announceRequestChannel <- AnnounceRequest{
+	results := announceTestTracker(tracker, AnnounceRequest{
 		None,
 		rand.Uint64(),
 		rand.Uint64(),
 		rand.Uint64(),
 		uint16(rand.Int()),
 		rand.Uint32(),
-	}
+	})
 
 	buffer := make([]byte, 16)
 	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
@@ -565,11 +573,143 @@ func TestTracker_Run_WrongAnnounceResponseLength(t *testing.T) {
 	n, err = exteriorConn.Write(buffer[:15])
 	assert.NoError(t, err, fmt.Sprintf("can not write 32 bytes: n = %d", n))
 
-	wait.Wait()
+	result := <-results
+	assert.True(t, isTransientTrackerError(result.err), "wrong response is not transient error")
+
+	// tracker survives wrong response and requests new connection id
+	requestTestTrackerConnection(t, tracker, exteriorConn)
+
+	tracker.Close()
+}
+
+func TestTracker_Announce_ErrorResponse(t *testing.T) {
+
+	interiorConn, exteriorConn := net.Pipe()
+
+	tracker, err := NewTracker(make([]byte, 20), make([]byte, 20), interiorConn)
+	if err != nil {
+		panic(err)
+	}
+
+	buffer, results := requestTestTrackerConnection(t, tracker, exteriorConn)
+
+	//Offset  Size            Name            Value
+	//0       32-bit integer  action          3 // error
+	//4       32-bit integer  transaction_id
+	//8       string          message
+
+	message := []byte("torrent is not registered")
+
+	response := make([]byte, 8+len(message))
+	binary.BigEndian.PutUint32(response[0:4], 3)
+	copy(response[4:8], buffer[12:16])
+	copy(response[8:], message)
+
+	n, err := exteriorConn.Write(response)
+	assert.NoError(t, err, fmt.Sprintf("can not write %d bytes: n = %d", len(response), n))
+
+	result := <-results
+	assert.EqualValues(t, TrackerError{"torrent is not registered"}, errors.Cause(result.err),
+		"unexpected error")
+	assert.True(t, isTransientTrackerError(result.err), "error response is not transient error")
+
+	// tracker survives error response and requests new connection id
+	requestTestTrackerConnection(t, tracker, exteriorConn)
+
+	tracker.Close()
+
+	interiorConn, exteriorConn = net.Pipe()
+
+	tracker, err = NewTracker(make([]byte, 20), make([]byte, 20), interiorConn)
+	if err != nil {
+		panic(err)
+	}
+
+	results = announceTestTracker(tracker, AnnounceRequest{})
+
+	buffer = make([]byte, 16)
+	n, err = io.ReadAtLeast(exteriorConn, buffer, 16)
+	assert.NoError(t, err, fmt.Sprintf("can not read 16 bytes: n = %d", n))
+
+	copy(response[4:8], buffer[12:16])
+
+	n, err = exteriorConn.Write(response)
+	assert.NoError(t, err, fmt.Sprintf("can not write %d bytes: n = %d", len(response), n))
+
+	result = <-results
+	assert.EqualValues(t, TrackerError{"torrent is not registered"}, errors.Cause(result.err),
+		"unexpected error")
+
+	tracker.Close()
+}
+
+func TestTracker_Announce_Retransmission(t *testing.T) {
+
+	interiorConn, exteriorConn := net.Pipe()
+
+	tracker, err := NewTracker(make([]byte, 20), make([]byte, 20), interiorConn)
+	if err != nil {
+		panic(err)
+	}
+
+	tracker.retransmissionTimeout = 20 * time.Millisecond
+
+	before := time.Now()
+
+	buffer, results := requestTestTrackerConnection(t, tracker, exteriorConn)
+
+	// request is lost, it is retransmitted after the timeout and then after the doubled timeout
+	for attempt := 1; attempt <= 2; attempt++ {
+
+		retransmitted := make([]byte, 16)
+		n, err := io.ReadAtLeast(exteriorConn, retransmitted, 16)
+		assert.NoError(t, err, fmt.Sprintf("can not read 16 bytes: n = %d", n))
+
+		assert.EqualValues(t, buffer, retransmitted, "wrong retransmitted request")
+		assert.True(t, time.Since(before) >= tracker.retransmissionTimeout*time.Duration(1<<uint(attempt)-1),
+			"request is retransmitted too early")
+	}
+
+	copy(buffer[0:8], buffer[8:16])
+	rand.Read(buffer[8:16])
+
+	n, err := exteriorConn.Write(buffer)
+	assert.NoError(t, err, fmt.Sprintf("can not write 16 bytes: n = %d", n))
+
+	buffer = make([]byte, 98)
+	n, err = io.ReadAtLeast(exteriorConn, buffer, 98)
+	assert.NoError(t, err, fmt.Sprintf("can not read 98 bytes: n = %d", n))
+
+	tracker.Close()
+
+	result := <-results
+	assert.Error(t, result.err, "announce to closed tracker")
+}
+
+func TestTracker_Announce_Retransmission_Timeout(t *testing.T) {
+
+	interiorConn, exteriorConn := net.Pipe()
+
+	tracker, err := NewTracker(make([]byte, 20), make([]byte, 20), interiorConn)
+	if err != nil {
+		panic(err)
+	}
 
+	tracker.retransmissionTimeout = 20 * time.Millisecond
+	tracker.maxRetransmissions = listMaxRetransmissions
+
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, exteriorConn)
+	}()
+
+	// tracker of the list gives up after the limited retransmissions
+	_, err = tracker.announce(AnnounceRequest{})
+	assert.True(t, errors.IsTimeout(errors.Cause(err)), "unexpected error")
+
+	tracker.Close()
 }
 
-func TestTracker_Run_ConnectionExpiration(t *testing.T) {
+func TestTracker_Announce_ConnectionExpiration(t *testing.T) {
 
 	if testing.Short() {
 		t.Skip("skip in short mode: test duration is about 1m")
@@ -588,23 +728,14 @@ func TestTracker_Run_ConnectionExpiration(t *testing.T) {
 		panic(err)
 	}
 
-	var wait sync.WaitGroup
-	wait.Add(1)
-
-	go func() {
-		defer wait.Done()
-		err := tracker.Run()
-		assert.NoError(t, err, "tracker finished with error")
-	}()
-
-	tracker.announceRequestChannel <- AnnounceRequest{
+	results := announceTestTracker(tracker, AnnounceRequest{
 		None,
 		rand.Uint64(),
 		rand.Uint64(),
 		rand.Uint64(),
 		uint16(rand.Int()),
 		rand.Uint32(),
-	}
+	})
 
 	buffer := make([]byte, 16)
 	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
@@ -637,16 +768,19 @@ func TestTracker_Run_ConnectionExpiration(t *testing.T) {
 	n, err = exteriorConn.Write(buffer)
 	assert.NoError(t, err, fmt.Sprintf("can not write 32 bytes: n = %d", n))
 
+	result := <-results
+	assert.NoError(t, result.err, "announce failed")
+
 	time.Sleep(time.Minute)
 
-	tracker.announceRequestChannel <- AnnounceRequest{
+	results = announceTestTracker(tracker, AnnounceRequest{
 		None,
 		rand.Uint64(),
 		rand.Uint64(),
 		rand.Uint64(),
 		uint16(rand.Int()),
 		rand.Uint32(),
-	}
+	})
 
 	buffer = make([]byte, 16)
 	n, err = io.ReadAtLeast(exteriorConn, buffer, 16)
@@ -660,6 +794,211 @@ func TestTracker_Run_ConnectionExpiration(t *testing.T) {
 
 	tracker.Close()
 
+	result = <-results
+	assert.Error(t, result.err, "announce to closed tracker")
+}
+
+func TestTracker_Scrape(t *testing.T) {
+
+	interiorConn, exteriorConn := net.Pipe()
+
+	tracker, err := NewTracker(nil, nil, interiorConn)
+	if err != nil {
+		panic(err)
+	}
+
+	infoHashes := make([][]byte, maxScrapeInfoHashes+6)
+	for i := range infoHashes {
+		infoHashes[i] = make([]byte, 20)
+		rand.Read(infoHashes[i])
+	}
+
+	expected := make([]ScrapeResponse, len(infoHashes))
+	for i := range expected {
+		expected[i] = ScrapeResponse{rand.Uint32(), rand.Uint32(), rand.Uint32()}
+	}
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+
+	go func() {
+		defer wait.Done()
+		responses, err := tracker.scrape(infoHashes)
+		assert.NoError(t, err, "scrape finished with error")
+		assert.EqualValues(t, expected, responses, "wrong scrape responses")
+	}()
+
+	buffer := make([]byte, 16)
+	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
+	assert.NoError(t, err, fmt.Sprintf("can not read 16 bytes: n = %d", n))
+
+	copy(buffer[0:8], buffer[8:16])
+	rand.Read(buffer[8:16])
+	connectionId := binary.BigEndian.Uint64(buffer[8:16])
+
+	n, err = exteriorConn.Write(buffer)
+	assert.NoError(t, err, fmt.Sprintf("can not write 16 bytes: n = %d", n))
+
+	for _, count := range []int{maxScrapeInfoHashes, 6} {
+
+		start := 0
+		if count == 6 {
+			start = maxScrapeInfoHashes
+		}
+
+		buffer = make([]byte, 16+20*count)
+		n, err = io.ReadAtLeast(exteriorConn, buffer, len(buffer))
+		assert.NoError(t, err, fmt.Sprintf("can not read %d bytes: n = %d", len(buffer), n))
+
+		assert.EqualValues(t, connectionId, binary.BigEndian.Uint64(buffer[0:8]), "wrong connection id")
+		assert.EqualValues(t, 2, binary.BigEndian.Uint32(buffer[8:12]), "wrong action id")
+
+		for i := 0; i < count; i++ {
+			assert.True(t, bytes.Compare(infoHashes[start+i], buffer[16+20*i:16+20*(i+1)]) == 0,
+				"wrong info hash")
+		}
+
+		transactionId := binary.BigEndian.Uint32(buffer[12:16])
+
+		buffer = make([]byte, 8+12*count)
+		binary.BigEndian.PutUint32(buffer[0:4], 2)
+		binary.BigEndian.PutUint32(buffer[4:8], transactionId)
+
+		for i := 0; i < count; i++ {
+			binary.BigEndian.PutUint32(buffer[8+12*i:12+12*i], expected[start+i].SeedersCount)
+			binary.BigEndian.PutUint32(buffer[12+12*i:16+12*i], expected[start+i].CompletedCount)
+			binary.BigEndian.PutUint32(buffer[16+12*i:20+12*i], expected[start+i].LechersCount)
+		}
+
+		n, err = exteriorConn.Write(buffer)
+		assert.NoError(t, err, fmt.Sprintf("can not write %d bytes: n = %d", len(buffer), n))
+	}
+
+	wait.Wait()
+
+	tracker.Close()
+}
+
+func TestTracker_Scrape_WrongResponseAction(t *testing.T) {
+
+	interiorConn, exteriorConn := net.Pipe()
+
+	tracker, err := NewTracker(nil, nil, interiorConn)
+	if err != nil {
+		panic(err)
+	}
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+
+	go func() {
+		defer wait.Done()
+		_, err := tracker.scrape([][]byte{make([]byte, 20)})
+		assert.Error(t, err, "scrape finished without error")
+	}()
+
+	buffer := make([]byte, 16)
+	n, err := io.ReadAtLeast(exteriorConn, buffer, 16)
+	assert.NoError(t, err, fmt.Sprintf("can not read 16 bytes: n = %d", n))
+
+	copy(buffer[0:8], buffer[8:16])
+	rand.Read(buffer[8:16])
+
+	n, err = exteriorConn.Write(buffer)
+	assert.NoError(t, err, fmt.Sprintf("can not write 16 bytes: n = %d", n))
+
+	buffer = make([]byte, 36)
+	n, err = io.ReadAtLeast(exteriorConn, buffer, 36)
+	assert.NoError(t, err, fmt.Sprintf("can not read 36 bytes: n = %d", n))
+
+	transactionId := binary.BigEndian.Uint32(buffer[12:16])
+
+	buffer = make([]byte, 20)
+	binary.BigEndian.PutUint32(buffer[0:4], 1)
+	binary.BigEndian.PutUint32(buffer[4:8], transactionId)
+
+	n, err = exteriorConn.Write(buffer)
+	assert.NoError(t, err, fmt.Sprintf("can not write 20 bytes: n = %d", n))
+
 	wait.Wait()
 
+	tracker.Close()
+}
+
+func TestTracker_ParseCompactPeers(t *testing.T) {
+
+	peers := parseCompactPeers([]byte{198, 51, 100, 7, 0x1A, 0xE1, 10, 0, 0, 1, 0, 80}, net.IPv4len)
+	assert.EqualValues(t, []string{"198.51.100.7:6881", "10.0.0.1:80"}, peers, "wrong ipv4 peers")
+
+	data := make([]byte, 36)
+	copy(data[0:16], net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(data[16:18], 6881)
+	copy(data[18:34], net.ParseIP("198.51.100.7"))
+	binary.BigEndian.PutUint16(data[34:36], 6882)
+
+	peers = parseCompactPeers(data, net.IPv6len)
+	assert.EqualValues(t, []string{"[2001:db8::1]:6881", "198.51.100.7:6882"}, peers, "wrong ipv6 peers")
+}
+
+func TestTracker_Announce_IPv6(t *testing.T) {
+
+	server, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("skip: ipv6 is not available")
+	}
+
+	defer server.Close()
+
+	conn, err := net.Dial("udp6", server.LocalAddr().String())
+	if err != nil {
+		panic(err)
+	}
+
+	tracker, err := NewTracker(make([]byte, 20), make([]byte, 20), conn)
+	if err != nil {
+		panic(err)
+	}
+
+	results := announceTestTracker(tracker, AnnounceRequest{
+		Started,
+		rand.Uint64(),
+		rand.Uint64(),
+		rand.Uint64(),
+		uint16(rand.Int()),
+		rand.Uint32(),
+	})
+
+	buffer := make([]byte, 1024)
+	n, addr, err := server.ReadFrom(buffer)
+	assert.NoError(t, err, "can not read connection request")
+	assert.EqualValues(t, 16, n, "wrong connection request length")
+
+	copy(buffer[0:8], buffer[8:16])
+	rand.Read(buffer[8:16])
+
+	_, err = server.WriteTo(buffer[:16], addr)
+	assert.NoError(t, err, "can not write connection response")
+
+	n, addr, err = server.ReadFrom(buffer)
+	assert.NoError(t, err, "can not read announce request")
+	assert.EqualValues(t, 98, n, "wrong announce request length")
+
+	transactionId := binary.BigEndian.Uint32(buffer[12:16])
+
+	buffer = make([]byte, 20+18)
+	binary.BigEndian.PutUint32(buffer[0:4], 1)
+	binary.BigEndian.PutUint32(buffer[4:8], transactionId)
+	copy(buffer[20:36], net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(buffer[36:38], 6881)
+
+	_, err = server.WriteTo(buffer, addr)
+	assert.NoError(t, err, "can not write announce response")
+
+	result := <-results
+	assert.NoError(t, result.err, "announce failed")
+
+	response := result.response
+	assert.EqualValues(t, []string{"[2001:db8::1]:6881"}, response.Peers, "wrong ipv6 peers")
+
+	tracker.Close()
 }
@@ -0,0 +1,290 @@
+package torrent
+
+import (
+	"github.com/juju/errors"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type TrackerStatus struct {
+	Url          string
+	Tier         int
+	LastAnnounce time.Time
+	LastError    error
+	PeersCount   int
+	NextAnnounce time.Time
+}
+
+// announceResult is the response of the tracker list or the error if all trackers failed
+type announceResult struct {
+	response AnnounceResponse
+	err      error
+}
+
+type trackerListEntry struct {
+	status TrackerStatus
+	client trackerClient
+}
+
+// TrackerList announces to the trackers of the announce-list (BEP 12):
+// tiers are tried in order, trackers of a tier in shuffled order, and a
+// tracker that responded is moved to the front of its tier
+type TrackerList struct {
+	tiers [][]*trackerListEntry
+
+	announceRequestChannel  chan AnnounceRequest
+	announceResponseChannel chan announceResult
+
+	peerId   []byte
+	infoHash []byte
+
+	stopChannel chan struct{}
+
+	mutex     sync.Mutex
+	closeWait sync.WaitGroup
+}
+
+func NewTrackerList(peerId, infoHash []byte, announce string, announceList [][]string) (trackers *TrackerList, err error) {
+
+	trackers = new(TrackerList)
+
+	if len(announceList) == 0 {
+		announceList = [][]string{{announce}}
+	}
+
+	for _, urls := range announceList {
+
+		if len(urls) == 0 {
+			continue
+		}
+
+		tier := make([]*trackerListEntry, len(urls))
+		for i, announceUrl := range urls {
+			tier[i] = &trackerListEntry{status: TrackerStatus{Url: announceUrl}}
+		}
+
+		rand.Shuffle(len(tier), func(i, j int) {
+			tier[i], tier[j] = tier[j], tier[i]
+		})
+
+		trackers.tiers = append(trackers.tiers, tier)
+	}
+
+	if len(trackers.tiers) == 0 {
+		return nil, errors.New("new tracker list: there is no announce url")
+	}
+
+	trackers.announceRequestChannel = make(chan AnnounceRequest, 1)
+	trackers.announceResponseChannel = make(chan announceResult, 1)
+
+	trackers.infoHash = infoHash
+	trackers.peerId = peerId
+
+	return trackers, nil
+}
+
+func (t *TrackerList) Run() (err error) {
+
+	t.mutex.Lock()
+	if t.stopChannel != nil {
+		t.mutex.Unlock()
+		return errors.Annotate(
+			errors.New("tracker list is already running"),
+			"tracker list run")
+	}
+	stopChannel := make(chan struct{})
+	t.stopChannel = stopChannel
+	t.closeWait.Add(1)
+	t.mutex.Unlock()
+
+	defer t.closeWait.Done()
+
+	for {
+
+		select {
+
+		case request := <-t.announceRequestChannel:
+
+			// failure is sent too, so the announce is retried later
+			response, err := t.announce(request)
+			if err != nil {
+				trackerLogger.WithFields(logrus.Fields{
+					"infoHash": t.infoHash,
+				}).Error(err.Error())
+			}
+
+			select {
+			case t.announceResponseChannel <- announceResult{response, err}:
+			case <-stopChannel:
+				return nil
+			}
+
+		case <-stopChannel:
+			return nil
+		}
+	}
+}
+
+func (t *TrackerList) Close() {
+
+	t.mutex.Lock()
+
+	if t.stopChannel != nil {
+		close(t.stopChannel)
+		t.stopChannel = nil
+	}
+
+	for _, tier := range t.tiers {
+		for _, entry := range tier {
+			if entry.client != nil {
+				entry.client.Close()
+				entry.client = nil
+			}
+		}
+	}
+
+	t.mutex.Unlock()
+
+	t.closeWait.Wait()
+}
+
+func (t *TrackerList) Status() (statuses []TrackerStatus) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for tierIndex, tier := range t.tiers {
+		for _, entry := range tier {
+			status := entry.status
+			status.Tier = tierIndex
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+func (t *TrackerList) announce(request AnnounceRequest) (response AnnounceResponse, err error) {
+
+	for tierIndex := range t.tiers {
+
+		t.mutex.Lock()
+		tier := make([]*trackerListEntry, len(t.tiers[tierIndex]))
+		copy(tier, t.tiers[tierIndex])
+		t.mutex.Unlock()
+
+		for _, entry := range tier {
+
+			response, err = t.announceTo(entry, request)
+			if err != nil {
+				trackerLogger.WithFields(logrus.Fields{
+					"url":  entry.status.Url,
+					"tier": tierIndex,
+				}).Warn(err.Error())
+				continue
+			}
+
+			t.promote(tierIndex, entry)
+
+			return response, nil
+		}
+	}
+
+	return AnnounceResponse{},
+		errors.Annotate(errors.New("all trackers failed"), "tracker list announce")
+}
+
+func (t *TrackerList) announceTo(entry *trackerListEntry, request AnnounceRequest) (response AnnounceResponse, err error) {
+
+	t.mutex.Lock()
+
+	if t.stopChannel == nil {
+		t.mutex.Unlock()
+		return AnnounceResponse{},
+			errors.Annotate(errors.New("tracker list is closed"), "tracker list announce")
+	}
+
+	if entry.client == nil {
+		entry.client, err = newTrackerClient(t.peerId, t.infoHash, entry.status.Url)
+		if err != nil {
+			entry.status.LastError = err
+			t.mutex.Unlock()
+			return AnnounceResponse{}, errors.Annotate(err, "tracker list announce")
+		}
+	}
+
+	client := entry.client
+
+	t.mutex.Unlock()
+
+	response, err = client.announce(request)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// tracker list was closed while announcing
+	if entry.client != client {
+		return AnnounceResponse{},
+			errors.Annotate(errors.New("tracker was closed"), "tracker list announce")
+	}
+
+	now := time.Now()
+	entry.status.LastAnnounce = now
+	entry.status.LastError = err
+
+	if err != nil {
+		entry.status.NextAnnounce = time.Time{}
+
+		// tracker survives wrong responses and timeouts, the client is created
+		// again on the next announce after other errors
+		if !isTransientTrackerError(err) {
+			client.Close()
+			entry.client = nil
+		}
+
+		return AnnounceResponse{}, errors.Annotate(err, "tracker list announce")
+	}
+
+	entry.status.PeersCount = len(response.Peers)
+	entry.status.NextAnnounce = now.Add(time.Duration(response.AnnounceInterval) * time.Second)
+
+	return response, nil
+}
+
+func (t *TrackerList) scrape(infoHashes [][]byte) (responses []ScrapeResponse, err error) {
+
+	for _, status := range t.Status() {
+
+		responses, err = ScrapeTracker(status.Url, infoHashes)
+		if err != nil {
+			trackerLogger.WithFields(logrus.Fields{
+				"url":  status.Url,
+				"tier": status.Tier,
+			}).Warn(err.Error())
+			continue
+		}
+
+		return responses, nil
+	}
+
+	return nil,
+		errors.Annotate(errors.New("all trackers failed"), "tracker list scrape")
+}
+
+func (t *TrackerList) promote(tierIndex int, entry *trackerListEntry) {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	tier := t.tiers[tierIndex]
+
+	for i := range tier {
+		if tier[i] == entry {
+			copy(tier[1:i+1], tier[0:i])
+			tier[0] = entry
+			return
+		}
+	}
+}
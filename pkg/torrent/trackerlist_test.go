@@ -0,0 +1,366 @@
+package torrent
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/zeebo/bencode"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func makeTestHttpTracker(t *testing.T, failure bool, requestCount *int32) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		atomic.AddInt32(requestCount, 1)
+
+		response := map[string]interface{}{
+			"interval": 1800,
+			"peers":    string([]byte{127, 0, 0, 1, 0x1A, 0xE1}),
+		}
+
+		if failure {
+			response = map[string]interface{}{
+				"failure reason": "tracker is down",
+			}
+		}
+
+		data, err := bencode.EncodeBytes(response)
+		assert.NoError(t, err, "can not encode response")
+		_, _ = w.Write(data)
+	}))
+}
+
+func announceTestTrackerList(trackers *TrackerList) announceResult {
+
+	trackers.announceRequestChannel <- AnnounceRequest{
+		Started,
+		rand.Uint64(),
+		rand.Uint64(),
+		rand.Uint64(),
+		uint16(rand.Int()),
+		rand.Uint32(),
+	}
+
+	return <-trackers.announceResponseChannel
+}
+
+func TestTrackerList_Run_TierFailover(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	myPeerId := make([]byte, 20)
+
+	rand.Read(infoHash)
+	rand.Read(myPeerId)
+
+	var failingCount, workingCount int32
+
+	failingServer := makeTestHttpTracker(t, true, &failingCount)
+	defer failingServer.Close()
+
+	workingServer := makeTestHttpTracker(t, false, &workingCount)
+	defer workingServer.Close()
+
+	deadServer := makeTestHttpTracker(t, false, new(int32))
+	deadServer.Close()
+
+	announceList := [][]string{
+		{failingServer.URL + "/announce", deadServer.URL + "/announce"},
+		{"wss://198.51.100.7/announce"},
+		{workingServer.URL + "/announce"},
+	}
+
+	trackers, err := NewTrackerList(myPeerId, infoHash, "udp://198.51.100.5:8000", announceList)
+	assert.NoError(t, err, "can not create tracker list")
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+
+	go func() {
+		defer wait.Done()
+		err := trackers.Run()
+		assert.NoError(t, err, "tracker list finished with error")
+	}()
+
+	before := time.Now()
+
+	result := announceTestTrackerList(trackers)
+	assert.NoError(t, result.err, "announce failed")
+	response := result.response
+	assert.EqualValues(t, []string{"127.0.0.1:6881"}, response.Peers, "unexpected peers")
+
+	statuses := trackers.Status()
+	assert.Len(t, statuses, 4, "announce key is not ignored")
+
+	for _, status := range statuses {
+		switch status.Url {
+		case workingServer.URL + "/announce":
+			assert.EqualValues(t, 2, status.Tier, "wrong tier")
+			assert.NoError(t, status.LastError, "unexpected error")
+			assert.EqualValues(t, 1, status.PeersCount, "wrong peer count")
+			assert.False(t, status.LastAnnounce.Before(before), "wrong last announce")
+			assert.EqualValues(t, status.LastAnnounce.Add(1800*time.Second), status.NextAnnounce,
+				"wrong next announce")
+		default:
+			assert.Error(t, status.LastError, "failed tracker has no error")
+			assert.True(t, status.NextAnnounce.IsZero(), "failed tracker has next announce")
+		}
+	}
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&failingCount), "wrong failing tracker request count")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&workingCount), "wrong working tracker request count")
+
+	trackers.Close()
+	wait.Wait()
+
+}
+
+func TestTrackerList_Run_SilentTracker(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	myPeerId := make([]byte, 20)
+
+	rand.Read(infoHash)
+	rand.Read(myPeerId)
+
+	// udp tracker never responds
+	silentServer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err, "can not listen udp")
+	defer silentServer.Close()
+
+	var silentCount int32
+
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			if _, _, err := silentServer.ReadFrom(buffer); err != nil {
+				return
+			}
+			atomic.AddInt32(&silentCount, 1)
+		}
+	}()
+
+	var workingCount int32
+
+	workingServer := makeTestHttpTracker(t, false, &workingCount)
+	defer workingServer.Close()
+
+	silentUrl := "udp://" + silentServer.LocalAddr().String()
+
+	trackers, err := NewTrackerList(myPeerId, infoHash, "", [][]string{
+		{silentUrl},
+		{workingServer.URL + "/announce"},
+	})
+	assert.NoError(t, err, "can not create tracker list")
+
+	client, err := newTrackerClient(myPeerId, infoHash, silentUrl)
+	assert.NoError(t, err, "can not create tracker")
+
+	client.(*Tracker).retransmissionTimeout = 20 * time.Millisecond
+	trackers.tiers[0][0].client = client
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+
+	go func() {
+		defer wait.Done()
+		err := trackers.Run()
+		assert.NoError(t, err, "tracker list finished with error")
+	}()
+
+	// next tier is tried after the limited retransmissions
+	result := announceTestTrackerList(trackers)
+	assert.NoError(t, result.err, "announce failed")
+	response := result.response
+	assert.EqualValues(t, []string{"127.0.0.1:6881"}, response.Peers, "unexpected peers")
+	assert.EqualValues(t, listMaxRetransmissions+1, atomic.LoadInt32(&silentCount),
+		"wrong silent tracker request count")
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&workingCount), "wrong working tracker request count")
+
+	// tracker survives timeout
+	assert.True(t, trackers.tiers[0][0].client == client, "silent tracker is closed after timeout")
+
+	trackers.Close()
+	wait.Wait()
+}
+
+func TestTrackerList_Run_Recovery(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	myPeerId := make([]byte, 20)
+
+	rand.Read(infoHash)
+	rand.Read(myPeerId)
+
+	var failingCount, workingCount int32
+	failing := int32(1)
+
+	failingServer := makeTestHttpTracker(t, true, &failingCount)
+	defer failingServer.Close()
+
+	recoveringServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		atomic.AddInt32(&workingCount, 1)
+
+		data, err := bencode.EncodeBytes(map[string]interface{}{
+			"interval": 1800,
+			"peers":    string([]byte{127, 0, 0, 1, 0x1A, 0xE1}),
+		})
+		assert.NoError(t, err, "can not encode response")
+		_, _ = w.Write(data)
+	}))
+	defer recoveringServer.Close()
+
+	trackers, err := NewTrackerList(myPeerId, infoHash, "", [][]string{
+		{failingServer.URL + "/announce"},
+		{recoveringServer.URL + "/announce"},
+	})
+	assert.NoError(t, err, "can not create tracker list")
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+
+	go func() {
+		defer wait.Done()
+		err := trackers.Run()
+		assert.NoError(t, err, "tracker list finished with error")
+	}()
+
+	// failure is reported when all trackers failed
+	result := announceTestTrackerList(trackers)
+	assert.Error(t, result.err, "announce to failed trackers finished without error")
+
+	for _, status := range trackers.Status() {
+		assert.Error(t, status.LastError, "failed tracker has no error")
+	}
+
+	// tracker list keeps running and announces again after the trackers recover
+	atomic.StoreInt32(&failing, 0)
+
+	result = announceTestTrackerList(trackers)
+	assert.NoError(t, result.err, "announce failed")
+	assert.EqualValues(t, []string{"127.0.0.1:6881"}, result.response.Peers, "unexpected peers")
+
+	assert.EqualValues(t, 2, atomic.LoadInt32(&failingCount), "wrong failing tracker request count")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&workingCount), "wrong working tracker request count")
+
+	trackers.Close()
+	wait.Wait()
+}
+
+func TestTrackerList_Run_Promotion(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	myPeerId := make([]byte, 20)
+
+	rand.Read(infoHash)
+	rand.Read(myPeerId)
+
+	var failingCount, workingCount int32
+
+	failingServer := makeTestHttpTracker(t, true, &failingCount)
+	defer failingServer.Close()
+
+	workingServer := makeTestHttpTracker(t, false, &workingCount)
+	defer workingServer.Close()
+
+	announceList := [][]string{
+		{failingServer.URL + "/announce", workingServer.URL + "/announce"},
+	}
+
+	trackers, err := NewTrackerList(myPeerId, infoHash, "", announceList)
+	assert.NoError(t, err, "can not create tracker list")
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+
+	go func() {
+		defer wait.Done()
+		err := trackers.Run()
+		assert.NoError(t, err, "tracker list finished with error")
+	}()
+
+	for i := 0; i < 3; i++ {
+		result := announceTestTrackerList(trackers)
+		assert.NoError(t, result.err, "announce failed")
+		response := result.response
+		assert.EqualValues(t, []string{"127.0.0.1:6881"}, response.Peers, "unexpected peers")
+	}
+
+	// working tracker is on the top of the tier after first announce
+	assert.True(t, atomic.LoadInt32(&failingCount) <= 1, "failing tracker is not demoted")
+	assert.EqualValues(t, 3, atomic.LoadInt32(&workingCount), "wrong working tracker request count")
+
+	statuses := trackers.Status()
+	assert.EqualValues(t, workingServer.URL+"/announce", statuses[0].Url, "working tracker is not promoted")
+
+	trackers.Close()
+	wait.Wait()
+
+	// tracker list can be started again after close
+	wait.Add(1)
+
+	go func() {
+		defer wait.Done()
+		err := trackers.Run()
+		assert.NoError(t, err, "tracker list finished with error")
+	}()
+
+	result := announceTestTrackerList(trackers)
+	assert.NoError(t, result.err, "announce failed")
+	response := result.response
+	assert.EqualValues(t, []string{"127.0.0.1:6881"}, response.Peers, "unexpected peers")
+
+	trackers.Close()
+	wait.Wait()
+}
+
+func TestTrackerList_New_Empty(t *testing.T) {
+
+	_, err := NewTrackerList(make([]byte, 20), make([]byte, 20), "", [][]string{{}})
+	assert.Error(t, err, "tracker list created without trackers")
+}
+
+func TestTrackerList_Scrape(t *testing.T) {
+
+	infoHash := make([]byte, 20)
+	rand.Read(infoHash)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := bencode.EncodeBytes(map[string]interface{}{
+			"files": map[string]interface{}{
+				string(infoHash): map[string]interface{}{
+					"complete":   5,
+					"downloaded": 7,
+					"incomplete": 3,
+				},
+			},
+		})
+		assert.NoError(t, err, "can not encode response")
+		_, _ = w.Write(data)
+	}))
+
+	defer server.Close()
+
+	announceList := [][]string{
+		{"http://198.51.100.6/no-scrape"},
+		{server.URL + "/announce"},
+	}
+
+	trackers, err := NewTrackerList(make([]byte, 20), infoHash, "", announceList)
+	assert.NoError(t, err, "can not create tracker list")
+
+	responses, err := trackers.scrape([][]byte{infoHash})
+	assert.NoError(t, err, "scrape finished with error")
+	assert.EqualValues(t, []ScrapeResponse{{5, 7, 3}}, responses, "wrong scrape responses")
+}
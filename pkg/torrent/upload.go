@@ -0,0 +1,163 @@
+package torrent
+
+import (
+	"github.com/juju/errors"
+	"github.com/lezhenin/gotorrentclient/pkg/ratelimit"
+	"github.com/sirupsen/logrus"
+)
+
+const maxUploadQueueLength = 256
+
+type blockRequest struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+type uploadedBlock struct {
+	seeder  *Seeder
+	request blockRequest
+	data    []byte
+	err     error
+}
+
+func (m *Manager) validateRequest(request blockRequest) (err error) {
+
+	if request.Length == 0 || request.Length > uint32(blockLength) {
+		return errors.Errorf("validate request: length %d is out of range", request.Length)
+	}
+
+	if int64(request.Index) >= m.pieceCount {
+		return errors.Errorf("validate request: piece %d is out of range", request.Index)
+	}
+
+	pieceLength := m.info.PieceLength
+	if int64(request.Index) == m.pieceCount-1 {
+		pieceLength = m.lastPieceLength
+	}
+
+	if int64(request.Begin)+int64(request.Length) > pieceLength {
+		return errors.Errorf("validate request: block %d+%d is out of piece",
+			request.Begin, request.Length)
+	}
+
+	return nil
+}
+
+func (m *Manager) rejectRequest(seeder *Seeder, request blockRequest) {
+	if seeder.SupportsFast() {
+		payload := MakeRequestPayload(request.Index, request.Begin, request.Length)
+		seeder.outcoming <- Message{RejectRequest, payload, m.peerId}
+	}
+}
+
+// dispatchUpload reads the next queued block of the seeder in separate routine
+// and waits for the upload limiters, the seeder has at most one block being read
+func (m *Manager) dispatchUpload(seeder *Seeder) {
+
+	if seeder.uploadInFlight || len(seeder.uploadQueue) == 0 {
+		return
+	}
+
+	request := seeder.uploadQueue[0]
+	seeder.uploadQueue = seeder.uploadQueue[1:]
+
+	seeder.uploadInFlight = true
+	seeder.uploadCurrent = request
+	seeder.uploadCancelled = false
+
+	quit := m.quit
+
+	go func() {
+
+		data := make([]byte, request.Length)
+
+		pieceLength := m.info.PieceLength
+		if int64(request.Index) == m.pieceCount-1 {
+			pieceLength = m.lastPieceLength
+		}
+
+		err := m.cache.readBlock(m, int(request.Index), pieceLength, data, int64(request.Begin))
+		if err == nil {
+			ratelimit.Wait(seeder.uploadLimiters, len(data))
+		}
+
+		select {
+		case m.uploadedBlocks <- uploadedBlock{seeder, request, data, err}:
+		case <-quit:
+		}
+	}()
+}
+
+func (m *Manager) handleUploadedBlock(block uploadedBlock) {
+
+	seeder, ok := m.getSeeder(block.seeder.PeerId)
+	if !ok || seeder != block.seeder {
+		return
+	}
+
+	seeder.uploadInFlight = false
+
+	switch {
+
+	case block.err != nil:
+		managerLogger.WithFields(logrus.Fields{
+			"peerId":   seeder.PeerId,
+			"infoHash": m.infoHash,
+		}).Error(errors.Annotate(block.err, "handle uploaded block").Error())
+		m.rejectRequest(seeder, block.request)
+
+	case !seeder.uploadCancelled:
+		payload := MakePiecePayload(block.request.Index, block.request.Begin, block.data)
+		seeder.outcoming <- Message{Piece, payload, m.peerId}
+		m.state.IncrementUploaded(uint64(block.request.Length))
+		seeder.uploadedBytes += int64(block.request.Length)
+	}
+
+	m.dispatchUpload(seeder)
+}
+
+func (m *Manager) handleCancelMessage(seeder *Seeder, payload []byte) {
+
+	index, begin, length, err := ParseCancelPayload(payload)
+	if err != nil {
+		seeder.Close()
+		return
+	}
+
+	request := blockRequest{index, begin, length}
+
+	for i, queued := range seeder.uploadQueue {
+		if queued == request {
+			seeder.uploadQueue = append(seeder.uploadQueue[:i:i], seeder.uploadQueue[i+1:]...)
+			// cancelled request is answered with reject (BEP 6)
+			m.rejectRequest(seeder, request)
+			return
+		}
+	}
+
+	// fast extension peer gets the block being read
+	if seeder.uploadInFlight && seeder.uploadCurrent == request && !seeder.SupportsFast() {
+		seeder.uploadCancelled = true
+	}
+}
+
+// clearUploads drops the requests of choked peer except allowed fast ones
+func (m *Manager) clearUploads(seeder *Seeder) {
+
+	var kept []blockRequest
+
+	for _, request := range seeder.uploadQueue {
+		if seeder.SupportsFast() && seeder.AllowedFast[request.Index] {
+			kept = append(kept, request)
+		} else {
+			m.rejectRequest(seeder, request)
+		}
+	}
+
+	seeder.uploadQueue = kept
+
+	if seeder.uploadInFlight && !seeder.SupportsFast() {
+		seeder.uploadCancelled = true
+	}
+}